@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/timothyham/bbackup/controller"
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+const backupUsage = "usage: bbackup backup [-compress none|gzip|zstd] [-pad none|padme|pow2] [-parity n] [-hash sha256,blake2b,blake3] [-dedup] [-identity file] [-tag a,b] [-xattr-security] [-xattr-trusted] <dir> <destination dir>"
+
+func runBackup(args []string) (err error) {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	compress := flags.String("compress", "none", "compression of the objects")
+	pad := flags.String("pad", "none", "padding of the objects")
+	parity := flags.Int("parity", 0, "parity shards per group of chunks of the objects")
+	dedup := flags.Bool("dedup", false, "split files into chunks stored once")
+	identity := flags.String("identity", "", "file holding the identity of a recipient, to read the dedup key with")
+	hashes := flags.String("hash", "sha256", "comma separated digests of the files and objects")
+	tags := flags.String("tag", "", "comma separated tags of the snapshot")
+	xattrSecurity := flags.Bool("xattr-security", false, "back up extended attributes in the security namespace, such as file capabilities")
+	xattrTrusted := flags.Bool("xattr-trusted", false, "back up extended attributes in the trusted namespace")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New(backupUsage)
+	}
+	opts := controller.Options{Dedup: *dedup, Parity: *parity, XattrSecurity: *xattrSecurity, XattrTrusted: *xattrTrusted}
+	opts.Compression, err = crypto.ParseCompression(*compress)
+	if err != nil {
+		return err
+	}
+	opts.Padding, err = crypto.ParsePadding(*pad)
+	if err != nil {
+		return err
+	}
+	opts.Hashes, err = crypto.ParseHashAlgorithms(*hashes)
+	if err != nil {
+		return err
+	}
+	opts.Tags, err = parseTags(*tags)
+	if err != nil {
+		return err
+	}
+	dest, err := controller.NewDirDestination(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDb(false)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	if *identity != "" {
+		id, err := readIdentity(*identity)
+		if err != nil {
+			return err
+		}
+		db.SetIdentity(id)
+	}
+	err = unlockForBackup(db, *dedup)
+	if err != nil {
+		return err
+	}
+	stats, err := controller.Backup(db, dest, flags.Arg(0), opts)
+	fmt.Fprintf(os.Stderr, "%d added, %d updated, %d unchanged, %d removed, %d other files, %d bytes\n",
+		stats.Added, stats.Updated, stats.Unchanged, stats.Removed, stats.Others, stats.Bytes)
+	if *dedup {
+		fmt.Fprintf(os.Stderr, "%d chunks stored, %d chunks removed\n", stats.Chunks, stats.RemovedChunks)
+	}
+	return err
+}
+
+// unlockForBackup unlocks db, creating its master key if it has none. A
+// db with recipients is left as it is: keys and the metadata snapshot are
+// sealed to them, so backups can run unattended, unless they dedup and
+// the dedup key can't be read without the passphrase.
+func unlockForBackup(db *info.Db, dedup bool) error {
+	recipients, err := db.Recipients()
+	if err != nil {
+		return err
+	}
+	if len(recipients) > 0 {
+		if !dedup || !db.HasMasterKey() {
+			return nil
+		}
+		if _, err = db.DedupKey(); err != info.ErrLocked {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "the dedup key needs the passphrase, or -identity")
+		passphrase, err := readPassphrase("Passphrase: ")
+		if err != nil {
+			return err
+		}
+		return db.Unlock(passphrase)
+	}
+	if !db.HasMasterKey() {
+		fmt.Fprintln(os.Stderr, "the metadata snapshot needs a master passphrase")
+		passphrase, err := readNewPassphrase()
+		if err != nil {
+			return err
+		}
+		return db.InitMasterKey(passphrase)
+	}
+	if _, err = db.MasterKey(); err != info.ErrLocked {
+		return err
+	}
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	return db.Unlock(passphrase)
+}
+
+const recoverDbUsage = "usage: bbackup recover-db [-identity file] <destination dir>"
+
+// runRecoverDb rebuilds the db at the -db path from the metadata snapshot
+// of a destination, with the passphrase or, for a snapshot sealed to
+// recipients, an identity.
+func runRecoverDb(args []string) error {
+	flags := flag.NewFlagSet("recover-db", flag.ContinueOnError)
+	identity := flags.String("identity", "", "file holding the identity of a recipient")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(recoverDbUsage)
+	}
+	if _, err := os.Stat(*dbPath); err == nil {
+		return fmt.Errorf("%s already exists", *dbPath)
+	}
+	dest, err := controller.NewDirDestination(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var db *info.Db
+	if *identity != "" {
+		id, err := readIdentity(*identity)
+		if err != nil {
+			return err
+		}
+		db, err = controller.RecoverDbWithIdentity(dest, id, *dbPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		passphrase, err := readPassphrase("Passphrase: ")
+		if err != nil {
+			return err
+		}
+		db, err = controller.RecoverDb(dest, passphrase, *dbPath)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "recovered %s\n", *dbPath)
+	return db.Close()
+}
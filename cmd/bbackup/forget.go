@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timothyham/bbackup/controller"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+const forgetUsage = "usage: bbackup forget [-keep-last n] [-keep-hourly n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-keep-yearly n] [-keep-within duration] [-keep-tag a,b] [-dry-run] <destination dir>"
+
+// runForget forgets the snapshots a retention policy does not keep, and
+// removes the objects no remaining snapshot needs.
+func runForget(args []string) (err error) {
+	flags := flag.NewFlagSet("forget", flag.ContinueOnError)
+	policy := info.RetentionPolicy{}
+	flags.IntVar(&policy.Last, "keep-last", 0, "keep the n newest snapshots")
+	flags.IntVar(&policy.Hourly, "keep-hourly", 0, "keep the newest snapshot of each of the n newest hours")
+	flags.IntVar(&policy.Daily, "keep-daily", 0, "keep the newest snapshot of each of the n newest days")
+	flags.IntVar(&policy.Weekly, "keep-weekly", 0, "keep the newest snapshot of each of the n newest weeks")
+	flags.IntVar(&policy.Monthly, "keep-monthly", 0, "keep the newest snapshot of each of the n newest months")
+	flags.IntVar(&policy.Yearly, "keep-yearly", 0, "keep the newest snapshot of each of the n newest years")
+	within := flags.String("keep-within", "", "keep the snapshots this long before the newest, such as 36h or 30d")
+	tags := flags.String("keep-tag", "", "comma separated tags of snapshots to keep")
+	dryRun := flags.Bool("dry-run", false, "only list what would be forgotten")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(forgetUsage)
+	}
+	if *within != "" {
+		policy.Within, err = parseDays(*within)
+		if err != nil {
+			return err
+		}
+	}
+	policy.Tags, err = parseTags(*tags)
+	if err != nil {
+		return err
+	}
+	dest, err := controller.NewDirDestination(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	decisions, forgotten, err := controller.Forget(db, dest, policy, *dryRun)
+	for _, d := range decisions {
+		action := "forget"
+		if d.Keep {
+			action = "keep  "
+		}
+		fmt.Fprintf(os.Stderr, "%s %d %s %s", action, d.Snapshot.ID,
+			d.Snapshot.Time.Format("2006-01-02 15:04:05"), strings.Join(d.Snapshot.Tags, ","))
+		if d.Keep {
+			fmt.Fprintf(os.Stderr, " (%s)", strings.Join(d.Reasons, ", "))
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	if forgotten != nil {
+		verb := "removed"
+		if *dryRun {
+			verb = "would be removed"
+		}
+		fmt.Fprintf(os.Stderr, "%d snapshots, %d file versions, %d chunks %s\n",
+			len(forgotten.Snapshots), len(forgotten.Files), len(forgotten.Chunks), verb)
+	}
+	return err
+}
+
+// parseDays parses a duration as time.ParseDuration does, and also a
+// whole number of days such as 30d.
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// parseTags splits a comma separated list of snapshot tags.
+func parseTags(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	tags := strings.Split(s, ",")
+	for _, tag := range tags {
+		if !info.ValidTag(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return tags, nil
+}
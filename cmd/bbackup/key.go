@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/timothyham/bbackup/controller"
+	"github.com/timothyham/bbackup/crypto"
+)
+
+const keyUsage = "usage: bbackup key export --paper [-png file] | import [destination dir]"
+
+// words per line of a printed paper key
+const paperLineWords = 8
+
+func runKey(args []string) error {
+	if len(args) < 1 {
+		return errors.New(keyUsage)
+	}
+	switch args[0] {
+	case "export":
+		return runKeyExport(args[1:])
+	case "import":
+		return runKeyImport(args[1:])
+	}
+	return errors.New(keyUsage)
+}
+
+// runKeyExport prints the master key as a paper key, in words and as a
+// QR code.
+func runKeyExport(args []string) (err error) {
+	flags := flag.NewFlagSet("key export", flag.ContinueOnError)
+	paper := flags.Bool("paper", false, "print a paper key")
+	png := flags.String("png", "", "also write the QR code to this PNG file")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if !*paper || flags.NArg() != 0 {
+		return errors.New(keyUsage)
+	}
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	key, err := db.PaperKey()
+	if err != nil {
+		return err
+	}
+	qr, err := qrcode.New(key.String(), qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	if *png != "" {
+		err = writePNG(*png, qr)
+		if err != nil {
+			return err
+		}
+	}
+
+	p := key.Params
+	fmt.Printf("bbackup paper key of master key %s\n", key.Master.ID)
+	fmt.Printf("argon2id time %d, memory %d KiB, threads %d, salt %d bytes\n\n",
+		p.Time, p.Memory, p.Threads, len(p.Salt))
+	words := key.Words()
+	for i := 0; i < len(words); i += paperLineWords {
+		end := i + paperLineWords
+		if end > len(words) {
+			end = len(words)
+		}
+		fmt.Printf("%2d: %s\n", i/paperLineWords+1, strings.Join(words[i:end], " "))
+	}
+	fmt.Printf("\nthe last 4 words are a checksum, words can be shortened to 4 letters\n\n")
+	fmt.Print(qr.ToSmallString(false))
+	fmt.Fprintln(os.Stderr, "anyone with this paper key can decrypt the backup, keep it offline")
+	return nil
+}
+
+// writePNG writes the QR code to a new file only the user can read.
+func writePNG(path string, qr *qrcode.QRCode) error {
+	b, err := qr.PNG(512)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// runKeyImport reads a paper key. With a destination, the db is recovered
+// from its metadata snapshot; otherwise the existing db is unlocked and a
+// new passphrase set.
+func runKeyImport(args []string) error {
+	if len(args) > 1 {
+		return errors.New(keyUsage)
+	}
+	key, err := readPaperKey()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		err = resetPassphrase(key.Master)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "passphrase changed, export a new paper key")
+		return nil
+	}
+
+	if _, err := os.Stat(*dbPath); err == nil {
+		return fmt.Errorf("%s already exists", *dbPath)
+	}
+	dest, err := controller.NewDirDestination(args[0])
+	if err != nil {
+		return err
+	}
+	db, err := controller.RecoverDbWithKey(dest, key.Master, *dbPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "recovered %s\n", *dbPath)
+	return db.Close()
+}
+
+// readPaperKey reads the words or the QR code text of a paper key up to
+// an empty line.
+func readPaperKey() (*crypto.PaperKey, error) {
+	fmt.Fprintln(os.Stderr, "Paper key words or QR code text, then an empty line:")
+	lines := []string{}
+	for {
+		line, err := stdin.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" && len(lines) > 0 {
+			break
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return crypto.ParsePaperKey(strings.Join(lines, "\n"))
+}
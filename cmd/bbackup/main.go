@@ -1 +1,65 @@
 package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/timothyham/bbackup/config"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":     {"back up a directory to a destination directory", runBackup},
+	"forget":     {"forget snapshots a retention policy does not keep", runForget},
+	"key":        {"export the master key as a paper key, or import one", runKey},
+	"passwd":     {"set or change the master passphrase", runPasswd},
+	"recipient":  {"manage the public keys per-file keys are sealed to", runRecipient},
+	"recover-db": {"rebuild the metadata database from a destination", runRecoverDb},
+	"restore":    {"restore a snapshot to a directory", runRestore},
+	"salvage":    {"write what is left of a damaged backed up file", runSalvage},
+	"seal":       {"write an encrypted copy of the metadata database", runSeal},
+	"shares":     {"split the master key into shares, or recover it from them", runShares},
+}
+
+var dbPath = flag.String("db", "bbackup.db", "path of the metadata database")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bbackup [flags] <command> [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.BoolVar(&config.Debug, "debug", false, "print debug messages")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bbackup %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase prompts for a passphrase on stderr. The passphrase is not
+// echoed if stdin is a terminal.
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readNewPassphrase prompts for a new passphrase twice.
+func readNewPassphrase() (string, error) {
+	p1, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p1 == "" {
+		return "", errors.New("empty passphrase")
+	}
+	p2, err := readPassphrase("Repeat new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p1 != p2 {
+		return "", errors.New("passphrases do not match")
+	}
+	return p1, nil
+}
+
+// openDb opens the metadata db. A sealed db is always opened with the
+// passphrase; other dbs are unlocked if unlock is set and they have a
+// master key.
+func openDb(unlock bool) (*info.Db, error) {
+	if info.IsSealedDb(*dbPath) {
+		passphrase, err := readPassphrase("Passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		return info.OpenSealedDb(*dbPath, passphrase)
+	}
+	db, err := info.OpenDb(*dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if !unlock || !db.HasMasterKey() {
+		return db, nil
+	}
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	err = db.Unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDbWithKey opens the db unlocked with master, recovered without the
+// passphrase.
+func openDbWithKey(master *crypto.MasterKey) (*info.Db, error) {
+	if info.IsSealedDb(*dbPath) {
+		return info.OpenSealedDbWithKey(*dbPath, master)
+	}
+	if _, err := os.Stat(*dbPath); err != nil {
+		return nil, err
+	}
+	db, err := info.OpenDb(*dbPath)
+	if err != nil {
+		return nil, err
+	}
+	err = db.UnlockWithKey(master)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// resetPassphrase unlocks the db with master, recovered without the
+// passphrase, and sets a new passphrase. The new passphrase derives a new
+// master key.
+func resetPassphrase(master *crypto.MasterKey) (err error) {
+	db, err := openDbWithKey(master)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	return db.ChangePassphrase(passphrase)
+}
+
+// closeDb closes db, and sets *err to the error of Close if it is nil.
+// Closing a sealed db writes it back.
+func closeDb(db *info.Db, err *error) {
+	cerr := db.Close()
+	if *err == nil {
+		*err = cerr
+	}
+}
+
+func runPasswd(args []string) (err error) {
+	if len(args) != 0 {
+		return errors.New("passwd takes no arguments")
+	}
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	err = db.ChangePassphrase(passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "passphrase changed")
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+const recipientUsage = "usage: bbackup recipient gen <name> | add <name> <recipient> | list | rm <name>"
+
+func runRecipient(args []string) (err error) {
+	if len(args) < 1 {
+		return errors.New(recipientUsage)
+	}
+	db, err := openDb(false)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	switch {
+	case args[0] == "gen" && len(args) == 2:
+		// the identity is printed, never stored
+		id, err := crypto.GenerateIdentity()
+		if err != nil {
+			return err
+		}
+		err = db.AddRecipient(args[1], id.Recipient())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "added recipient %s %s\n", args[1], id.Recipient())
+		fmt.Fprintln(os.Stderr, "keep this identity offline, it is needed to restore:")
+		fmt.Println(id)
+	case args[0] == "add" && len(args) == 3:
+		r, err := crypto.ParseRecipient(args[2])
+		if err != nil {
+			return err
+		}
+		return db.AddRecipient(args[1], r)
+	case args[0] == "list" && len(args) == 1:
+		recipients, err := db.Recipients()
+		if err != nil {
+			return err
+		}
+		for _, r := range recipients {
+			fmt.Printf("%s\t%s\n", r.Name, r.Recipient)
+		}
+	case args[0] == "rm" && len(args) == 2:
+		return db.RemoveRecipient(args[1])
+	default:
+		return errors.New(recipientUsage)
+	}
+	return nil
+}
+
+// readIdentity reads an identity, as printed by recipient gen, from the
+// file at path.
+func readIdentity(path string) (*crypto.Identity, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ParseIdentity(strings.TrimSpace(string(b)))
+}
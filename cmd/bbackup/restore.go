@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timothyham/bbackup/controller"
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+const restoreUsage = "usage: bbackup restore [-at time] <destination dir> <target dir>"
+
+// runRestore writes the files of the newest snapshot, or of the newest
+// one taken at or before a time, to a directory.
+func runRestore(args []string) (err error) {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	at := flags.String("at", "", "restore the snapshot as of this time, such as 2021-03-04 or 2021-03-04T15:04:05Z")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New(restoreUsage)
+	}
+	dest, err := controller.NewDirDestination(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	var s *info.Snapshot
+	if *at == "" {
+		s, err = db.LatestSnapshot()
+	} else {
+		var t time.Time
+		t, err = parseTime(*at)
+		if err != nil {
+			return err
+		}
+		s, err = db.SnapshotAsOf(t)
+	}
+	if err == info.NoResultError {
+		return errors.New("no snapshot to restore")
+	}
+	if err != nil {
+		return err
+	}
+	err = controller.Restore(db, dest, s, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored snapshot %d of %s to %s\n",
+		s.ID, s.Time.Format("2006-01-02 15:04:05"), flags.Arg(1))
+	return nil
+}
+
+// restoreWithKey restores the newest snapshot of destDir to target with
+// master, recovered without the passphrase. Without a db, the metadata
+// snapshot of destDir is recovered to a temporary db, which is removed
+// afterwards.
+func restoreWithKey(master *crypto.MasterKey, destDir, target string) (err error) {
+	dest, err := controller.NewDirDestination(destDir)
+	if err != nil {
+		return err
+	}
+	db, err := openDbWithKey(master)
+	if os.IsNotExist(err) {
+		tmp, terr := ioutil.TempDir("", "bbackup")
+		if terr != nil {
+			return terr
+		}
+		defer os.RemoveAll(tmp)
+		db, err = controller.RecoverDbWithKey(dest, master, filepath.Join(tmp, "bbackup.db"))
+	}
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	s, err := db.LatestSnapshot()
+	if err == info.NoResultError {
+		return errors.New("no snapshot to restore")
+	}
+	if err != nil {
+		return err
+	}
+	err = controller.Restore(db, dest, s, target)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored snapshot %d of %s to %s\n",
+		s.ID, s.Time.Format("2006-01-02 15:04:05"), target)
+	return nil
+}
+
+// parseTime parses an RFC 3339 time, or a date, which is the end of that
+// day in local time.
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
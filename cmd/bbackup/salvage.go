@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/timothyham/bbackup/controller"
+	"github.com/timothyham/bbackup/crypto"
+)
+
+const salvageUsage = "usage: bbackup salvage [-skip] <destination dir> <name> <output file>"
+
+// runSalvage writes what is left of a damaged backed up file to a new
+// file, and lists the byte ranges that were lost.
+func runSalvage(args []string) (err error) {
+	flags := flag.NewFlagSet("salvage", flag.ContinueOnError)
+	skip := flags.Bool("skip", false, "leave damaged ranges out instead of zero filling them")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 3 {
+		return errors.New(salvageUsage)
+	}
+	mode := crypto.SalvageZeroFill
+	if *skip {
+		mode = crypto.SalvageSkip
+	}
+	dest, err := controller.NewDirDestination(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	m, err := db.GetByName(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(1), err)
+	}
+
+	outPath := flags.Arg(2)
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	damaged, err := controller.SalvageFile(db, dest, m, out, mode)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range damaged {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if len(damaged) > 0 {
+		return fmt.Errorf("%s written with %d damaged ranges", outPath, len(damaged))
+	}
+	fmt.Fprintf(os.Stderr, "%s written, nothing was damaged\n", outPath)
+	return nil
+}
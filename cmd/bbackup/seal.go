@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/timothyham/bbackup/metadata"
+)
+
+const sealUsage = "usage: bbackup seal <sealed db>"
+
+// runSeal writes the metadata db encrypted with the master key to a new
+// file, which can then be used with -db. A master key is set up first if
+// the db has none.
+func runSeal(args []string) (err error) {
+	if len(args) != 1 {
+		return errors.New(sealUsage)
+	}
+	if info.IsSealedDb(*dbPath) {
+		return errors.New("db is already sealed")
+	}
+	sealedPath := args[0]
+	if _, err := os.Stat(sealedPath); err == nil {
+		return fmt.Errorf("%s already exists", sealedPath)
+	}
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	if !db.HasMasterKey() {
+		passphrase, err := readNewPassphrase()
+		if err != nil {
+			return err
+		}
+		err = db.InitMasterKey(passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(sealedPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = db.WriteSealed(out)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(sealedPath)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "sealed db written to %s, use it with -db %s\n", sealedPath, sealedPath)
+	return nil
+}
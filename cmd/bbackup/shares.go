@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+const sharesUsage = "usage: bbackup shares split [-k threshold] [-n shares] | combine -reset | combine <destination dir> <target dir>"
+
+func runShares(args []string) error {
+	if len(args) < 1 {
+		return errors.New(sharesUsage)
+	}
+	switch args[0] {
+	case "split":
+		return runSplit(args[1:])
+	case "combine":
+		return runCombine(args[1:])
+	}
+	return errors.New(sharesUsage)
+}
+
+// runSplit prints the shares of the master key, to be handed out to
+// different people.
+func runSplit(args []string) (err error) {
+	flags := flag.NewFlagSet("shares split", flag.ContinueOnError)
+	k := flags.Int("k", 3, "shares needed to recover the master key")
+	n := flags.Int("n", 5, "shares to print")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New(sharesUsage)
+	}
+	db, err := openDb(true)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	master, err := db.MasterKey()
+	if err != nil {
+		return err
+	}
+	shares, err := crypto.SplitMasterKey(master, *k, *n)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "any %d of these %d shares recover the master key:\n", *k, *n)
+	for _, s := range shares {
+		fmt.Printf("share %d of %d: %s\n", s.X, *n, s)
+	}
+	return nil
+}
+
+// runCombine reads shares until there are enough to recover the master
+// key, and restores the newest snapshot to a directory with it, from the
+// db if there is one and otherwise from the metadata snapshot of the
+// destination. The passphrase is left as it is. With -reset, the db is
+// unlocked with the key and a new passphrase set instead; the new
+// passphrase derives a new master key, so the old shares and paper keys
+// stop working.
+func runCombine(args []string) error {
+	flags := flag.NewFlagSet("shares combine", flag.ContinueOnError)
+	reset := flags.Bool("reset", false, "set a new passphrase, which stops every share and paper key working")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if (*reset && flags.NArg() != 0) || (!*reset && flags.NArg() != 2) {
+		return errors.New(sharesUsage)
+	}
+	master, err := readShares()
+	if err != nil {
+		return err
+	}
+	if !*reset {
+		return restoreWithKey(master, flags.Arg(0), flags.Arg(1))
+	}
+	err = resetPassphrase(master)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "master key recovered and passphrase changed, split the new master key again")
+	return nil
+}
+
+// readShares reads shares until there are enough to recover the master
+// key, and returns it.
+func readShares() (*crypto.MasterKey, error) {
+	shares := make([]*crypto.Share, 0)
+	seen := make(map[int]bool)
+	for len(shares) == 0 || len(seen) < shares[0].Threshold {
+		text, err := readPassphrase("Share: ")
+		if err != nil {
+			return nil, err
+		}
+		s, err := crypto.ParseShare(text)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v, try again\n", err)
+			continue
+		}
+		if seen[s.X] {
+			fmt.Fprintf(os.Stderr, "already have share %d\n", s.X)
+			continue
+		}
+		seen[s.X] = true
+		shares = append(shares, s)
+	}
+	return crypto.CombineShares(shares)
+}
@@ -0,0 +1,577 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timothyham/bbackup/config"
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// MetadataSnapshotName is the object the sealed metadata db is uploaded
+// as after each backup run, so it can be recovered with the passphrase
+// alone.
+const MetadataSnapshotName = "bbackup-metadata"
+
+// Options control how objects are encrypted.
+type Options struct {
+	Compression crypto.Compression
+	Padding     crypto.Padding
+	Hashes      []crypto.HashAlgorithm // crypto.DefaultHashes if empty
+
+	// Parity adds that many Reed-Solomon parity shards to each group of
+	// crypto.ParityGroup chunks of an object, so damaged chunks can be
+	// rebuilt when it is read.
+	Parity int
+
+	// Dedup splits files into content-defined chunks, each stored once
+	// as its own object.
+	Dedup         bool
+	ChunkerParams crypto.ChunkerParams // crypto.DefaultChunkerParams if zero
+
+	// Tags are given to the snapshot, for retention policies to keep it
+	// by.
+	Tags []string
+
+	// Extended attributes in the user namespace and POSIX ACLs are always
+	// backed up; those in the security namespace, such as file
+	// capabilities, and in the trusted namespace only if these are set.
+	XattrSecurity bool
+	XattrTrusted  bool
+}
+
+// encryptor returns a new encryptor set up with opts.
+func (opts Options) encryptor() (*crypto.Encryptor, error) {
+	enc, err := crypto.NewEncryptor()
+	if err != nil {
+		return nil, err
+	}
+	enc.SetCompression(opts.Compression)
+	enc.SetPadding(opts.Padding)
+	err = enc.SetParity(opts.Parity)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Hashes) > 0 {
+		err = enc.SetHashes(opts.Hashes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return enc, nil
+}
+
+// Stats counts what a backup run did. Added, Updated, Unchanged and
+// Removed count regular files; directories, links and special files are
+// only counted in Others.
+type Stats struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Removed   int   // files of the previous snapshot that are gone
+	Others    int   // other files, changed or not
+	Bytes     int64 // plaintext bytes encrypted
+
+	Chunks        int // new chunks stored
+	RemovedChunks int // chunks no longer referenced
+}
+
+// Backup backs up the tree under root to dest as a new snapshot in db.
+// Files are named in db by their slash separated path relative to root,
+// root itself being ".". Regular files are only encrypted again, as a new
+// version, if their size, modification time, owner or permissions
+// changed; an unchanged file keeps its version. Directories, symlinks,
+// FIFOs and device files only have metadata, and the names of a file
+// with hardlinks after the first are stored as hardlinks to it. Sockets
+// are left out. The extended attributes opts include are encrypted to an
+// object of their own, and told apart by a hash keyed with the dedup key;
+// if the db can't read that key, such as a locked db with recipients and
+// no identity, files with attributes are backed up again. Earlier versions stay in the snapshots that hold them, so a db holds the
+// history of one root. Finally the sealed db is uploaded as
+// MetadataSnapshotName. db needs an unlocked master key or recipients, so
+// a db with recipients can be backed up without a passphrase.
+func Backup(db *info.Db, dest Destination, root string, opts Options) (Stats, error) {
+	stats := Stats{}
+	recipients, err := db.Recipients()
+	if err != nil {
+		return stats, err
+	}
+	if len(recipients) == 0 && !db.HasMasterKey() {
+		return stats, info.ErrNoMasterKey
+	}
+	var dedup *crypto.DedupKey
+	dedupRead := false
+	xattrHash := func(xattrs []info.Xattr) (string, error) {
+		if len(xattrs) == 0 {
+			return "", nil
+		}
+		if !dedupRead {
+			key, err := db.DedupKey()
+			if err != nil && err != info.ErrLocked && err != crypto.ErrNoIdentity {
+				return "", err
+			}
+			dedup, dedupRead = key, true
+		}
+		if dedup == nil {
+			return "", nil
+		}
+		return info.XattrHash(dedup, xattrs), nil
+	}
+	snapshot := &info.Snapshot{Time: time.Now(), Root: root, Tags: opts.Tags}
+	files := make([]*info.Info, 0)
+	seen := make(map[string]bool)
+	links := make(map[fileID]string)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		m, err := fileInfo(path, name, fi, links)
+		if m == nil || err != nil {
+			return err
+		}
+		var xattrs []info.Xattr
+		if m.Type != info.TypeHardlink {
+			xattrs, err = listXattrs(path, opts)
+			if err != nil {
+				return err
+			}
+			m.XattrHash, err = xattrHash(xattrs)
+			if err != nil {
+				return err
+			}
+		}
+		seen[name] = true
+		m, err = backupFile(db, dest, path, m, xattrs, opts, &stats)
+		if err != nil {
+			return err
+		}
+		files = append(files, m)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	previous, err := db.LatestSnapshot()
+	if err == nil {
+		var old []*info.Info
+		old, err = db.SnapshotFiles(previous)
+		for _, m := range old {
+			if m.Type == info.TypeFile && !seen[m.Name] {
+				stats.Removed += 1
+			}
+		}
+	}
+	if err != nil && err != info.NoResultError {
+		return stats, err
+	}
+	err = db.InsertSnapshot(snapshot, files)
+	if err != nil {
+		return stats, err
+	}
+	err = prune(db, dest, &stats)
+	if err != nil {
+		return stats, err
+	}
+	return stats, UploadSnapshot(db, dest)
+}
+
+// backupFile returns the newest version in db of the file at path, which
+// was stat'ed as m, if it has not changed. Otherwise it stores m as a new
+// version, encrypting the content of a regular file and its extended
+// attributes xattrs to new objects, and returns it.
+func backupFile(db *info.Db, dest Destination, path string, m *info.Info, xattrs []info.Xattr, opts Options, stats *Stats) (*info.Info, error) {
+	old, err := db.GetByName(m.Name)
+	if err != nil && err != info.NoResultError {
+		return nil, err
+	}
+	// attributes without a hash can't be told apart from the old ones
+	same := old != nil && unchanged(old, m) && (len(xattrs) == 0 || m.XattrHash != "")
+	if m.Type != info.TypeFile {
+		stats.Others += 1
+		if same {
+			return old, nil
+		}
+		err = putXattrs(dest, m, xattrs, opts)
+		if err == nil {
+			err = db.Insert(m)
+		}
+		if err != nil {
+			removeXattrs(dest, m)
+			return nil, err
+		}
+		return m, nil
+	}
+	if same {
+		stats.Unchanged += 1
+		return old, nil
+	}
+	if config.Debug {
+		config.Logger.Printf("backing up %s\n", m.Name)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	err = putXattrs(dest, m, xattrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Dedup {
+		err = backupChunked(db, dest, in, m, opts, stats)
+	} else {
+		err = backupWhole(db, dest, in, m, opts, stats)
+	}
+	if err != nil {
+		removeXattrs(dest, m)
+		return nil, err
+	}
+
+	if old == nil || old.Type != info.TypeFile {
+		stats.Added += 1
+	} else {
+		stats.Updated += 1
+	}
+	return m, nil
+}
+
+// fileID tells the names of a file with hardlinks.
+type fileID struct {
+	device, inode uint64
+}
+
+// fileInfo returns the metadata of the file at path, named name, which
+// was stat'ed as fi, or nil if it is a socket or of some other type that
+// can't be restored. A regular file with more than one link is a
+// hardlink to the first name links has of it, or else is added to links.
+func fileInfo(path, name string, fi os.FileInfo, links map[fileID]string) (*info.Info, error) {
+	mode := fi.Mode()
+	m := &info.Info{
+		Name:     name,
+		Modified: fi.ModTime(),
+		Perms:    fromFileMode(mode),
+	}
+	nlink := statInfo(m, fi)
+	switch {
+	case mode.IsRegular():
+		m.Type = info.TypeFile
+		m.Size = fi.Size()
+	case mode.IsDir():
+		m.Type = info.TypeDir
+	case mode&os.ModeSymlink != 0:
+		m.Type = info.TypeSymlink
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		m.LinkTarget = target
+	case mode&os.ModeNamedPipe != 0:
+		m.Type = info.TypeFIFO
+	case mode&os.ModeCharDevice != 0:
+		m.Type = info.TypeCharDevice
+	case mode&os.ModeDevice != 0:
+		m.Type = info.TypeBlockDevice
+	default:
+		return nil, nil
+	}
+	if m.Type == info.TypeFile && nlink > 1 {
+		id := fileID{m.Device, m.Inode}
+		if first, ok := links[id]; ok {
+			m.Type = info.TypeHardlink
+			m.LinkTarget = first
+			m.Size = 0
+		} else {
+			links[id] = name
+		}
+	}
+	return m, nil
+}
+
+// backupWhole encrypts in to a single new object and stores m for it.
+func backupWhole(db *info.Db, dest Destination, in io.Reader, m *info.Info, opts Options, stats *Stats) error {
+	enc, err := opts.encryptor()
+	if err != nil {
+		return err
+	}
+	encname, err := crypto.NewEncname()
+	if err != nil {
+		return err
+	}
+	w, size, err := putObject(dest, encname, enc, in)
+	if err != nil {
+		return err
+	}
+	hash := w.Hash()
+	m.Size = size
+	m.Encname = encname
+	m.EncFormat = w.Format()
+	m.Key = enc.GetKey()
+	m.IV = enc.GetIv()
+	m.Hashes = hash.In
+	m.EncHashes = hash.Out
+	err = db.Insert(m)
+	if err != nil {
+		dest.Remove(encname)
+		return err
+	}
+	stats.Bytes += size
+	return nil
+}
+
+// backupChunked splits in into content-defined chunks, stores the chunks
+// that are not in db yet as new objects, and stores m with its chunk
+// list.
+func backupChunked(db *info.Db, dest Destination, in io.Reader, m *info.Info, opts Options, stats *Stats) error {
+	dedup, err := db.DedupKey()
+	if err != nil {
+		return err
+	}
+	algs := opts.Hashes
+	if len(algs) == 0 {
+		algs = crypto.DefaultHashes
+	}
+	hashes, err := crypto.NewHashSet(algs)
+	if err != nil {
+		return err
+	}
+	params := opts.ChunkerParams
+	if params == (crypto.ChunkerParams{}) {
+		params = crypto.DefaultChunkerParams
+	}
+	chunker, err := dedup.NewChunker(io.TeeReader(in, hashes), params)
+	if err != nil {
+		return err
+	}
+
+	chunks := make([]*info.Chunk, 0)
+	m.Size = 0
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		id := dedup.ChunkID(data)
+		c, err := db.GetChunk(id)
+		if err == info.NoResultError {
+			c, err = putChunk(db, dest, id, data, opts)
+			if err == nil {
+				stats.Chunks += 1
+				stats.Bytes += c.Size
+			}
+		}
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, c)
+		m.Size += int64(len(data))
+	}
+	m.Encname = ""
+	m.EncFormat = 0
+	m.Key = ""
+	m.IV = ""
+	m.Hashes = hashes.Digests()
+	m.EncHashes = nil
+	return db.InsertChunked(m, chunks)
+}
+
+// putChunk encrypts data to a new object and stores it as the chunk id.
+func putChunk(db *info.Db, dest Destination, id string, data []byte, opts Options) (*info.Chunk, error) {
+	enc, err := opts.encryptor()
+	if err != nil {
+		return nil, err
+	}
+	enc.SetHashes() // the chunk id identifies the content
+	encname, err := crypto.NewEncname()
+	if err != nil {
+		return nil, err
+	}
+	c := &info.Chunk{ChunkID: id, Encname: encname}
+	w, size, err := putObject(dest, c.Encname, enc, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	c.Size = size
+	c.EncFormat = w.Format()
+	c.Key = enc.GetKey()
+	c.IV = enc.GetIv()
+	err = db.InsertChunk(c)
+	if err != nil {
+		dest.Remove(c.Encname)
+		return nil, err
+	}
+	return c, nil
+}
+
+// putObject encrypts in to a new object of dest, and returns the closed
+// writer, which has the hashes and format of the object, and the size of
+// in.
+func putObject(dest Destination, name string, enc *crypto.Encryptor, in io.Reader) (*crypto.EncryptWriter, int64, error) {
+	out, err := dest.Create(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := crypto.NewEncryptWriter(enc, out)
+	size, err := io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		out.Abort()
+		return nil, 0, err
+	}
+	return w, size, out.Commit()
+}
+
+// prune removes the file versions no snapshot holds, left by a failed
+// backup run, from db and dest, and then the chunks no file version refers
+// to any more.
+func prune(db *info.Db, dest Destination, stats *Stats) error {
+	forgotten, err := db.Forget(nil, false)
+	if err != nil {
+		return err
+	}
+	stats.RemovedChunks += len(forgotten.Chunks)
+	return removeObjects(dest, forgotten)
+}
+
+// removeObjects removes the objects of the file versions and chunks db
+// forgot from dest.
+func removeObjects(dest Destination, forgotten *info.Forgotten) error {
+	names := make([]string, 0, len(forgotten.Files)+len(forgotten.Chunks))
+	for _, m := range forgotten.Files {
+		if m.Encname != "" {
+			names = append(names, m.Encname)
+		}
+		if m.XattrEncname != "" {
+			names = append(names, m.XattrEncname)
+		}
+	}
+	for _, c := range forgotten.Chunks {
+		names = append(names, c.Encname)
+	}
+	for _, name := range names {
+		err := dest.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile decrypts the content of m from dest to out, whether it is
+// stored as one object or as chunks.
+func ReadFile(db *info.Db, dest Destination, m *info.Info, out io.Writer) error {
+	if m.Encname != "" {
+		return readObject(dest, m.Encname, m.Key, m.IV, out)
+	}
+	chunks, err := db.FileChunks(m)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		err = readObject(dest, c.Encname, c.Key, c.IV, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrSealedKey is returned when reading an object whose key is sealed to
+// recipients the db can't unseal for: a db without the identity of one of
+// them, and without the master key unlocked or the key sealed to it.
+var ErrSealedKey = errors.New("key sealed to recipients, needs one of their identities")
+
+// checkKey returns an error if key, read from the db, was not unwrapped.
+func checkKey(name, key string) error {
+	if crypto.IsSealed(key) {
+		return fmt.Errorf("%w: %s", ErrSealedKey, name)
+	}
+	if crypto.IsWrapped(key) {
+		return fmt.Errorf("%w: %s", info.ErrLocked, name)
+	}
+	return nil
+}
+
+// readObject decrypts the object name of dest to out.
+func readObject(dest Destination, name, key, iv string, out io.Writer) error {
+	err := checkKey(name, key)
+	if err != nil {
+		return err
+	}
+	in, err := dest.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dec, err := crypto.NewDecryptor(key, iv)
+	if err != nil {
+		return err
+	}
+	_, err = dec.Encrypt(out, in, false)
+	return err
+}
+
+// UploadSnapshot uploads db, sealed with its master key or to its
+// recipients, to dest as MetadataSnapshotName.
+func UploadSnapshot(db *info.Db, dest Destination) error {
+	out, err := dest.Create(MetadataSnapshotName)
+	if err != nil {
+		return err
+	}
+	err = db.WriteSealed(out)
+	if err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// RecoverDb downloads the metadata snapshot from dest and writes it to a
+// new db at dbPath, unlocked with passphrase.
+func RecoverDb(dest Destination, passphrase, dbPath string) (*info.Db, error) {
+	in, err := dest.Open(MetadataSnapshotName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return info.RecoverDb(in, passphrase, dbPath)
+}
+
+// RecoverDbWithKey is RecoverDb with a master key, such as one from a
+// paper key, instead of the passphrase.
+func RecoverDbWithKey(dest Destination, master *crypto.MasterKey, dbPath string) (*info.Db, error) {
+	in, err := dest.Open(MetadataSnapshotName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return info.RecoverDbWithKey(in, master, dbPath)
+}
+
+// RecoverDbWithIdentity is RecoverDb for a metadata snapshot sealed to
+// the recipients of the db, with the identity of one of them.
+func RecoverDbWithIdentity(dest Destination, id *crypto.Identity, dbPath string) (*info.Db, error) {
+	in, err := dest.Open(MetadataSnapshotName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return info.RecoverDbWithIdentity(in, id, dbPath)
+}
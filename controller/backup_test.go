@@ -0,0 +1,493 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// tempDir returns a new temporary directory
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	return dir
+}
+
+// readFile decrypts the content of m from dest
+func readFile(t *testing.T, db *info.Db, dest Destination, m *info.Info) []byte {
+	out := &bytes.Buffer{}
+	err := ReadFile(db, dest, m, out)
+	if err != nil {
+		t.Fatalf("%s: could not read file: %v", m.Name, err)
+	}
+	return out.Bytes()
+}
+
+func TestBackup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	files := map[string]string{
+		"a.txt":       "hello",
+		"sub/b.txt":   "world",
+		"sub/c/d.bin": string(bytes.Repeat([]byte{1, 2, 3}, 100000)),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		err := ioutil.WriteFile(path, []byte(content), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+
+	opts := Options{
+		Compression: crypto.CompressionZstd,
+		Padding:     crypto.PaddingPadme,
+		Hashes:      []crypto.HashAlgorithm{crypto.HashBLAKE3},
+	}
+	_, err = Backup(db, dest, root, opts)
+	if err != info.ErrNoMasterKey {
+		t.Errorf("expected ErrNoMasterKey, got %v", err)
+	}
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	if stats.Added != 3 || stats.Unchanged != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for name, content := range files {
+		m, err := db.GetByName(name)
+		if err != nil {
+			t.Fatalf("%s: not in db: %v", name, err)
+		}
+		if m.Perms != 0640 || m.Size != int64(len(content)) {
+			t.Errorf("%s: unexpected metadata %+v", name, m)
+		}
+		if string(readFile(t, db, dest, m)) != content {
+			t.Errorf("%s: object differs", name)
+		}
+		if len(m.Hashes) != 1 || m.Hashes[crypto.HashBLAKE3] == "" || m.EncHashes[crypto.HashBLAKE3] == "" {
+			t.Errorf("%s: unexpected hashes %v %v", name, m.Hashes, m.EncHashes)
+		}
+	}
+
+	// change one file, remove another
+	old, _ := db.GetByName("a.txt")
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("hello again"), 0640)
+	os.Chtimes(filepath.Join(root, "a.txt"), time.Now(), time.Now().Add(time.Hour))
+	os.Remove(filepath.Join(root, "sub", "b.txt"))
+	removed, _ := db.GetByName("sub/b.txt")
+
+	stats, err = Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up again: %v", err)
+	}
+	if stats.Added != 0 || stats.Updated != 1 || stats.Unchanged != 1 || stats.Removed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	m, _ := db.GetByName("a.txt")
+	if string(readFile(t, db, dest, m)) != "hello again" {
+		t.Errorf("updated object differs")
+	}
+	latest, err := db.LatestSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetInSnapshot(latest, "sub/b.txt"); err != info.NoResultError {
+		t.Errorf("removed file still in the snapshot: %v", err)
+	}
+	current, err := db.SnapshotFiles(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regular := make([]*info.Info, 0)
+	for _, m := range current {
+		if m.Type == info.TypeFile {
+			regular = append(regular, m)
+		}
+	}
+	if len(current) != 5 || len(regular) != 2 || regular[0].ID != m.ID {
+		t.Errorf("unexpected snapshot files %v", current)
+	}
+
+	// the first snapshot still has the old versions
+	snapshots, err := db.Snapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[1].ID != latest.ID || snapshots[0].Root != root {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	for name, expected := range map[string]*info.Info{"a.txt": old, "sub/b.txt": removed} {
+		m, err := db.GetAsOf(name, snapshots[0].Time)
+		if err != nil || m.ID != expected.ID {
+			t.Fatalf("%s: unexpected version %v: %v", name, m, err)
+		}
+		if string(readFile(t, db, dest, m)) != files[name] {
+			t.Errorf("%s: old version differs", name)
+		}
+	}
+}
+
+func TestRecoverDb(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "lost.db"))
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	paper, err := db.PaperKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	recoveredPath := filepath.Join(dir, "recovered.db")
+	_, err = RecoverDb(dest, "battery staple", recoveredPath)
+	if err != crypto.ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	recovered, err := RecoverDb(dest, "correct horse", recoveredPath)
+	if err != nil {
+		t.Fatalf("could not recover: %v", err)
+	}
+	defer recovered.Close()
+	m, err := recovered.GetByName("file")
+	if err != nil {
+		t.Fatalf("file not in recovered db: %v", err)
+	}
+	if string(readFile(t, recovered, dest, m)) != "content" {
+		t.Errorf("object differs")
+	}
+
+	_, err = RecoverDb(dest, "correct horse", recoveredPath)
+	if !os.IsExist(err) {
+		t.Errorf("expected existing db not to be overwritten, got %v", err)
+	}
+
+	// the paper key alone is enough
+	paper, err = crypto.ParsePaperKey(strings.Join(paper.Words(), " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPaper, err := RecoverDbWithKey(dest, paper.Master, filepath.Join(dir, "paper.db"))
+	if err != nil {
+		t.Fatalf("could not recover with paper key: %v", err)
+	}
+	defer fromPaper.Close()
+	m, err = fromPaper.GetByName("file")
+	if err != nil || string(readFile(t, fromPaper, dest, m)) != "content" {
+		t.Errorf("file not recovered with paper key: %v", err)
+	}
+}
+
+func TestBackupRecipients(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only recipients, no passphrase
+	db := info.NewDb(filepath.Join(dir, "unattended.db"))
+	err = db.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up with recipients: %v", err)
+	}
+	m := mustGet(t, db, "file")
+	if !crypto.IsSealed(m.Key) {
+		t.Errorf("key not sealed: %s", m.Key)
+	}
+	db.Close()
+
+	_, err = RecoverDb(dest, "correct horse", filepath.Join(dir, "passphrase.db"))
+	if err != crypto.ErrNoIdentity {
+		t.Errorf("expected ErrNoIdentity, got %v", err)
+	}
+	_, err = RecoverDbWithIdentity(dest, other, filepath.Join(dir, "other.db"))
+	if err != crypto.ErrNoIdentity {
+		t.Errorf("expected ErrNoIdentity, got %v", err)
+	}
+	recovered, err := RecoverDbWithIdentity(dest, id, filepath.Join(dir, "recovered.db"))
+	if err != nil {
+		t.Fatalf("could not recover with identity: %v", err)
+	}
+	defer recovered.Close()
+	m = mustGet(t, recovered, "file")
+	if string(readFile(t, recovered, dest, m)) != "content" {
+		t.Errorf("object differs")
+	}
+
+	// a db with a master key and recipients needs no passphrase either
+	db = info.NewDb(filepath.Join(dir, "locked.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err == nil {
+		err = db.AddRecipient("offline", id.Recipient())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up locked with recipients: %v", err)
+	}
+	m = mustGet(t, db, "file")
+	err = ReadFile(db, dest, m, ioutil.Discard)
+	if !errors.Is(err, ErrSealedKey) {
+		t.Errorf("expected ErrSealedKey, got %v", err)
+	}
+	// and is restored with the passphrase as well as the identity
+	err = db.Unlock("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = mustGet(t, db, "file")
+	if string(readFile(t, db, dest, m)) != "content" {
+		t.Errorf("object differs")
+	}
+	db.Lock()
+
+	// dedup uses a dedup key sealed to the recipients, read with an
+	// identity
+	db.SetIdentity(id)
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("new content"), 0600)
+	os.Chtimes(filepath.Join(root, "file"), time.Now(), time.Now().Add(time.Hour))
+	stats, err := Backup(db, dest, root, Options{Dedup: true})
+	if err != nil {
+		t.Fatalf("could not back up with dedup: %v", err)
+	}
+	if stats.Updated != 1 || stats.Chunks != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// A db that gets recipients after its first backups is backed up locked
+// without reading its dedup key, which is wrapped with the master key.
+func TestBackupLockedRecipients(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	err = db.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	stats, err := Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up locked: %v", err)
+	}
+	if stats.Unchanged != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// objects returns the number of objects in dest
+func objects(t *testing.T, dest *DirDestination) int {
+	names, err := ioutil.ReadDir(dest.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestBackupDedup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "a"), 0700)
+	content := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	ioutil.WriteFile(filepath.Join(root, "a", "big"), content, 0600)
+	ioutil.WriteFile(filepath.Join(root, "empty"), nil, 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{
+		Compression:   crypto.CompressionZstd,
+		Dedup:         true,
+		ChunkerParams: crypto.ChunkerParams{Min: 4 * 1024, Avg: 16 * 1024, Max: 64 * 1024},
+	}
+	stats, err := Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	first := stats.Chunks
+	if first < 5 || stats.Bytes != int64(len(content)) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// a copy under another name, and an append to the original, only
+	// store the chunks at the end of the original
+	ioutil.WriteFile(filepath.Join(root, "copy"), content, 0600)
+	appended := append(append([]byte{}, content...), []byte("appended")...)
+	ioutil.WriteFile(filepath.Join(root, "a", "big"), appended, 0600)
+	os.Chtimes(filepath.Join(root, "a", "big"), time.Now(), time.Now().Add(time.Hour))
+	stats, err = Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up again: %v", err)
+	}
+	if stats.Added != 1 || stats.Updated != 1 || stats.Chunks < 1 || stats.Chunks > 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for name, expected := range map[string][]byte{"copy": content, "a/big": appended, "empty": nil} {
+		m, err := db.GetByName(name)
+		if err != nil {
+			t.Fatalf("%s: not in db: %v", name, err)
+		}
+		if !bytes.Equal(readFile(t, db, dest, m), expected) || m.Size != int64(len(expected)) {
+			t.Errorf("%s: content differs", name)
+		}
+	}
+
+	// the chunks only the original had stay with its old version once it
+	// is gone
+	before := objects(t, dest)
+	os.Remove(filepath.Join(root, "copy"))
+	stats, err = Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up after removal: %v", err)
+	}
+	if stats.Removed != 1 || stats.RemovedChunks != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if n := objects(t, dest); n != before {
+		t.Errorf("%d objects, expected %d", n, before)
+	}
+	snapshots, err := db.Snapshots()
+	if err != nil || len(snapshots) != 3 {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	m, err := db.GetAsOf("a/big", snapshots[0].Time)
+	if err != nil || !bytes.Equal(readFile(t, db, dest, m), content) {
+		t.Errorf("first version of a/big differs: %v", err)
+	}
+}
+
+// mustGet returns the info of name in db
+func mustGet(t *testing.T, db *info.Db, name string) *info.Info {
+	m, err := db.GetByName(name)
+	if err != nil {
+		t.Fatalf("%s: not in db: %v", name, err)
+	}
+	return m
+}
+
+func TestBackupParity(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	content := make([]byte, 600*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	ioutil.WriteFile(filepath.Join(root, "big"), content, 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Backup(db, dest, root, Options{Parity: 1})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	m := mustGet(t, db, "big")
+	if crypto.FormatParity(m.EncFormat) != 1 {
+		t.Errorf("unexpected format %x", m.EncFormat)
+	}
+
+	// damage the middle of the object, which is in the second chunk
+	path := filepath.Join(dest.dir, m.Encname)
+	object, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object[len(object)-len(content)/2] ^= 1
+	ioutil.WriteFile(path, object, 0600)
+	if !bytes.Equal(readFile(t, db, dest, m), content) {
+		t.Errorf("repaired content differs")
+	}
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Destination stores the encrypted objects of a backup.
+type Destination interface {
+	// Create starts writing a new object.
+	Create(name string) (Object, error)
+	// Open returns a reader of an object.
+	Open(name string) (io.ReadCloser, error)
+	// Remove deletes an object.
+	Remove(name string) error
+}
+
+// Object is an object being written to a destination. It only becomes
+// visible, replacing any object of the same name, once it is committed.
+type Object interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// DirDestination stores objects as files in a local directory.
+type DirDestination struct {
+	dir string
+}
+
+// NewDirDestination returns a destination storing objects in dir, which
+// is created if it does not exist.
+func NewDirDestination(dir string) (*DirDestination, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DirDestination{dir: dir}, nil
+}
+
+func (d *DirDestination) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name[0] == '.' {
+		return "", errors.New("invalid object name " + name)
+	}
+	return filepath.Join(d.dir, name), nil
+}
+
+// Create writes the object to a temporary file, which is renamed into
+// place on Commit.
+func (d *DirDestination) Create(name string) (Object, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(d.dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &dirObject{f: f, path: path}, nil
+}
+
+func (d *DirDestination) Open(name string) (io.ReadCloser, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (d *DirDestination) Remove(name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+type dirObject struct {
+	f    *os.File
+	path string
+}
+
+func (o *dirObject) Write(b []byte) (int, error) {
+	return o.f.Write(b)
+}
+
+func (o *dirObject) Commit() error {
+	err := o.f.Sync()
+	cerr := o.f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(o.f.Name(), o.path)
+	}
+	if err != nil {
+		os.Remove(o.f.Name())
+	}
+	return err
+}
+
+func (o *dirObject) Abort() error {
+	o.f.Close()
+	return os.Remove(o.f.Name())
+}
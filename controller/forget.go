@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// ErrEmptyPolicy is returned by Forget for a retention policy without
+// rules, which would forget every snapshot.
+var ErrEmptyPolicy = errors.New("retention policy keeps nothing")
+
+// Forget applies policy to the snapshots of db, and forgets the snapshots
+// it does not keep, with the file versions and chunks only they held.
+// Their objects are removed from dest, and the sealed db is uploaded
+// again, which needs db to have an unlocked master key. If dryRun is set,
+// nothing is changed, and the result says what would have been removed.
+func Forget(db *info.Db, dest Destination, policy info.RetentionPolicy, dryRun bool) ([]info.RetentionDecision, *info.Forgotten, error) {
+	if policy.Empty() {
+		return nil, nil, ErrEmptyPolicy
+	}
+	if !dryRun && !db.HasMasterKey() {
+		return nil, nil, info.ErrNoMasterKey
+	}
+	snapshots, err := db.Snapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+	decisions := policy.Apply(snapshots)
+	drop := make([]*info.Snapshot, 0)
+	for _, d := range decisions {
+		if !d.Keep {
+			drop = append(drop, d.Snapshot)
+		}
+	}
+	forgotten, err := db.Forget(drop, dryRun)
+	if err != nil || dryRun {
+		return decisions, forgotten, err
+	}
+	err = removeObjects(dest, forgotten)
+	if err != nil {
+		return decisions, forgotten, err
+	}
+	return decisions, forgotten, UploadSnapshot(db, dest)
+}
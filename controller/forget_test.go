@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+func TestForget(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// four runs, each with a new version of a, and the same b; the second
+	// run is tagged
+	modified := time.Now().Add(-time.Hour)
+	ioutil.WriteFile(filepath.Join(root, "b"), []byte("same"), 0600)
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(root, "a")
+		ioutil.WriteFile(path, []byte(fmt.Sprintf("version %d", i)), 0600)
+		os.Chtimes(path, modified, modified.Add(time.Duration(i)*time.Minute))
+		opts := Options{Compression: crypto.CompressionGzip}
+		if i == 1 {
+			opts.Tags = []string{"keep"}
+		}
+		_, err = Backup(db, dest, root, opts)
+		if err != nil {
+			t.Fatalf("could not back up: %v", err)
+		}
+	}
+	snapshots, err := db.Snapshots()
+	if err != nil || len(snapshots) != 4 {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	before := objects(t, dest) // 4 versions of a, b and the metadata
+
+	if _, _, err = Forget(db, dest, info.RetentionPolicy{}, false); err != ErrEmptyPolicy {
+		t.Errorf("expected ErrEmptyPolicy, got %v", err)
+	}
+	policy := info.RetentionPolicy{Last: 1, Tags: []string{"keep"}}
+	decisions, forgotten, err := Forget(db, dest, policy, true)
+	if err != nil || len(decisions) != 4 || len(forgotten.Snapshots) != 2 || len(forgotten.Files) != 2 {
+		t.Fatalf("unexpected dry run %v %+v: %v", decisions, forgotten, err)
+	}
+	if n := objects(t, dest); n != before {
+		t.Errorf("dry run removed objects: %d, expected %d", n, before)
+	}
+
+	decisions, forgotten, err = Forget(db, dest, policy, false)
+	if err != nil || len(forgotten.Snapshots) != 2 || len(forgotten.Files) != 2 {
+		t.Fatalf("unexpected forget %v %+v: %v", decisions, forgotten, err)
+	}
+	if !decisions[0].Keep || decisions[1].Keep || !decisions[2].Keep || decisions[3].Keep {
+		t.Errorf("unexpected decisions %v", decisions)
+	}
+	if n := objects(t, dest); n != before-2 {
+		t.Errorf("%d objects, expected %d", n, before-2)
+	}
+	for _, m := range forgotten.Files {
+		if _, err = os.Stat(filepath.Join(dest.dir, m.Encname)); !os.IsNotExist(err) {
+			t.Errorf("object of forgotten %s still there: %v", m.Name, err)
+		}
+	}
+
+	// the kept snapshots still read back
+	snapshots, err = db.Snapshots()
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	for i, expected := range []string{"version 1", "version 3"} {
+		m, err := db.GetInSnapshot(snapshots[i], "a")
+		if err != nil || string(readFile(t, db, dest, m)) != expected {
+			t.Errorf("a in snapshot %d differs: %v", snapshots[i].ID, err)
+		}
+		m, err = db.GetInSnapshot(snapshots[i], "b")
+		if err != nil || string(readFile(t, db, dest, m)) != "same" {
+			t.Errorf("b in snapshot %d differs: %v", snapshots[i].ID, err)
+		}
+	}
+}
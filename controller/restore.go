@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// fromFileMode returns the permission bits of mode as stored in
+// info.Info.Perms.
+func fromFileMode(mode os.FileMode) int {
+	perms := int(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perms |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perms |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perms |= 01000
+	}
+	return perms
+}
+
+// toFileMode is the inverse of fromFileMode.
+func toFileMode(perms int) os.FileMode {
+	mode := os.FileMode(perms) & os.ModePerm
+	if perms&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perms&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perms&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// unchanged reports whether the file stat'ed as m is as it was when old
+// was stored, leaving aside its access and change times, which reading
+// it or storing it again would change.
+func unchanged(old, m *info.Info) bool {
+	return old.Type == m.Type && old.Size == m.Size && sameTime(old.Modified, m.Modified) &&
+		old.Perms == m.Perms && old.User == m.User && old.Group == m.Group &&
+		old.LinkTarget == m.LinkTarget && old.Rdev == m.Rdev && old.XattrHash == m.XattrHash
+}
+
+// sameTime reports whether the stored time t is u. Versions from before
+// times were stored to the nanosecond only have the second.
+func sameTime(t, u time.Time) bool {
+	return t.Equal(u) || t.Nanosecond() == 0 && t.Unix() == u.Unix()
+}
+
+// accessed returns the access time to restore for m, its modification
+// time if its access time was not recorded.
+func accessed(m *info.Info) time.Time {
+	if m.Accessed.IsZero() {
+		return m.Modified
+	}
+	return m.Accessed
+}
+
+// ErrUnsafePath is returned by Restore for a file whose name, or the name
+// a hardlink links to, is outside of the target directory or reached
+// through a symlink.
+var ErrUnsafePath = errors.New("unsafe path")
+
+// Restore writes the files of snapshot s of db to the directory target,
+// which is created if need be, with their types, links, owners,
+// permissions, extended attributes and access and modification times.
+// Files already in target are overwritten, but nothing is written outside
+// of target or through a symlink. Owners and the extended attributes of
+// the security and trusted namespaces are only restored as far as the
+// user running it may set them; without root privileges device files
+// can't be created.
+func Restore(db *info.Db, dest Destination, s *info.Snapshot, target string) error {
+	files, err := db.SnapshotFiles(s)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(target, 0700)
+	if err != nil {
+		return err
+	}
+
+	// hardlinks are made once the files they link to are there, and
+	// symlinks after every other file, so that none is written through
+	// one. The metadata is set last, children before their directory, so
+	// that neither making files nor read-only directories get in the way
+	hardlinks := make([]*info.Info, 0)
+	symlinks := make([]*info.Info, 0)
+	for _, m := range files {
+		switch m.Type {
+		case info.TypeHardlink:
+			hardlinks = append(hardlinks, m)
+			continue
+		case info.TypeSymlink:
+			symlinks = append(symlinks, m)
+			continue
+		}
+		err = restoreFile(db, dest, target, m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+	}
+	for _, m := range hardlinks {
+		err = restoreHardlink(target, m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+	}
+	for _, m := range symlinks {
+		err = restoreFile(db, dest, target, m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name > files[j].Name })
+	for _, m := range files {
+		if m.Type == info.TypeHardlink {
+			continue
+		}
+		path, err := restorePath(target, m.Name)
+		if err != nil {
+			return err
+		}
+		xattrs, err := readXattrs(dest, m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+		err = restoreMetadata(path, m, xattrs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restorePath returns the path in target of the file named name, or
+// ErrUnsafePath if it is outside of target or a directory on the way to
+// it is a symlink.
+func restorePath(target, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is outside of the target", ErrUnsafePath, name)
+	}
+	path := target
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		fi, err := os.Lstat(path)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %s is reached through a symlink", ErrUnsafePath, name)
+		}
+	}
+	return filepath.Join(target, rel), nil
+}
+
+// restoreHardlink links the hardlink m in target to the file it links to.
+func restoreHardlink(target string, m *info.Info) error {
+	path, err := restorePath(target, m.Name)
+	if err != nil {
+		return err
+	}
+	linked, err := restorePath(target, m.LinkTarget)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	return os.Link(linked, path)
+}
+
+// restoreFile creates the file m in target, with its content or link
+// target, but not its metadata.
+func restoreFile(db *info.Db, dest Destination, target string, m *info.Info) error {
+	path, err := restorePath(target, m.Name)
+	if err != nil {
+		return err
+	}
+	if m.Type == info.TypeDir {
+		return os.MkdirAll(path, 0700)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(path); err == nil && (!fi.Mode().IsRegular() || m.Type != info.TypeFile) {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	switch m.Type {
+	case info.TypeFile:
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		err = ReadFile(db, dest, m, out)
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	case info.TypeSymlink:
+		return os.Symlink(m.LinkTarget, path)
+	case info.TypeFIFO:
+		return mkfifo(path)
+	case info.TypeCharDevice, info.TypeBlockDevice:
+		return mknod(path, m)
+	}
+	return fmt.Errorf("can't restore files of type %v", m.Type)
+}
+
+// restoreMetadata sets the owner, permissions, extended attributes and
+// times of the file at path to those of m, with xattrs its extended
+// attributes. Owners and attributes the user may not set are left alone.
+// The attributes are set after the owner, as changing the owner clears
+// file capabilities, and after the permissions, which ACLs refine.
+func restoreMetadata(path string, m *info.Info, xattrs []info.Xattr) error {
+	denied := func(err error) bool {
+		return os.IsPermission(err) && os.Geteuid() != 0
+	}
+	err := os.Lchown(path, m.User, m.Group)
+	if err != nil && !denied(err) {
+		return err
+	}
+	if m.Type != info.TypeSymlink {
+		err = os.Chmod(path, toFileMode(m.Perms))
+		if err != nil {
+			return err
+		}
+	}
+	for _, x := range xattrs {
+		err = setXattr(path, x)
+		if err != nil && !denied(err) {
+			return err
+		}
+	}
+	return setTimes(path, m)
+}
@@ -0,0 +1,203 @@
+//go:build unix
+
+package controller
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/timothyham/bbackup/metadata"
+)
+
+func TestRestore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "sub", "empty"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "sub", "file"), []byte("content"), 0640)
+	err := os.Link(filepath.Join(root, "sub", "file"), filepath.Join(root, "a-link"))
+	if err == nil {
+		err = os.Symlink("sub/file", filepath.Join(root, "symlink"))
+	}
+	if err == nil {
+		err = syscall.Mkfifo(filepath.Join(root, "fifo"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(filepath.Join(root, "sub", "empty"), 0750)
+	os.Chmod(filepath.Join(root, "sub"), 0711|os.ModeSticky)
+	modified := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.Local)
+	for _, name := range []string{"sub/empty", "sub/file", "fifo", "sub", "."} {
+		os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), modified, modified)
+	}
+
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	if stats.Added != 1 || stats.Others != 6 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// the name walked first has the content
+	m := mustGet(t, db, "sub/file")
+	if m.Type != info.TypeHardlink || m.LinkTarget != "a-link" || m.Encname != "" {
+		t.Errorf("unexpected hardlink %+v", m)
+	}
+	m = mustGet(t, db, "a-link")
+	if !m.Modified.Equal(modified) || m.Accessed.IsZero() || m.Changed.IsZero() || m.Inode == 0 {
+		t.Errorf("unexpected file %+v", m)
+	}
+
+	// nothing changed
+	stats, err = Backup(db, dest, root, Options{})
+	if err != nil || stats.Unchanged != 1 || stats.Added != 0 || stats.Updated != 0 {
+		t.Errorf("unexpected stats %+v: %v", stats, err)
+	}
+
+	target := filepath.Join(dir, "target")
+	latest, err := db.LatestSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(db, dest, latest, target)
+	if err != nil {
+		t.Fatalf("could not restore: %v", err)
+	}
+	for _, name := range []string{".", "sub", "sub/empty", "sub/file", "a-link", "symlink", "fifo"} {
+		original, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := os.Lstat(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: not restored: %v", name, err)
+			continue
+		}
+		if restored.Mode() != original.Mode() {
+			t.Errorf("%s: mode %v, expected %v", name, restored.Mode(), original.Mode())
+		}
+		if !restored.ModTime().Equal(original.ModTime()) {
+			t.Errorf("%s: modified %v, expected %v", name, restored.ModTime(), original.ModTime())
+		}
+		ost, rst := original.Sys().(*syscall.Stat_t), restored.Sys().(*syscall.Stat_t)
+		if rst.Uid != ost.Uid || rst.Gid != ost.Gid || rst.Nlink != ost.Nlink {
+			t.Errorf("%s: unexpected owner or links %+v, expected %+v", name, rst, ost)
+		}
+	}
+	content, err := ioutil.ReadFile(filepath.Join(target, "sub", "file"))
+	if err != nil || string(content) != "content" {
+		t.Errorf("unexpected hardlink content %q: %v", content, err)
+	}
+	link, err := os.Readlink(filepath.Join(target, "symlink"))
+	if err != nil || link != "sub/file" {
+		t.Errorf("unexpected symlink target %q: %v", link, err)
+	}
+	a, _ := os.Stat(filepath.Join(target, "a-link"))
+	b, _ := os.Stat(filepath.Join(target, "sub", "file"))
+	if !os.SameFile(a, b) {
+		t.Errorf("hardlink not restored as one")
+	}
+}
+
+// restoreFiles restores a snapshot of files, copies of file but for
+// their name, type and link target, to target.
+func restoreFiles(t *testing.T, db *info.Db, dest Destination, file *info.Info, target string, files ...info.Info) error {
+	versions := make([]*info.Info, 0)
+	for _, f := range files {
+		m := *file
+		m.ID = 0
+		m.Name, m.Type, m.LinkTarget = f.Name, f.Type, f.LinkTarget
+		err := db.Insert(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, &m)
+	}
+	s := &info.Snapshot{Time: time.Now(), Root: "crafted"}
+	err := db.InsertSnapshot(s, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Restore(db, dest, s, target)
+}
+
+func TestRestoreUnsafePaths(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	file := mustGet(t, db, "file")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(outside, 0700)
+
+	unsafe := [][]info.Info{
+		{{Name: "../outside/file", Type: info.TypeFile}},
+		{{Name: "/tmp/file", Type: info.TypeFile}},
+		{{Name: "file", Type: info.TypeFile}, {Name: "link", Type: info.TypeHardlink, LinkTarget: "../outside/file"}},
+	}
+	for i, files := range unsafe {
+		target := filepath.Join(dir, "target", string(rune('a'+i)))
+		err = restoreFiles(t, db, dest, file, target, files...)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: expected ErrUnsafePath, got %v", files[len(files)-1].Name, err)
+		}
+	}
+
+	// a symlink of the snapshot to outside of the target is only made
+	// once the files are written, so that none is written through it
+	target := filepath.Join(dir, "target", "symlink")
+	err = restoreFiles(t, db, dest, file, target,
+		info.Info{Name: "sub", Type: info.TypeSymlink, LinkTarget: outside},
+		info.Info{Name: "sub/file", Type: info.TypeFile})
+	if err == nil {
+		t.Errorf("expected error restoring a symlink over a directory")
+	}
+
+	// nor is anything written through a symlink already in the target
+	target = filepath.Join(dir, "target", "existing")
+	os.MkdirAll(target, 0700)
+	err = os.Symlink(outside, filepath.Join(target, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restoreFiles(t, db, dest, file, target, info.Info{Name: "sub/file", Type: info.TypeFile})
+	if !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("expected ErrUnsafePath, got %v", err)
+	}
+
+	names, err := ioutil.ReadDir(outside)
+	if err != nil || len(names) != 0 {
+		t.Errorf("restored outside of the target: %v %v", names, err)
+	}
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// SalvageFile is ReadFile for damaged backups. Whatever still decrypts is
+// written to out, the damaged ranges are zero filled or left out
+// according to mode, and they are returned with their offsets in the
+// file. The Chunk of a range is its index in the object it was found in.
+// An object that is missing or has a damaged header is lost as a whole.
+func SalvageFile(db *info.Db, dest Destination, m *info.Info, out io.Writer, mode crypto.SalvageMode) ([]crypto.DamagedRange, error) {
+	if m.Encname != "" {
+		return salvageObject(dest, m.Encname, m.Key, m.IV, m.Size, 0, out, mode)
+	}
+	chunks, err := db.FileChunks(m)
+	if err != nil {
+		return nil, err
+	}
+	damaged := []crypto.DamagedRange{}
+	offset := int64(0)
+	for _, c := range chunks {
+		d, err := salvageObject(dest, c.Encname, c.Key, c.IV, c.Size, offset, out, mode)
+		if err != nil {
+			return damaged, err
+		}
+		damaged = append(damaged, d...)
+		offset += c.Size
+	}
+	return damaged, nil
+}
+
+// salvageObject salvages the object name of dest, which holds size bytes
+// of plaintext at offset of the file, to out.
+func salvageObject(dest Destination, name, key, iv string, size, offset int64, out io.Writer, mode crypto.SalvageMode) ([]crypto.DamagedRange, error) {
+	err := checkKey(name, key)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := crypto.NewDecryptor(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	in, err := dest.Open(name)
+	var report *crypto.SalvageReport
+	if err == nil {
+		report, err = salvageReader(dec, in, size, out, mode)
+		in.Close()
+	}
+	if os.IsNotExist(err) || errors.Is(err, crypto.ErrBadHeader) ||
+		errors.Is(err, crypto.ErrUnsupportedVersion) || errors.Is(err, crypto.ErrTruncated) {
+		d := crypto.DamagedRange{Offset: offset, Length: size, Err: err}
+		if mode == crypto.SalvageZeroFill {
+			return []crypto.DamagedRange{d}, writeZeros(out, size)
+		}
+		return []crypto.DamagedRange{d}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Damaged {
+		report.Damaged[i].Offset += offset
+	}
+	return report.Damaged, nil
+}
+
+// salvageReader salvages in, which is read into memory unless it is a
+// file.
+func salvageReader(dec *crypto.Encryptor, in io.Reader, size int64, out io.Writer, mode crypto.SalvageMode) (*crypto.SalvageReport, error) {
+	if f, ok := in.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return dec.Salvage(out, f, fi.Size(), size, mode)
+	}
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return dec.Salvage(out, bytes.NewReader(b), int64(len(b)), size, mode)
+}
+
+// writeZeros writes n zero bytes to out.
+func writeZeros(out io.Writer, n int64) error {
+	zeros := make([]byte, 64*1024)
+	for n > 0 {
+		if n < int64(len(zeros)) {
+			zeros = zeros[:n]
+		}
+		w, err := out.Write(zeros)
+		if err != nil {
+			return err
+		}
+		n -= int64(w)
+	}
+	return nil
+}
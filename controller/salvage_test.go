@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+func TestSalvageFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	content := make([]byte, 4*crypto.ChunkSize)
+	rand.New(rand.NewSource(1)).Read(content)
+	ioutil.WriteFile(filepath.Join(root, "file"), content, 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+
+	// rot a bit of the second chunk of the object
+	m := mustGet(t, db, "file")
+	path := filepath.Join(dir, "dest", m.Encname)
+	object, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object[len(object)/3] ^= 1
+	ioutil.WriteFile(path, object, 0600)
+
+	out := &bytes.Buffer{}
+	damaged, err := SalvageFile(db, dest, m, out, crypto.SalvageZeroFill)
+	if err != nil {
+		t.Fatalf("could not salvage: %v", err)
+	}
+	if len(damaged) != 1 || damaged[0].Chunk != 1 || damaged[0].Length != crypto.ChunkSize {
+		t.Fatalf("unexpected damage %v", damaged)
+	}
+	expected := append([]byte{}, content...)
+	copy(expected[crypto.ChunkSize:2*crypto.ChunkSize], make([]byte, crypto.ChunkSize))
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("salvaged content differs")
+	}
+	if err = ReadFile(db, dest, m, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected ReadFile to fail")
+	}
+}
+
+func TestSalvageChunkedFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	content := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	ioutil.WriteFile(filepath.Join(root, "file"), content, 0600)
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Dedup:         true,
+		ChunkerParams: crypto.ChunkerParams{Min: 4 * 1024, Avg: 16 * 1024, Max: 64 * 1024},
+	}
+	_, err = Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+
+	// lose the object of one chunk
+	m := mustGet(t, db, "file")
+	chunks, err := db.FileChunks(m)
+	if err != nil || len(chunks) < 3 {
+		t.Fatalf("unexpected chunks %v: %v", chunks, err)
+	}
+	lost := chunks[1]
+	err = dest.Remove(lost.Encname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	damaged, err := SalvageFile(db, dest, m, out, crypto.SalvageSkip)
+	if err != nil {
+		t.Fatalf("could not salvage: %v", err)
+	}
+	offset := chunks[0].Size
+	if len(damaged) != 1 || damaged[0].Offset != offset || damaged[0].Length != lost.Size || !os.IsNotExist(damaged[0].Err) {
+		t.Fatalf("unexpected damage %v", damaged)
+	}
+	expected := append(append([]byte{}, content[:offset]...), content[offset+lost.Size:]...)
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("salvaged content differs")
+	}
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/timothyham/bbackup/metadata"
+	"golang.org/x/sys/unix"
+)
+
+// statInfo fills in the metadata of m that fi.Mode() does not have, and
+// returns the number of links to the file.
+func statInfo(m *info.Info, fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	m.User = int(st.Uid)
+	m.Group = int(st.Gid)
+	m.Accessed = time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	m.Changed = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+	m.Inode = uint64(st.Ino)
+	m.Device = uint64(st.Dev)
+	m.Rdev = uint64(st.Rdev)
+	return uint64(st.Nlink)
+}
+
+// setTimes sets the access and modification times of the file at path to
+// those of m, without following symlinks.
+func setTimes(path string, m *info.Info) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(accessed(m).UnixNano()),
+		unix.NsecToTimespec(m.Modified.UnixNano()),
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: path, Err: err}
+	}
+	return nil
+}
+
+// mkfifo creates a FIFO at path.
+func mkfifo(path string) error {
+	err := unix.Mkfifo(path, 0600)
+	if err != nil {
+		return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	return nil
+}
+
+// mknod creates the device file m at path.
+func mknod(path string, m *info.Info) error {
+	mode := uint32(unix.S_IFCHR)
+	if m.Type == info.TypeBlockDevice {
+		mode = unix.S_IFBLK
+	}
+	err := unix.Mknod(path, mode|0600, int(m.Rdev))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+// listXattrs returns the extended attributes of the file at path that
+// opts include, without following symlinks. A file system without them
+// has none.
+func listXattrs(path string, opts Options) ([]info.Xattr, error) {
+	var names []byte
+	err := readSized(func(buf []byte) (int, error) { return unix.Llistxattr(path, buf) }, &names)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	xattrs := make([]info.Xattr, 0)
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" || !opts.includesXattr(name) {
+			continue
+		}
+		var value []byte
+		err = readSized(func(buf []byte) (int, error) { return unix.Lgetxattr(path, name, buf) }, &value)
+		if err == unix.ENODATA {
+			continue // removed since it was listed
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: err}
+		}
+		xattrs = append(xattrs, info.Xattr{Name: name, Value: value})
+	}
+	return xattrs, nil
+}
+
+// readSized reads into data with read, which returns the size it needs
+// when given an empty buffer, growing it while it is too small.
+func readSized(read func(buf []byte) (int, error), data *[]byte) error {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if err == unix.ERANGE {
+			continue // it grew in between
+		}
+		if err != nil {
+			return err
+		}
+		*data = buf[:n]
+		return nil
+	}
+}
+
+// setXattr sets the extended attribute x of the file at path, without
+// following symlinks.
+func setXattr(path string, x info.Xattr) error {
+	err := unix.Lsetxattr(path, x.Name, x.Value, 0)
+	if err != nil {
+		return &os.PathError{Op: "setxattr " + x.Name, Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build unix && !linux
+
+package controller
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// statInfo fills in the metadata of m that fi.Mode() does not have, and
+// returns the number of links to the file. Access and change times are
+// only recorded on Linux.
+func statInfo(m *info.Info, fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	m.User = int(st.Uid)
+	m.Group = int(st.Gid)
+	m.Inode = uint64(st.Ino)
+	m.Device = uint64(st.Dev)
+	m.Rdev = uint64(st.Rdev)
+	return uint64(st.Nlink)
+}
+
+// setTimes sets the access and modification times of the file at path to
+// those of m. Those of symlinks are left alone.
+func setTimes(path string, m *info.Info) error {
+	if m.Type == info.TypeSymlink {
+		return nil
+	}
+	return os.Chtimes(path, accessed(m), m.Modified)
+}
+
+// mkfifo creates a FIFO at path.
+func mkfifo(path string) error {
+	err := syscall.Mkfifo(path, 0600)
+	if err != nil {
+		return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	return nil
+}
+
+// mknod creates the device file m at path, which is only supported on
+// Linux.
+func mknod(path string, m *info.Info) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: errors.New("device files can only be restored on Linux")}
+}
+
+// listXattrs returns no extended attributes, which are only backed up on
+// Linux.
+func listXattrs(path string, opts Options) ([]info.Xattr, error) {
+	return nil, nil
+}
+
+// setXattr sets the extended attribute x of the file at path, which is
+// only supported on Linux.
+func setXattr(path string, x info.Xattr) error {
+	return &os.PathError{Op: "setxattr " + x.Name, Path: path, Err: errors.New("extended attributes can only be restored on Linux")}
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"errors"
+	"os"
+
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// statInfo has nothing to add to what fi.Mode() tells on Windows, where
+// files have no owners, inodes or devices, and returns one link.
+func statInfo(m *info.Info, fi os.FileInfo) uint64 {
+	return 1
+}
+
+// setTimes sets the access and modification times of the file at path to
+// those of m. Those of symlinks are left alone.
+func setTimes(path string, m *info.Info) error {
+	if m.Type == info.TypeSymlink {
+		return nil
+	}
+	return os.Chtimes(path, accessed(m), m.Modified)
+}
+
+// mkfifo creates a FIFO at path, which Windows does not have.
+func mkfifo(path string) error {
+	return &os.PathError{Op: "mkfifo", Path: path, Err: errors.New("FIFOs can't be restored on Windows")}
+}
+
+// mknod creates the device file m at path, which is only supported on
+// Linux.
+func mknod(path string, m *info.Info) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: errors.New("device files can only be restored on Linux")}
+}
+
+// listXattrs returns no extended attributes, which are only backed up on
+// Linux.
+func listXattrs(path string, opts Options) ([]info.Xattr, error) {
+	return nil, nil
+}
+
+// setXattr sets the extended attribute x of the file at path, which is
+// only supported on Linux.
+func setXattr(path string, x info.Xattr) error {
+	return &os.PathError{Op: "setxattr " + x.Name, Path: path, Err: errors.New("extended attributes can only be restored on Linux")}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+)
+
+// includesXattr reports whether the extended attribute name is backed up
+// with opts: those in the user namespace and the POSIX ACLs always are,
+// those in the security and trusted namespaces if opts say so, and other
+// system attributes never are.
+func (opts Options) includesXattr(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "user."):
+		return true
+	case name == "system.posix_acl_access" || name == "system.posix_acl_default":
+		return true
+	case strings.HasPrefix(name, "security."):
+		return opts.XattrSecurity
+	case strings.HasPrefix(name, "trusted."):
+		return opts.XattrTrusted
+	}
+	return false
+}
+
+// putXattrs encrypts the extended attributes of m to a new object of
+// dest, if it has any.
+func putXattrs(dest Destination, m *info.Info, xattrs []info.Xattr, opts Options) error {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	enc, err := opts.encryptor()
+	if err != nil {
+		return err
+	}
+	enc.SetHashes() // XattrHash identifies the content
+	encname, err := crypto.NewEncname()
+	if err != nil {
+		return err
+	}
+	_, _, err = putObject(dest, encname, enc, bytes.NewReader(info.EncodeXattrs(xattrs)))
+	if err != nil {
+		return err
+	}
+	m.XattrEncname = encname
+	m.XattrKey = enc.GetKey()
+	m.XattrIV = enc.GetIv()
+	return nil
+}
+
+// removeXattrs removes the object putXattrs stored for m, if any.
+func removeXattrs(dest Destination, m *info.Info) {
+	if m.XattrEncname != "" {
+		dest.Remove(m.XattrEncname)
+	}
+}
+
+// readXattrs decrypts the extended attributes of m from dest.
+func readXattrs(dest Destination, m *info.Info) ([]info.Xattr, error) {
+	if m.XattrEncname == "" {
+		return nil, nil
+	}
+	out := &bytes.Buffer{}
+	err := readObject(dest, m.XattrEncname, m.XattrKey, m.XattrIV, out)
+	if err != nil {
+		return nil, err
+	}
+	return info.DecodeXattrs(out.Bytes())
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+	"github.com/timothyham/bbackup/metadata"
+	"golang.org/x/sys/unix"
+)
+
+// posixACL returns the system.posix_acl_access value giving uid read
+// access besides the permission bits 0640.
+func posixACL(uid int) []byte {
+	entries := []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, 0xffffffff},  // owner
+		{0x02, 4, uint32(uid)}, // user
+		{0x04, 4, 0xffffffff},  // group
+		{0x10, 4, 0xffffffff},  // mask
+		{0x20, 0, 0xffffffff},  // other
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(2))
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, e)
+	}
+	return buf.Bytes()
+}
+
+func TestXattrs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0700)
+	file := filepath.Join(root, "file")
+	ioutil.WriteFile(file, []byte("content"), 0640)
+	err := unix.Setxattr(file, "user.comment", []byte("hello"), 0)
+	if err == unix.ENOTSUP {
+		t.Skip("no extended attributes in the temp dir")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	xattrs := map[string][]byte{"user.comment": []byte("hello")}
+	optional := map[string][]byte{
+		"system.posix_acl_access": posixACL(12345),
+		"security.capability":     {0, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, // cap_net_raw
+		"trusted.note":            []byte("root only"),
+	}
+	for name, value := range optional {
+		if err = unix.Setxattr(file, name, value, 0); err == nil {
+			xattrs[name] = value
+		} else {
+			t.Logf("not testing %s: %v", name, err)
+		}
+	}
+
+	dest, err := NewDirDestination(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := info.NewDb(filepath.Join(dir, "bbackup.db"))
+	defer db.Close()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without the security and trusted namespaces
+	_, err = Backup(db, dest, root, Options{})
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	m := mustGet(t, db, "file")
+	stored, err := readXattrs(dest, m)
+	if err != nil || m.XattrEncname == "" {
+		t.Fatalf("could not read extended attributes of %+v: %v", m, err)
+	}
+	for _, x := range stored {
+		if !bytes.Equal(x.Value, xattrs[x.Name]) || x.Name == "security.capability" || x.Name == "trusted.note" {
+			t.Errorf("unexpected extended attribute %s %v", x.Name, x.Value)
+		}
+	}
+
+	// with them the attributes changed, so the file has a new version
+	opts := Options{XattrSecurity: true, XattrTrusted: true}
+	stats, err := Backup(db, dest, root, opts)
+	if err != nil {
+		t.Fatalf("could not back up: %v", err)
+	}
+	expected := 0
+	if xattrs["security.capability"] != nil || xattrs["trusted.note"] != nil {
+		expected = 1
+	}
+	if stats.Updated != expected {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	stats, err = Backup(db, dest, root, opts)
+	if err != nil || stats.Unchanged != 1 {
+		t.Errorf("unexpected stats %+v: %v", stats, err)
+	}
+
+	target := filepath.Join(dir, "target")
+	latest, err := db.LatestSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(db, dest, latest, target)
+	if err != nil {
+		t.Fatalf("could not restore: %v", err)
+	}
+	for name, value := range xattrs {
+		buf := make([]byte, 256)
+		n, err := unix.Getxattr(filepath.Join(target, "file"), name, buf)
+		if err != nil || !bytes.Equal(buf[:n], value) {
+			t.Errorf("%s restored as %v: %v", name, buf[:n], err)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(target, "file"))
+	if err != nil || fi.Mode() != 0640 {
+		t.Errorf("unexpected mode %v: %v", fi.Mode(), err)
+	}
+
+	// forgetting the versions removes their attribute objects
+	old := m.XattrEncname
+	_, _, err = Forget(db, dest, info.RetentionPolicy{Last: 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dest.dir, old)); !os.IsNotExist(err) && expected == 1 {
+		t.Errorf("object of forgotten attributes still there: %v", err)
+	}
+	// a locked db with recipients can't read the dedup key to hash the
+	// attributes, so the file is backed up again rather than failing
+	id, err := crypto.GenerateIdentity()
+	if err == nil {
+		err = db.AddRecipient("offline", id.Recipient())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	stats, err = Backup(db, dest, root, opts)
+	if err != nil || stats.Updated != 1 {
+		t.Errorf("unexpected stats %+v: %v", stats, err)
+	}
+}
@@ -0,0 +1,206 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"lukechampine.com/blake3"
+)
+
+// blake3 key derivation contexts of the dedup key
+const (
+	dedupIDContext   = "bbackup 2026-10-18 chunk ids v1"
+	dedupGearContext = "bbackup 2026-10-18 chunker gear v1"
+	dedupMetaContext = "bbackup 2026-10-18 metadata hashes v1"
+)
+
+// ChunkerParams are the chunk sizes of content-defined chunking. Avg must
+// be a power of two of at least 4, as the masks cutting chunks have two
+// bits more and two bits fewer than it.
+type ChunkerParams struct {
+	Min int
+	Avg int
+	Max int
+}
+
+// DefaultChunkerParams cut chunks of 512KiB to 8MiB, 1MiB on average.
+var DefaultChunkerParams = ChunkerParams{Min: 512 * 1024, Avg: 1024 * 1024, Max: 8 * 1024 * 1024}
+
+func (p ChunkerParams) valid() error {
+	if p.Min <= 0 || p.Avg < 4 || p.Min > p.Avg || p.Avg > p.Max || p.Avg&(p.Avg-1) != 0 {
+		return fmt.Errorf("%w: chunker params %+v", ErrBadOption, p)
+	}
+	return nil
+}
+
+// DedupKey addresses and cuts the chunks of deduplicated files. Both
+// chunk ids and chunk boundaries depend on the key, so neither reveals
+// whether a chunk of known content is stored. It also keys the hashes of
+// metadata stored in the clear, such as extended attributes.
+type DedupKey struct {
+	key  []byte // 32 bytes or 256 bits
+	id   []byte // blake3 key of chunk ids
+	meta []byte // blake3 key of metadata hashes
+	gear [256]uint64
+}
+
+// NewDedupKey returns a new random dedup key.
+func NewDedupKey() (*DedupKey, error) {
+	key, err := randomBytes(256 / 8)
+	if err != nil {
+		return nil, err
+	}
+	return newDedupKey(key), nil
+}
+
+// ParseDedupKey parses the base64 form returned by String.
+func ParseDedupKey(s string) (*DedupKey, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 256/8 {
+		return nil, errors.New("invalid dedup key")
+	}
+	return newDedupKey(key), nil
+}
+
+func newDedupKey(key []byte) *DedupKey {
+	k := &DedupKey{key: key, id: make([]byte, 256/8), meta: make([]byte, 256/8)}
+	blake3.DeriveKey(k.id, dedupIDContext, key)
+	blake3.DeriveKey(k.meta, dedupMetaContext, key)
+	gear := make([]byte, 8*len(k.gear))
+	blake3.DeriveKey(gear, dedupGearContext, key)
+	for i := range k.gear {
+		k.gear[i] = binary.LittleEndian.Uint64(gear[8*i:])
+	}
+	return k
+}
+
+// String returns the key in base64, to be wrapped like a per-file key.
+func (k *DedupKey) String() string {
+	return base64.RawURLEncoding.EncodeToString(k.key)
+}
+
+// ChunkID returns the keyed hash addressing chunk.
+func (k *DedupKey) ChunkID(chunk []byte) string {
+	h := blake3.New(32, k.id)
+	h.Write(chunk)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// MetadataHash returns the keyed hash of data, which only tells whether
+// it changed to those without the key.
+func (k *DedupKey) MetadataHash(data []byte) string {
+	h := blake3.New(32, k.meta)
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Chunker splits a stream into content-defined chunks with FastCDC: a
+// gear hash rolls over the stream and a chunk ends where its top bits
+// are zero. Up to Avg bytes a stricter mask is used than after, which
+// narrows the chunk sizes around Avg. Chunks are between Min and Max
+// bytes, except for the last one which may be shorter. An insertion or
+// deletion only changes the chunks around it.
+type Chunker struct {
+	r      io.Reader
+	params ChunkerParams
+	gear   *[256]uint64
+	maskS  uint64 // mask before Avg bytes
+	maskL  uint64 // mask after Avg bytes
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+// NewChunker returns a chunker of r cutting chunks with k.
+func (k *DedupKey) NewChunker(r io.Reader, params ChunkerParams) (*Chunker, error) {
+	err := params.valid()
+	if err != nil {
+		return nil, err
+	}
+	bits := uint(0)
+	for 1<<bits < params.Avg {
+		bits += 1
+	}
+	return &Chunker{
+		r:      r,
+		params: params,
+		gear:   &k.gear,
+		maskS:  ^uint64(0) << (64 - (bits + 2)),
+		maskL:  ^uint64(0) << (64 - (bits - 2)),
+		buf:    make([]byte, 2*params.Max),
+	}, nil
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk
+// is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.params.Max && !c.eof {
+		err := c.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill moves the unread data to the front of buf and reads until it is
+// full or r ends.
+func (c *Chunker) fill() error {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.params.Min {
+		return n
+	}
+	if n > c.params.Max {
+		n = c.params.Max
+	}
+	normal := c.params.Avg
+	if normal > n {
+		normal = n
+	}
+	h := uint64(0)
+	i := c.params.Min
+	for ; i < normal; i++ {
+		h = h<<1 + c.gear[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + c.gear[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,107 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testChunkerParams = ChunkerParams{Min: 2 * 1024, Avg: 8 * 1024, Max: 32 * 1024}
+
+// chunks returns the chunks of data cut with k
+func chunks(t *testing.T, k *DedupKey, data []byte) [][]byte {
+	c, err := k.NewChunker(bytes.NewReader(data), testChunkerParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := [][]byte{}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return all
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	k, err := NewDedupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := chunks(t, k, data)
+	if !bytes.Equal(bytes.Join(all, nil), data) {
+		t.Fatalf("chunks do not add up to the data")
+	}
+	for i, chunk := range all {
+		if len(chunk) > testChunkerParams.Max || (len(chunk) < testChunkerParams.Min && i != len(all)-1) {
+			t.Errorf("chunk %d has %d bytes", i, len(chunk))
+		}
+	}
+	avg := len(data) / len(all)
+	if avg < testChunkerParams.Avg/2 || avg > testChunkerParams.Avg*2 {
+		t.Errorf("average chunk size %d", avg)
+	}
+
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:500000]...), []byte("inserted")...), data[500000:]...)
+	ids := make(map[string]bool)
+	for _, chunk := range all {
+		ids[k.ChunkID(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range chunks(t, k, edited) {
+		if !ids[k.ChunkID(chunk)] {
+			changed += 1
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("%d chunks changed by an insertion", changed)
+	}
+
+	// boundaries and ids depend on the key
+	other, err := NewDedupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ChunkID(all[0]) == k.ChunkID(all[0]) {
+		t.Errorf("chunk ids do not depend on the key")
+	}
+	if other.MetadataHash(all[0]) == k.MetadataHash(all[0]) || k.MetadataHash(all[0]) == k.ChunkID(all[0]) {
+		t.Errorf("metadata hashes do not depend on the key, or are chunk ids")
+	}
+	if len(chunks(t, other, data)[0]) == len(all[0]) && len(chunks(t, other, data)[1]) == len(all[1]) {
+		t.Errorf("chunk boundaries do not depend on the key")
+	}
+
+	parsed, err := ParseDedupKey(k.String())
+	if err != nil || parsed.ChunkID(all[0]) != k.ChunkID(all[0]) {
+		t.Errorf("could not parse dedup key: %v", err)
+	}
+	if _, err := k.NewChunker(bytes.NewReader(data), ChunkerParams{Min: 1, Avg: 3, Max: 4}); err == nil {
+		t.Errorf("expected error for an average that is not a power of two")
+	}
+	for _, avg := range []int{1, 2} {
+		if _, err := k.NewChunker(bytes.NewReader(data), ChunkerParams{Min: 1, Avg: avg, Max: 4}); err == nil {
+			t.Errorf("expected error for an average of %d", avg)
+		}
+	}
+	small, err := k.NewChunker(bytes.NewReader(data[:100]), ChunkerParams{Min: 1, Avg: 4, Max: 8})
+	if err != nil {
+		t.Fatalf("could not chunk with the smallest average: %v", err)
+	}
+	for n := 0; n < 100; {
+		chunk, err := small.Next()
+		if err != nil || len(chunk) == 0 || len(chunk) > 8 {
+			t.Fatalf("unexpected chunk of %d bytes: %v", len(chunk), err)
+		}
+		n += len(chunk)
+	}
+}
@@ -0,0 +1,228 @@
+package crypto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm chunks are compressed with before they are
+// sealed.
+type Compression byte
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+	CompressionZstd Compression = 2
+)
+
+// A sample compressing to more than compressibleRatio of its size is not
+// worth compressing.
+const compressibleRatio = 0.9
+
+// Each chunk of a compressed stream starts with one of these, so chunks
+// that don't compress are stored as they are.
+const (
+	chunkRaw        = 0
+	chunkCompressed = 1
+)
+
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdErr error
+
+// zstdCodec returns the shared zstd encoder and decoder. EncodeAll and
+// DecodeAll are safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(MaxChunkSize)))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// ParseCompression returns the compression with the given name.
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("%w: unknown compression %s", ErrBadOption, name)
+}
+
+func (c Compression) valid() bool {
+	return c <= CompressionZstd
+}
+
+// SetCompression sets the algorithm chunks are compressed with. If the
+// first chunk of a stream doesn't compress well, the stream is stored
+// without compression, and Format reports that.
+func (e *Encryptor) SetCompression(c Compression) error {
+	if !c.valid() {
+		return fmt.Errorf("%w: unknown compression %d", ErrBadOption, c)
+	}
+	e.compress = c
+	return nil
+}
+
+// GetCompression returns the compression of the stream.
+func (e *Encryptor) GetCompression() Compression {
+	return e.compression
+}
+
+// chooseCompression picks the compression of a new stream given its
+// first chunk.
+func (e *Encryptor) chooseCompression(sample []byte) {
+	e.compression = e.compress
+	if e.compress == CompressionNone || len(sample) == 0 {
+		return
+	}
+	compressed, err := compressChunk(nil, sample, e.compress)
+	if err != nil || float64(len(compressed)) > compressibleRatio*float64(len(sample)) {
+		e.compression = CompressionNone
+	}
+}
+
+// compressChunk appends the compressed plain to dst.
+func compressChunk(dst, plain []byte, c Compression) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		buf := bytes.NewBuffer(dst)
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(plain)
+		if err == nil {
+			err = w.Close()
+		}
+		return buf.Bytes(), err
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(plain, dst), nil
+	}
+	return append(dst, plain...), nil
+}
+
+// decompressChunk appends the decompressed data to dst. At most limit
+// bytes are decompressed.
+func decompressChunk(dst, data []byte, c Compression, limit int64) ([]byte, error) {
+	start := len(dst)
+	var err error
+	switch c {
+	case CompressionGzip:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadChunk, err)
+		}
+		buf := bytes.NewBuffer(dst)
+		_, err = io.Copy(buf, io.LimitReader(r, limit+1))
+		dst = buf.Bytes()
+	case CompressionZstd:
+		_, dec, zerr := zstdCodec()
+		if zerr != nil {
+			return nil, zerr
+		}
+		dst, err = dec.DecodeAll(data, dst)
+	default:
+		return nil, fmt.Errorf("%w: compression %d", ErrBadChunk, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadChunk, err)
+	}
+	if int64(len(dst)-start) > limit {
+		return nil, fmt.Errorf("%w: decompressed chunk too large", ErrBadChunk)
+	}
+	return dst, nil
+}
+
+// packChunk prepares the plaintext of a chunk for sealing. Chunks of a
+// compressed stream get a leading byte telling if they are compressed,
+// and are stored raw if compressing doesn't make them smaller.
+func (e *Encryptor) packChunk(dst, plain []byte) ([]byte, error) {
+	if e.compression == CompressionNone {
+		return plain, nil
+	}
+	dst = append(dst[:0], chunkCompressed)
+	dst, err := compressChunk(dst, plain, e.compression)
+	if err != nil {
+		return nil, err
+	}
+	if len(dst)-1 >= len(plain) {
+		dst = append(dst[:0], chunkRaw)
+		dst = append(dst, plain...)
+	}
+	return dst, nil
+}
+
+// unpackChunk reverses packChunk, appending the plaintext to dst.
+func (e *Encryptor) unpackChunk(dst, packed []byte) ([]byte, error) {
+	if e.compression == CompressionNone {
+		return append(dst, packed...), nil
+	}
+	if len(packed) == 0 {
+		return nil, fmt.Errorf("%w: empty chunk", ErrBadChunk)
+	}
+	switch packed[0] {
+	case chunkRaw:
+		if int64(len(packed)-1) > e.chunkSize {
+			return nil, fmt.Errorf("%w: chunk too large", ErrBadChunk)
+		}
+		return append(dst, packed[1:]...), nil
+	case chunkCompressed:
+		return decompressChunk(dst, packed[1:], e.compression, e.chunkSize)
+	}
+	return nil, fmt.Errorf("%w: unknown chunk type", ErrBadChunk)
+}
+
+// Format returns the format of the stream as stored in
+// info.Info.EncFormat: the version in the low byte, the compression in
+// the next one, the padding in the one after and the parity shards per
+// group in the high byte.
+func (e *Encryptor) Format() int {
+	return int(e.version) | int(e.compression)<<8 | int(e.padding)<<16 | e.parity<<24
+}
+
+// FormatVersion returns the stream version of a format from Format.
+func FormatVersion(format int) byte {
+	return byte(format)
+}
+
+// FormatCompression returns the compression of a format from Format.
+func FormatCompression(format int) Compression {
+	return Compression(format >> 8)
+}
+
+// FormatPadding returns the padding of a format from Format.
+func FormatPadding(format int) Padding {
+	return Padding(format >> 16)
+}
+
+// FormatParity returns the parity shards per group of a format from
+// Format.
+func FormatParity(format int) int {
+	return int(byte(format >> 24))
+}
@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// compressiblePlaintext returns size bytes of text that compresses well
+func compressiblePlaintext(size int) []byte {
+	b := &bytes.Buffer{}
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(b, "line %d of a compressible file\n", i)
+	}
+	return b.Bytes()[:size]
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, int(ChunkSize), 3*int(ChunkSize) + 100}
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		for _, size := range sizes {
+			plain := compressiblePlaintext(size)
+			enc := testEncryptor()
+			err := enc.SetCompression(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext := &bytes.Buffer{}
+			_, err = enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+			if err != nil {
+				t.Fatalf("%v %d: could not encrypt: %v", c, size, err)
+			}
+			if size >= int(ChunkSize) && FormatCompression(enc.Format()) != c {
+				t.Errorf("%v %d: unexpected format %x", c, size, enc.Format())
+			}
+			if size > int(ChunkSize) && ciphertext.Len() > size/2 {
+				t.Errorf("%v %d: ciphertext not compressed, %d bytes", c, size, ciphertext.Len())
+			}
+			encrypted := ciphertext.Bytes()
+
+			dec := testEncryptor()
+			decrypted := &bytes.Buffer{}
+			_, err = dec.Encrypt(decrypted, bytes.NewReader(encrypted), false)
+			if err != nil {
+				t.Fatalf("%v %d: could not decrypt: %v", c, size, err)
+			}
+			if !bytes.Equal(plain, decrypted.Bytes()) {
+				t.Errorf("%v %d: decrypted text differs", c, size)
+			}
+			if dec.GetCompression() != enc.GetCompression() {
+				t.Errorf("%v %d: decryptor read compression %v", c, size, dec.GetCompression())
+			}
+
+			decrypted.Reset()
+			_, err = testEncryptor().EncryptParallel(decrypted, bytes.NewReader(encrypted), false, 3)
+			if err != nil {
+				t.Fatalf("%v %d: could not decrypt in parallel: %v", c, size, err)
+			}
+			if !bytes.Equal(plain, decrypted.Bytes()) {
+				t.Errorf("%v %d: parallel decrypted text differs", c, size)
+			}
+		}
+	}
+}
+
+func TestCompressParallel(t *testing.T) {
+	plain := compressiblePlaintext(5*int(ChunkSize) + 17)
+	enc := testEncryptor()
+	enc.SetCompression(CompressionZstd)
+	serial := &bytes.Buffer{}
+	_, err := enc.Encrypt(serial, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+
+	enc = testEncryptor()
+	enc.SetCompression(CompressionZstd)
+	parallel := &bytes.Buffer{}
+	_, err = enc.EncryptParallel(parallel, bytes.NewReader(plain), true, 4)
+	if err != nil {
+		t.Fatalf("could not encrypt in parallel: %v", err)
+	}
+	if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+		t.Error("parallel ciphertext differs from serial")
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	plain := testPlaintext(2*int(ChunkSize) + 5)
+	enc := testEncryptor()
+	enc.SetCompression(CompressionGzip)
+	ciphertext := &bytes.Buffer{}
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	if FormatCompression(enc.Format()) != CompressionNone || FormatVersion(enc.Format()) != currentVersion {
+		t.Errorf("unexpected format %x", enc.Format())
+	}
+
+	uncompressed := &bytes.Buffer{}
+	_, err = testEncryptor().Encrypt(uncompressed, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	if !bytes.Equal(ciphertext.Bytes(), uncompressed.Bytes()) {
+		t.Error("incompressible stream differs from an uncompressed one")
+	}
+}
+
+func TestCompressRandomAccess(t *testing.T) {
+	// a compressible start followed by incompressible chunks stored raw
+	plain := append(compressiblePlaintext(2*int(ChunkSize)), testPlaintext(2*int(ChunkSize)+321)...)
+	enc := testEncryptor()
+	enc.SetCompression(CompressionZstd)
+	ciphertext := &bytes.Buffer{}
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	backing := bytes.NewReader(ciphertext.Bytes())
+
+	r, err := NewDecryptReaderAt(enc.GetKey(), backing, backing.Size(), 2)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	if r.Size() != int64(len(plain)) {
+		t.Errorf("unexpected size %d", r.Size())
+	}
+	for _, off := range []int64{0, ChunkSize - 10, 3*ChunkSize + 7, int64(len(plain)) - 5} {
+		b := make([]byte, 100)
+		n, err := r.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("%d: unexpected error %v", off, err)
+		}
+		if !bytes.Equal(b[:n], plain[off:off+int64(n)]) {
+			t.Errorf("%d: bytes differ", off)
+		}
+	}
+
+	rs, err := NewDecryptReadSeeker(enc.GetKey(), backing)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	_, err = rs.Seek(ChunkSize+3, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(rs)
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if !bytes.Equal(rest, plain[ChunkSize+3:]) {
+		t.Error("bytes read after seek differ")
+	}
+
+	_, err = NewDecryptReaderAt(enc.GetKey(), backing, backing.Size()-1, 2)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	format := int(3) | int(CompressionZstd)<<8
+	if FormatVersion(format) != 3 || FormatCompression(format) != CompressionZstd {
+		t.Errorf("unexpected format parts of %x", format)
+	}
+	c, err := ParseCompression("gzip")
+	if err != nil || c != CompressionGzip {
+		t.Errorf("could not parse gzip: %v %v", c, err)
+	}
+	_, err = ParseCompression("lz4")
+	if err == nil {
+		t.Error("parsed unknown compression")
+	}
+	if testEncryptor().SetCompression(Compression(9)) == nil {
+		t.Error("set unknown compression")
+	}
+}
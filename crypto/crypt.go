@@ -2,9 +2,6 @@ package crypto
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha1"
-	"crypto/sha256"
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
@@ -15,91 +12,104 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// ChunkSize is the chunk size of new encryptors, and of version 1 and 2
+// streams, which don't record it.
 var ChunkSize = int64(1024 * 256) // 256KiB
 var debug = false
-var version = []byte{'b', 1}
-var headerOffset = 26 // 2 for version + 24 iv
+var currentVersion = byte(3)
+var versions = []byte{1, 2, 3}           // versions that can be decrypted
+var headerOffset = 26                    // 2 for version + 24 iv
+var frameHeaderSize = 4                  // length of a framed chunk
+var keySize = 256 / 8                    // 32 bytes or 256 bits
+var ivSize = chacha20poly1305.NonceSizeX // 24 bytes or 192 bits
 
 type Encryptor struct {
-	aead     cipher.AEAD
-	key      []byte // 32 bytes or 256 bits
-	iv       []byte // 24 bytes or 192 bits
-	nonce    []byte // 24 bytes or 192 bits
-	ChunkIdx int64  // chuckCount used to derive nonce
-	Overhead int64  // 16
+	aead        cipher.AEAD
+	key         []byte          // 32 bytes or 256 bits
+	iv          []byte          // 24 bytes or 192 bits
+	version     byte            // format version of the stream
+	chunkSize   int64           // plaintext bytes per chunk
+	compress    Compression     // compression requested for new streams
+	compression Compression     // compression of the stream
+	padding     Padding         // padding scheme of the stream
+	parity      int             // parity shards per group of chunks of the stream
+	parityGroup int             // chunks per parity group of the stream
+	hashes      []HashAlgorithm // digests computed over in and out
+	ChunkIdx    int64           // chuckCount used to derive nonce
+	Overhead    int64           // 16
 }
 
+// Hash holds the digests of the plaintext (In) and ciphertext (Out) of a
+// stream, for the hash algorithms of the encryptor.
 type Hash struct {
-	InSHA1    string
-	InSHA256  string
-	OutSHA1   string
-	OutSHA256 string
+	In  Digests
+	Out Digests
 }
 
 func EqualHash(a, b Hash) bool {
-	if a.InSHA1 != b.InSHA1 {
-		return false
-	}
-	if a.InSHA256 != b.InSHA256 {
-		return false
-	}
-	if a.OutSHA1 != b.OutSHA1 {
-		return false
-	}
-	if a.OutSHA256 != b.OutSHA256 {
-		return false
-	}
-	return true
+	return a.In.Equal(b.In) && a.Out.Equal(b.Out)
 }
 
 // Init sets up the internal oncryptor using current key and iv.
-func (e *Encryptor) Init() {
+// ErrBadKey is returned if the key has the wrong length.
+func (e *Encryptor) Init() error {
 	aead, err := chacha20poly1305.NewX(e.key)
 	if err != nil {
-		panic("could not creat aead:" + err.Error())
+		return fmt.Errorf("%w: %v", ErrBadKey, err)
 	}
 	e.aead = aead
 	e.Overhead = int64(aead.Overhead())
 	e.ChunkIdx = 0
+	return nil
 }
 
 // NewEncryptor generates a new random key, iv
-func NewEncryptor() *Encryptor {
+func NewEncryptor() (*Encryptor, error) {
 	e := Encryptor{}
-	newkey := make([]byte, 256/8)
-	_, err := rand.Read(newkey)
+	var err error
+	e.key, err = randomBytes(keySize)
 	if err != nil {
-		panic("Could not generate random key")
+		return nil, err
 	}
-	e.key = newkey
-
-	newiv := make([]byte, 192/8)
-	_, err = rand.Read(newiv)
+	e.iv, err = randomBytes(ivSize)
 	if err != nil {
-		panic("Could not generate iv")
+		return nil, err
 	}
-	e.iv = newiv
-
-	e.Init()
+	e.version = currentVersion
+	e.chunkSize = ChunkSize
+	e.hashes = DefaultHashes
 
-	return &e
+	err = e.Init()
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
 }
 
-func NewDecryptor(key, iv string) *Encryptor {
+// NewDecryptor returns an encryptor with the given base64 key and iv.
+// The iv may be empty, as streams since version 1 carry it in their
+// header. ErrBadKey is returned for an invalid key or iv.
+func NewDecryptor(key, iv string) (*Encryptor, error) {
 	e := Encryptor{}
-	var err error
-	e.key, err = base64.RawURLEncoding.DecodeString(key)
+	err := e.SetKey(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	e.iv, err = base64.RawURLEncoding.DecodeString(iv)
+	if iv != "" {
+		err = e.SetIv(iv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.chunkSize = ChunkSize
+	e.hashes = DefaultHashes
+	err = e.Init()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	e.Init()
-
-	return &e
+	return &e, nil
 }
+
 func (e *Encryptor) GetKey() string {
 	return fmt.Sprintf("%s", base64.RawURLEncoding.EncodeToString(e.key))
 }
@@ -108,212 +118,352 @@ func (e *Encryptor) GetIv() string {
 	return fmt.Sprintf("%s", base64.RawURLEncoding.EncodeToString(e.iv))
 }
 
-func (e *Encryptor) SetKey(key string) {
+// SetKey sets the base64 key. Init has to be called for it to be used.
+// ErrBadKey is returned for an invalid key, which is not set.
+func (e *Encryptor) SetKey(key string) error {
 	k, err := base64.RawURLEncoding.DecodeString(key)
-	if err == nil {
-		e.key = k
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadKey, err)
+	}
+	if len(k) != keySize {
+		return fmt.Errorf("%w: %d bytes", ErrBadKey, len(k))
 	}
+	e.key = k
+	return nil
 }
 
-func (e *Encryptor) SetIv(iv string) {
+// SetIv sets the base64 iv. ErrBadKey is returned for an invalid iv,
+// which is not set.
+func (e *Encryptor) SetIv(iv string) error {
 	i, err := base64.RawURLEncoding.DecodeString(iv)
-	if err == nil {
-		e.iv = i
+	if err != nil {
+		return fmt.Errorf("%w: iv: %v", ErrBadKey, err)
+	}
+	if len(i) != ivSize {
+		return fmt.Errorf("%w: iv of %d bytes", ErrBadKey, len(i))
 	}
+	e.iv = i
+	return nil
 }
 
 // Read plain/cipher text from in io.Reader and writes plain/cipher
 // text to out io.Writer. If encrypt is true, then in is the plaintext.
+// Encryption always produces the current format version, and leaves e
+// reporting the format of the stream it wrote in Format. Decryption
+// accepts every version listed in versions and returns ErrTruncated if
+// trailing chunks of a version 2 stream are missing. The padding of padded
+// streams is not written to out.
 func (e *Encryptor) Encrypt(out io.Writer, in io.Reader, encrypt bool) (Hash, error) {
+	if encrypt {
+		w := NewEncryptWriter(e, out)
+		_, err := io.Copy(w, in)
+		if err == nil {
+			err = w.Close()
+		}
+		e.version = w.enc.version
+		e.compression = w.enc.compression
+		e.ChunkIdx = w.chunkIdx
+		return w.Hash(), err
+	}
+
 	hash := Hash{}
 
-	inSha256 := sha256.New()
-	inSha1 := sha1.New()
-	outSha256 := sha256.New()
-	outSha1 := sha1.New()
+	inHash, err := NewHashSet(e.hashes)
+	if err != nil {
+		return hash, err
+	}
+	outHash, err := NewHashSet(e.hashes)
+	if err != nil {
+		return hash, err
+	}
+	out = io.MultiWriter(out, outHash)
 
 	e.ChunkIdx = 0
-	bufSize := 1024 * 64
+	header, err := e.readHeader(in)
+	if err != nil {
+		return hash, err
+	}
+	inHash.Write(header)
 
-	var scratch []byte
-	var inChunkSize int64
-	var outChunkSize int64
-	if encrypt {
-		inChunkSize = ChunkSize
-		outChunkSize = ChunkSize + e.Overhead
-		n, err := out.Write(version)
-		outSha1.Write(version)
-		outSha256.Write(version)
-		if err != nil || n != 2 {
-			return hash, errors.New("could not write header part 1")
+	var outBytes []byte
+	written, size := int64(0), int64(-1)
+	err = e.readSealedChunks(io.TeeReader(in, inHash), func(chunk []byte, last bool) error {
+		var err error
+		if len(chunk) == 0 && e.ChunkIdx == 0 && e.version == 1 {
+			return nil // version 1 does not write a chunk for empty input
 		}
-		n, err = out.Write(e.iv)
-		outSha1.Write(e.iv)
-		outSha256.Write(e.iv)
-		if err != nil || n != 24 {
-			return hash, errors.New("could not write header part 2")
+		outBytes, size, err = e.decodeChunk(outBytes[:0], chunk, e.ChunkIdx, last)
+		if err != nil {
+			return err
 		}
-	} else {
-		inChunkSize = ChunkSize + e.Overhead
-		outChunkSize = ChunkSize
-
-		header := make([]byte, headerOffset)
-		n, err := in.Read(header)
-		if err != nil || n != headerOffset {
-			return hash, errors.New("could not read header")
+		written += int64(len(outBytes))
+		w, err := out.Write(outBytes)
+		if debug {
+			fmt.Printf("wrote %d bytes\n", w)
+		}
+		if err != nil {
+			return err
 		}
-		if !(header[0] == 'b' && header[1] == 1) {
-			return hash, errors.New("unrecognized header")
+		if w != len(outBytes) {
+			return errors.New(fmt.Sprintf("Expected to write %d, but actually wrote %d", len(outBytes), w))
 		}
-		e.iv = header[2:headerOffset]
-		inSha1.Write(header)
-		inSha256.Write(header)
+		e.ChunkIdx += 1
+		return nil
+	})
+	if err != nil {
+		return hash, err
 	}
-	inBytes := make([]byte, inChunkSize)
-	outBytes := make([]byte, outChunkSize)
-	inCount := int64(0)
-	scratch = make([]byte, bufSize)
+	if e.padding != PaddingNone && size != written {
+		return hash, ErrPaddingSize
+	}
+
+	hash.In = inHash.Digests()
+	hash.Out = outHash.Digests()
+	return hash, nil
+}
 
+// readChunks reads in in pieces of size bytes and calls fn for each of
+// them. The final piece is flagged as last and may be shorter than size,
+// or empty if in is empty. One piece is read ahead to find the last one.
+func readChunks(in io.Reader, size int64, fn func(chunk []byte, last bool) error) error {
+	cur := make([]byte, size)
+	next := make([]byte, size)
+	n, err := readFull(in, cur)
+	if err != nil {
+		return err
+	}
 	for {
-		n, err := in.Read(scratch)
-		n64 := int64(n)
-		if inCount+n64 < inChunkSize { // still filing chunk
-			o := copy(inBytes[inCount:], scratch[0:n])
-			inSha1.Write(scratch[0:n])
-			inSha256.Write(scratch[0:n])
-			if debug {
-				fmt.Printf("filling: incount, n: %d %d\n", inCount, n)
-			}
-			if o != n {
-				return hash, errors.New(fmt.Sprintf("1: Expected %d, but copied %d", n, o))
-			}
-			inCount += n64
-		} else { // finish chunk and start new chunk
-			// fill chunk
-			if debug {
-				fmt.Printf("else: incount, n: %d %d\n", inCount, n)
-			}
-			lenPartial := inChunkSize - inCount
-			remaining := n64 - lenPartial
-			if debug {
-				fmt.Printf("lenPartial, remaining: %d %d\n", lenPartial, remaining)
-			}
-			o := copy(inBytes[inCount:], scratch[0:lenPartial])
-			o64 := int64(o)
-			inSha1.Write(scratch[0:lenPartial])
-			inSha256.Write(scratch[0:lenPartial])
-			if o64 != lenPartial {
-				return hash, errors.New(fmt.Sprintf("2: Expected %d, but copied %d", lenPartial, o))
-			}
-			inCount += o64
-			outBytes = outBytes[:0]
-			// fill outbuf
-			if encrypt {
-				outBytes = e.aead.Seal(outBytes, e.currentNonce(), inBytes[0:inCount], nil)
-			} else {
-				outBytes, err = e.aead.Open(outBytes, e.currentNonce(), inBytes[0:inCount], nil)
-				if err != nil {
-					return hash, err
-				}
-			}
-			w, err := out.Write(outBytes)
-			if err != nil {
-				return hash, err
-			}
-			outSha1.Write(outBytes)
-			outSha256.Write(outBytes)
-			if debug {
-				fmt.Printf("wrote %d bytes\n", w)
-			}
-			if w != len(outBytes) {
-				return hash, errors.New(fmt.Sprintf("Expected to write %d, but actually wrote %d", len(outBytes), w))
-			}
-
-			// continue
-			e.ChunkIdx += 1
-			inCount = 0
-			// and fill with remaining partial
-			if lenPartial > 0 {
-				o = copy(inBytes[inCount:], scratch[lenPartial:n])
-				o64 := int64(o)
-				inSha1.Write(scratch[lenPartial:n])
-				inSha256.Write(scratch[lenPartial:n])
-				if o64 != remaining {
-					return hash, errors.New(fmt.Sprintf("3: Expected %d, but copied %d", remaining, o))
-				}
-				inCount += o64
-			}
+		if n < len(cur) {
+			return fn(cur[:n], true)
 		}
+		m, err := readFull(in, next)
 		if err != nil {
-			if err == io.EOF {
-				if debug {
-					fmt.Printf("EOF\n")
-				}
-				break
-			}
-			return hash, err
+			return err
+		}
+		if m == 0 {
+			return fn(cur[:n], true)
 		}
+		err = fn(cur[:n], false)
+		if err != nil {
+			return err
+		}
+		cur, next = next, cur
+		n = m
 	}
-	// write the rest
-	if inCount > 0 {
-		var err error
-		outBytes = outBytes[:0]
-		if encrypt {
-			outBytes = e.aead.Seal(outBytes, e.currentNonce(), inBytes[0:inCount], nil)
-		} else {
-			outBytes, err = e.aead.Open(outBytes, e.currentNonce(), inBytes[0:inCount], nil)
-			if err != nil {
-				return hash, err
-			}
+}
+
+// readSealedChunks reads the sealed chunks following the header from in,
+// and calls fn for each of them like readChunks does. Chunks of
+// compressed streams vary in size, so each is framed by its length.
+// Damaged chunks of streams with parity are rebuilt if they can be.
+func (e *Encryptor) readSealedChunks(in io.Reader, fn func(chunk []byte, last bool) error) error {
+	if !e.framed() {
+		return readChunks(in, e.chunkSize+e.Overhead, fn)
+	}
+	if e.parity != 0 {
+		return e.readParityGroups(in, fn)
+	}
+	maxSize := e.maxSealedSize()
+	cur, eof, err := readFrame(in, nil, maxSize)
+	if err != nil {
+		return err
+	}
+	if eof {
+		return fn(nil, true)
+	}
+	var next []byte
+	for {
+		next, eof, err = readFrame(in, next, maxSize)
+		if err != nil {
+			return err
 		}
-		if len(outBytes) > 0 {
-			w, err := out.Write(outBytes)
-			if debug {
-				fmt.Printf("wrote remaining %d bytes\n", w)
-			}
-			outSha1.Write(outBytes)
-			outSha256.Write(outBytes)
-			if err != nil {
-				return hash, err
-			}
-			if w != len(outBytes) {
-				return hash, errors.New(fmt.Sprintf("Expected to write %d, but actually wrote %d", len(outBytes), w))
-			}
+		if eof {
+			return fn(cur, true)
+		}
+		err = fn(cur, false)
+		if err != nil {
+			return err
 		}
+		cur, next = next, cur
 	}
+}
 
-	hash.InSHA1 = fmt.Sprintf("%x", inSha1.Sum(nil))
-	hash.InSHA256 = fmt.Sprintf("%x", inSha256.Sum(nil))
-	hash.OutSHA1 = fmt.Sprintf("%x", outSha1.Sum(nil))
-	hash.OutSHA256 = fmt.Sprintf("%x", outSha256.Sum(nil))
-	return hash, nil
+// readFrame reads a length framed chunk into buf. eof is true if in has no
+// more frames.
+func readFrame(in io.Reader, buf []byte, maxSize int64) (frame []byte, eof bool, err error) {
+	size := make([]byte, frameHeaderSize)
+	n, err := io.ReadFull(in, size)
+	if err == io.EOF {
+		return buf, true, nil
+	}
+	if err != nil {
+		if n > 0 && err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return nil, false, err
+	}
+	frameSize := int64(binary.LittleEndian.Uint32(size))
+	if frameSize > maxSize {
+		return nil, false, fmt.Errorf("%w: size %d", ErrBadChunk, frameSize)
+	}
+	if int64(cap(buf)) < frameSize {
+		buf = make([]byte, frameSize, maxSize)
+	}
+	buf = buf[:frameSize]
+	_, err = io.ReadFull(in, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return buf, false, err
+}
+
+// readFull is io.ReadFull, except that running out of input is not an error.
+func readFull(in io.Reader, b []byte) (int, error) {
+	n, err := io.ReadFull(in, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
 }
 
 // compute 192 bit (24 byte) nonce from iv and ChunkIdx
 func (e *Encryptor) currentNonce() []byte {
-	if e.nonce == nil {
-		e.nonce = make([]byte, chacha20poly1305.NonceSizeX)
-		copy(e.nonce, e.iv)
-	}
+	return e.chunkNonce(e.ChunkIdx)
+}
+
+// compute 192 bit (24 byte) nonce from iv and chunk index idx
+func (e *Encryptor) chunkNonce(idx int64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, e.iv)
 
 	num := binary.LittleEndian.Uint64(e.iv[16:])
-	num += uint64(e.ChunkIdx)
+	num += uint64(idx)
 	if debug {
 		fmt.Printf("new nonce with ChunkIdx %d\n", num)
 	}
-	binary.LittleEndian.PutUint64(e.nonce[16:], num)
-	return e.nonce
+	binary.LittleEndian.PutUint64(nonce[16:], num)
+	return nonce
+}
+
+// additionalData authenticates the header, whether a chunk is the final
+// one, so chunks can be neither dropped from the end nor appended, and
+// whether it is padding. Version 1 streams have no additional data.
+func (e *Encryptor) additionalData(last, padding bool) []byte {
+	if e.version < 2 {
+		return nil
+	}
+	flags := byte(0)
+	if last {
+		flags |= chunkLast
+	}
+	if padding {
+		flags |= chunkPadding
+	}
+	return append(e.header(), flags)
+}
+
+func (e *Encryptor) sealChunk(cipherBytes, plainBytes []byte, idx int64, last bool) []byte {
+	return e.aead.Seal(cipherBytes, e.chunkNonce(idx), plainBytes, e.additionalData(last, false))
+}
+
+// framed reports whether the sealed chunks of the stream are preceded by
+// their length.
+func (e *Encryptor) framed() bool {
+	return e.compression != CompressionNone || e.padding != PaddingNone || e.parity != 0
+}
+
+// maxSealedSize returns the largest size of a sealed chunk.
+func (e *Encryptor) maxSealedSize() int64 {
+	if e.framed() {
+		return e.chunkSize + 1 + e.Overhead
+	}
+	return e.chunkSize + e.Overhead
+}
+
+// encodeChunk compresses and seals a chunk of plaintext, appending the
+// result, framed if need be, to dst. scratch is reused for compression.
+func (e *Encryptor) encodeChunk(dst, scratch, plainBytes []byte, idx int64, last bool) ([]byte, []byte, error) {
+	packed, err := e.packChunk(scratch, plainBytes)
+	if err != nil {
+		return nil, scratch, err
+	}
+	if e.compression != CompressionNone {
+		scratch = packed
+	}
+	if !e.framed() {
+		return e.sealChunk(dst, packed, idx, last), scratch, nil
+	}
+	start := len(dst)
+	dst = append(dst, make([]byte, frameHeaderSize)...)
+	dst = e.sealChunk(dst, packed, idx, last)
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start-frameHeaderSize))
+	return dst, scratch, nil
+}
+
+// decodeChunk opens and decompresses a sealed chunk, appending the
+// plaintext to dst. size is the plaintext size of the stream if the chunk
+// is the final chunk of a padded stream, and -1 otherwise.
+func (e *Encryptor) decodeChunk(dst, cipherBytes []byte, idx int64, last bool) (plain []byte, size int64, err error) {
+	if e.padding != PaddingNone {
+		plain, size, err = e.openPadded(dst, cipherBytes, idx, last)
+	} else if e.compression == CompressionNone {
+		plain, err = e.openChunk(dst, cipherBytes, idx, last)
+		size = -1
+	} else {
+		var packed []byte
+		packed, err = e.openChunk(nil, cipherBytes, idx, last)
+		if err == nil {
+			plain, err = e.unpackChunk(dst, packed)
+		}
+		size = -1
+	}
+	if err != nil {
+		return nil, -1, &ChunkError{Index: idx, Err: err}
+	}
+	return plain, size, nil
+}
+
+// DecryptChunk decrypts the chunk at ChunkIdx. last tells whether the
+// chunk is the final chunk of the stream. If a version 2 chunk only
+// authenticates with the opposite flag, ErrTruncated or ErrTrailingData
+// is returned.
+func (e *Encryptor) DecryptChunk(plainBytes, cipherBytes []byte, last bool) ([]byte, error) {
+	plain, _, err := e.decodeChunk(plainBytes, cipherBytes, e.ChunkIdx, last)
+	return plain, err
 }
 
-func (e *Encryptor) DecryptChunk(plainBytes, cipherBytes []byte) ([]byte, error) {
-	outBytes, err := e.aead.Open(plainBytes, e.currentNonce(), cipherBytes, nil)
-	return outBytes, err
+func (e *Encryptor) openChunk(plainBytes, cipherBytes []byte, idx int64, last bool) ([]byte, error) {
+	return e.openChunkFlags(plainBytes, cipherBytes, idx, last, false)
+}
+
+func (e *Encryptor) openChunkFlags(plainBytes, cipherBytes []byte, idx int64, last, padding bool) ([]byte, error) {
+	if len(cipherBytes) == 0 && last && e.version >= 2 {
+		return nil, ErrTruncated
+	}
+	nonce := e.chunkNonce(idx)
+	outBytes, err := e.aead.Open(plainBytes, nonce, cipherBytes, e.additionalData(last, padding))
+	if err == nil {
+		return outBytes, nil
+	}
+	if e.version < 2 {
+		return nil, ErrAuthFailed
+	}
+	_, err2 := e.aead.Open(plainBytes, nonce, cipherBytes, e.additionalData(!last, padding))
+	if err2 == nil {
+		if last {
+			return nil, ErrTruncated
+		}
+		return nil, ErrTrailingData
+	}
+	return nil, ErrAuthFailed
 }
 
 // NewEncname generates a random 200 bit number and returns the base32 string
-func NewEncname() string {
-	newkey := make([]byte, 200/8)
-	_, _ = rand.Read(newkey)
+func NewEncname() (string, error) {
+	newkey, err := randomBytes(200 / 8)
+	if err != nil {
+		return "", err
+	}
 	name := base32.StdEncoding.EncodeToString(newkey)
-	return name
+	return name, nil
 }
@@ -1,9 +1,12 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -21,17 +24,30 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Error("Could not open output file")
 	}
 
-	encryptor := NewEncryptor()
+	encryptor, err := NewEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
 	keyHex := "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
 	key, _ := hex.DecodeString(keyHex)
 	keyB64 := base64.RawURLEncoding.EncodeToString(key)
-	encryptor.SetKey(keyB64)
+	err = encryptor.SetKey(keyB64)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ivHex := "000102030405060708090a0b0c0d0e0f0001020304050607"
 	iv, _ := hex.DecodeString(ivHex)
 	ivB64 := base64.RawURLEncoding.EncodeToString(iv)
-	encryptor.SetIv(ivB64)
-	encryptor.Init()
+	err = encryptor.SetIv(ivB64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encryptor.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor.SetHashes(HashSHA1, HashSHA256)
 
 	if ivB64 != encryptor.GetIv() {
 		t.Error("Error getting IV")
@@ -45,17 +61,17 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Errorf("Error encrypting file: %v", err)
 	}
 
-	if hash.InSHA1 != "c19451af499dadf2d0f035ce36532e3fc3d6c172" {
-		t.Errorf("wrong hash %s", hash.InSHA1)
+	if hash.In[HashSHA1] != "c19451af499dadf2d0f035ce36532e3fc3d6c172" {
+		t.Errorf("wrong hash %s", hash.In[HashSHA1])
 	}
-	if hash.InSHA256 != "9627a54a4bbabf51eaa39f6e9169e3364f0b4c54a1522f4ddfd6637384cc15de" {
-		t.Errorf("wrong hash %s", hash.InSHA256)
+	if hash.In[HashSHA256] != "9627a54a4bbabf51eaa39f6e9169e3364f0b4c54a1522f4ddfd6637384cc15de" {
+		t.Errorf("wrong hash %s", hash.In[HashSHA256])
 	}
-	if hash.OutSHA1 != "1a81793ad5a5b0ef5d668d21235950a724b1d3dd" {
-		t.Errorf("wrong hash %s", hash.OutSHA1)
+	if hash.Out[HashSHA1] != "5f8ec18d76077e6f10999a842964ac547d6d244a" {
+		t.Errorf("wrong hash %s", hash.Out[HashSHA1])
 	}
-	if hash.OutSHA256 != "3969fcfd5ba999c74d874cc1a5d42ea7a98bc5d5796caab3d4a201018af77544" {
-		t.Errorf("wrong hash %s", hash.OutSHA256)
+	if hash.Out[HashSHA256] != "1918876f0ba706acb76d9719741f83af476cc3c6ec4f5421defa44dcf38e095b" {
+		t.Errorf("wrong hash %s", hash.Out[HashSHA256])
 	}
 
 	ciphertext.Sync()
@@ -63,7 +79,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error getting ciphertext stats")
 	}
-	if ciphertextStats.Size() != int64(1024*1024+4*encryptor.Overhead)+int64(headerOffset) {
+	if ciphertextStats.Size() != int64(1024*1024+4*encryptor.Overhead)+encryptor.headerSize() {
 		t.Errorf("unexpected ciphertext size  %d", ciphertextStats.Size())
 	}
 
@@ -104,8 +120,145 @@ func TestEncryptDecrypt(t *testing.T) {
 }
 
 func TestNewEncname(t *testing.T) {
-	encname := NewEncname()
+	encname, err := NewEncname()
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(string(encname)) != 40 {
 		t.Error("Did not generate encname")
 	}
 }
+
+// testEncryptor returns an encryptor with the fixed key and iv used by the tests
+func testEncryptor() *Encryptor {
+	keyHex := "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	key, _ := hex.DecodeString(keyHex)
+	ivHex := "000102030405060708090a0b0c0d0e0f0001020304050607"
+	iv, _ := hex.DecodeString(ivHex)
+	enc, err := NewDecryptor(base64.RawURLEncoding.EncodeToString(key), base64.RawURLEncoding.EncodeToString(iv))
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+// testKey returns a new random base64 key.
+func testKey(t *testing.T) string {
+	enc, err := NewEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc.GetKey()
+}
+
+func testPlaintext(size int) []byte {
+	b := make([]byte, size)
+	r := rand.New(rand.NewSource(int64(size)))
+	r.Read(b)
+	return b
+}
+
+func TestEncryptDecryptSizes(t *testing.T) {
+	sizes := []int{0, 1, int(ChunkSize) - 1, int(ChunkSize), int(ChunkSize) + 1, 3 * int(ChunkSize)}
+	for _, size := range sizes {
+		plain := testPlaintext(size)
+		enc := testEncryptor()
+		ciphertext := &bytes.Buffer{}
+		_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+		if err != nil {
+			t.Fatalf("%d: could not encrypt: %v", size, err)
+		}
+		decrypted := &bytes.Buffer{}
+		_, err = testEncryptor().Encrypt(decrypted, ciphertext, false)
+		if err != nil {
+			t.Fatalf("%d: could not decrypt: %v", size, err)
+		}
+		if !bytes.Equal(plain, decrypted.Bytes()) {
+			t.Errorf("%d: decrypted text differs", size)
+		}
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	plain := testPlaintext(3*int(ChunkSize) + 100)
+	ciphertext := &bytes.Buffer{}
+	enc := testEncryptor()
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	full := ciphertext.Bytes()
+	cipherChunkSize := int(ChunkSize) + 16
+	headerSize := int(enc.headerSize())
+
+	// drop the final chunk, and then all chunks
+	for _, end := range []int{headerSize + 3*cipherChunkSize, headerSize} {
+		_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(full[:end]), false)
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d: expected ErrTruncated, got %v", end, err)
+		}
+		_, err = NewDecryptReadSeeker(testEncryptor().GetKey(), bytes.NewReader(full[:end]))
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d: expected ErrTruncated from reader, got %v", end, err)
+		}
+	}
+
+	// a copy of the final chunk appended to the stream
+	extended := append(append([]byte{}, full...), full[headerSize+3*cipherChunkSize:]...)
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(extended), false)
+	if err == nil {
+		t.Errorf("expected error decrypting extended stream")
+	}
+
+	// the header is authenticated too
+	tampered := append([]byte{}, full...)
+	tampered[1] = 2
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(tampered[:headerOffset]), false)
+	if err == nil {
+		t.Errorf("expected error decrypting with a downgraded header")
+	}
+
+	tampered = append([]byte{}, full...)
+	tampered[headerOffset] ^= 1 // the chunk size
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(tampered), false)
+	if err == nil {
+		t.Errorf("expected error decrypting with a downgraded header")
+	}
+}
+
+func TestDecryptVersion1(t *testing.T) {
+	// build a version 1 stream by hand: no additional data, and no
+	// final chunk marker
+	plain := testPlaintext(2*int(ChunkSize) + 7)
+	enc := testEncryptor()
+	v1 := append([]byte{'b', 1}, enc.iv...)
+	for i := int64(0); i*ChunkSize < int64(len(plain)); i++ {
+		end := (i + 1) * ChunkSize
+		if end > int64(len(plain)) {
+			end = int64(len(plain))
+		}
+		enc.ChunkIdx = i
+		v1 = enc.aead.Seal(v1, enc.currentNonce(), plain[i*ChunkSize:end], nil)
+	}
+
+	decrypted := &bytes.Buffer{}
+	_, err := testEncryptor().Encrypt(decrypted, bytes.NewReader(v1), false)
+	if err != nil {
+		t.Fatalf("could not decrypt version 1: %v", err)
+	}
+	if !bytes.Equal(plain, decrypted.Bytes()) {
+		t.Errorf("version 1 decrypted text differs")
+	}
+
+	dec, err := NewDecryptReadSeeker(enc.GetKey(), bytes.NewReader(v1))
+	if err != nil {
+		t.Fatalf("could not open version 1: %v", err)
+	}
+	all, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("could not read version 1: %v", err)
+	}
+	if !bytes.Equal(plain, all) {
+		t.Errorf("version 1 read text differs")
+	}
+}
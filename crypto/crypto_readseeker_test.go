@@ -24,16 +24,17 @@ func testGenerate(t *testing.T) {
 		t.Error("Could not open output file")
 	}
 
-	encryptor := NewEncryptor()
+	encryptor, err := NewEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
 	encryptor.SetKey("000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f")
 	encryptor.SetIv("000102030405060708090a0b0c0d0e0f0001020304050607")
 	encryptor.Init()
 
 	hash, err := encryptor.Encrypt(ciphertext, plaintext, true)
-	fmt.Printf("insha1 %s\n", hash.InSHA1)
-	fmt.Printf("insha256 %s\n", hash.InSHA256)
-	fmt.Printf("outsha1 %s\n", hash.OutSHA1)
-	fmt.Printf("outsha256 %s\n", hash.OutSHA256)
+	fmt.Printf("in %s\n", hash.In)
+	fmt.Printf("out %s\n", hash.Out)
 }
 
 func TestReadSeeker(t *testing.T) {
@@ -60,7 +61,7 @@ func TestReadSeeker(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	lenFile := pInfo.Size()
-	dec, err := NewDecryptReadSeeker(keyB64, lenFile, f)
+	dec, err := NewDecryptReadSeeker(keyB64, f)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -166,10 +167,13 @@ func TestReadWhole(t *testing.T) {
 		t.Fatal("Couldn't open test file")
 	}
 
-	dec, err := NewDecryptReadSeeker(keyB64, st.Size(), f)
+	dec, err := NewDecryptReadSeeker(keyB64, f)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
+	if end, _ := dec.Seek(0, io.SeekEnd); end != st.Size() {
+		t.Errorf("unexpected plaintext size %d", end)
+	}
 	// read the whole file
 	decbytes := make([]byte, 1024*8-1) // weird size uncovers bugs
 	pbytes := make([]byte, 1024*8-1)
@@ -217,3 +221,50 @@ func TestReadWhole(t *testing.T) {
 		}
 	}
 }
+
+func TestReadSeekerSize(t *testing.T) {
+	sizes := []int{0, 1, int(ChunkSize), 2*int(ChunkSize) + 9}
+	for _, size := range sizes {
+		plain := testPlaintext(size)
+		enc := testEncryptor()
+		enc.SetChunkSize(4096)
+		ciphertext := &bytes.Buffer{}
+		_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+		if err != nil {
+			t.Fatalf("%d: could not encrypt: %v", size, err)
+		}
+
+		// only the key and the object are needed
+		dec, err := NewDecryptReadSeeker(enc.GetKey(), bytes.NewReader(ciphertext.Bytes()))
+		if err != nil {
+			t.Fatalf("%d: could not open: %v", size, err)
+		}
+		end, err := dec.Seek(0, io.SeekEnd)
+		if err != nil || end != int64(size) {
+			t.Errorf("%d: seek to end gave %d %v", size, end, err)
+		}
+		if size == 0 {
+			continue
+		}
+		offset, err := dec.Seek(-1, io.SeekEnd)
+		b := make([]byte, 10)
+		n, _ := dec.Read(b)
+		if err != nil || offset != int64(size)-1 || n != 1 || b[0] != plain[offset] {
+			t.Errorf("%d: could not read the last byte: %v", size, err)
+		}
+		offset, err = dec.Seek(-1, io.SeekCurrent)
+		if err != nil || offset != int64(size)-1 {
+			t.Errorf("%d: seek back gave %d %v", size, offset, err)
+		}
+		if _, err = dec.Seek(-int64(size)-1, io.SeekEnd); err == nil {
+			t.Errorf("%d: expected error seeking before the start", size)
+		}
+		if offset, _ = dec.Seek(0, io.SeekCurrent); offset != int64(size)-1 {
+			t.Errorf("%d: failed seek moved to %d", size, offset)
+		}
+		offset, err = dec.Seek(1, io.SeekEnd)
+		if n, rerr := dec.Read(b); err != nil || offset != int64(size)+1 || n != 0 || rerr != io.EOF {
+			t.Errorf("%d: read past the end gave %d %v %v", size, n, err, rerr)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package crypto
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCacheChunks is the number of decrypted chunks a DecryptReaderAt
+// keeps when no cache size is given.
+var DefaultCacheChunks = 16
+
+// DecryptReaderAt reads the plaintext of an encrypted object at arbitrary
+// offsets. It is safe for concurrent use. Decrypted chunks are kept in a
+// bounded LRU cache, so neighbouring reads don't decrypt a chunk twice.
+type DecryptReaderAt struct {
+	enc       *Encryptor
+	backing   io.ReaderAt
+	layout    *chunkLayout
+	size      int64 // plaintext size
+	lastChunk int64
+	hits      int64
+	misses    int64
+
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // of *cachedChunk, most recently used first
+	chunks   map[int64]*list.Element
+}
+
+type cachedChunk struct {
+	idx   int64
+	plain []byte
+	err   error
+	ready chan struct{} // closed once plain or err is set
+}
+
+// NewDecryptReaderAt returns a reader of the plaintext of backing, which
+// holds backingSize bytes of ciphertext. cacheChunks is the number of
+// decrypted chunks to keep, DefaultCacheChunks if 0 or less. The final
+// chunk is authenticated up front, so truncated objects fail with
+// ErrTruncated, as do objects shorter than backingSize. The plaintext
+// size is taken from the final chunk, so the padding of padded objects is
+// never read.
+func NewDecryptReaderAt(key string, backing io.ReaderAt, backingSize int64, cacheChunks int) (*DecryptReaderAt, error) {
+	if cacheChunks <= 0 {
+		cacheChunks = DefaultCacheChunks
+	}
+	enc, err := NewDecryptor(key, "")
+	if err != nil {
+		return nil, err
+	}
+	r := DecryptReaderAt{
+		enc:      enc,
+		backing:  backing,
+		capacity: cacheChunks,
+		lru:      list.New(),
+		chunks:   make(map[int64]*list.Element),
+	}
+	_, err = r.enc.readHeader(io.NewSectionReader(backing, 0, backingSize))
+	if err != nil {
+		return nil, err
+	}
+	err = checkSize(backing, backingSize)
+	if err != nil {
+		return nil, err
+	}
+
+	r.layout, err = r.enc.newChunkLayout(backing, backingSize)
+	if err != nil {
+		return nil, err
+	}
+	r.lastChunk = r.layout.count() - 1
+	if r.lastChunk < 0 {
+		if r.enc.version >= 2 {
+			return nil, ErrTruncated
+		}
+		return &r, nil // an empty version 1 object
+	}
+
+	if r.enc.padding != PaddingNone {
+		cipherBytes, err := r.sealedChunk(r.lastChunk)
+		if err != nil {
+			return nil, err
+		}
+		_, r.size, err = r.enc.decodeChunk(nil, cipherBytes, r.lastChunk, true)
+		if err != nil {
+			return nil, err
+		}
+		if r.size > r.lastChunk*r.enc.chunkSize {
+			return nil, ErrPaddingSize
+		}
+		return &r, nil
+	}
+
+	// the size of the final chunk gives the plaintext size
+	last, err := r.chunk(r.lastChunk)
+	if err != nil {
+		return nil, err
+	}
+	r.size = r.lastChunk*r.enc.chunkSize + int64(len(last))
+	return &r, nil
+}
+
+// checkSize returns ErrTruncated if backing holds fewer than size bytes,
+// which the layout of the chunks is worked out from.
+func checkSize(backing io.ReaderAt, size int64) error {
+	n, err := backing.ReadAt(make([]byte, 1), size-1)
+	if n == 1 {
+		return nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: object is shorter than %d bytes", ErrTruncated, size)
+	}
+	return err
+}
+
+// Size returns the size of the plaintext.
+func (r *DecryptReaderAt) Size() int64 {
+	return r.size
+}
+
+// CacheStats returns the number of chunk lookups served from the cache
+// and the number that had to be decrypted.
+func (r *DecryptReaderAt) CacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&r.hits), atomic.LoadInt64(&r.misses)
+}
+
+func (r *DecryptReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(b) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		plain, err := r.chunk(off / r.enc.chunkSize)
+		if err != nil {
+			return n, err
+		}
+		m := copy(b[n:], plain[off%r.enc.chunkSize:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// chunk returns the plaintext of chunk idx, from the cache if possible.
+// Concurrent lookups of a chunk being decrypted wait for it.
+func (r *DecryptReaderAt) chunk(idx int64) ([]byte, error) {
+	r.mu.Lock()
+	if e, ok := r.chunks[idx]; ok {
+		r.lru.MoveToFront(e)
+		r.mu.Unlock()
+		atomic.AddInt64(&r.hits, 1)
+		c := e.Value.(*cachedChunk)
+		<-c.ready
+		return c.plain, c.err
+	}
+	c := &cachedChunk{idx: idx, ready: make(chan struct{})}
+	r.chunks[idx] = r.lru.PushFront(c)
+	for r.lru.Len() > r.capacity {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.chunks, oldest.Value.(*cachedChunk).idx)
+	}
+	r.mu.Unlock()
+	atomic.AddInt64(&r.misses, 1)
+
+	c.plain, c.err = r.decryptChunk(idx)
+	close(c.ready)
+	if c.err != nil {
+		r.mu.Lock()
+		if e, ok := r.chunks[idx]; ok && e.Value == c {
+			r.lru.Remove(e)
+			delete(r.chunks, idx)
+		}
+		r.mu.Unlock()
+	}
+	return c.plain, c.err
+}
+
+func (r *DecryptReaderAt) decryptChunk(idx int64) ([]byte, error) {
+	cipherBytes, err := r.sealedChunk(idx)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := r.enc.decodeChunk(make([]byte, 0, r.enc.chunkSize), cipherBytes, idx, idx == r.lastChunk)
+	if err != nil {
+		return nil, err
+	}
+	if r.enc.padding != PaddingNone {
+		expected := r.enc.chunkSize
+		if r.size-idx*r.enc.chunkSize < expected {
+			expected = r.size - idx*r.enc.chunkSize
+		}
+		if int64(len(plain)) != expected {
+			return nil, ErrPaddingSize
+		}
+	} else if idx != r.lastChunk && int64(len(plain)) != r.enc.chunkSize {
+		return nil, &ChunkError{Index: idx, Err: fmt.Errorf("%w: short chunk", ErrBadChunk)}
+	}
+	return plain, nil
+}
+
+// sealedChunk reads sealed chunk idx from the backing object. A damaged
+// chunk of a stream with parity is rebuilt from the rest of its group.
+func (r *DecryptReaderAt) sealedChunk(idx int64) ([]byte, error) {
+	offset, length := r.layout.chunk(idx)
+	if r.layout.groups != nil {
+		return r.sealedParityChunk(idx, offset, length)
+	}
+	cipherBytes := make([]byte, length)
+	n, err := r.backing.ReadAt(cipherBytes, offset)
+	if int64(n) < length && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return nil, ErrTruncated
+	}
+	if err != nil && !(err == io.EOF && int64(n) == length) {
+		return nil, err
+	}
+	return cipherBytes, nil
+}
+
+// sealedParityChunk reads the frame of chunk idx, which is checked
+// against the CRC in its parity block.
+func (r *DecryptReaderAt) sealedParityChunk(idx, offset, length int64) ([]byte, error) {
+	frame, err := readSealed(r.backing, nil, offset-int64(frameHeaderSize), length+int64(frameHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	g := r.layout.groups[idx/int64(r.enc.parityGroup)]
+	i := idx % int64(r.enc.parityGroup)
+	if crc32.Checksum(frame, crcTable) == g.block.sums[i] {
+		return frame[frameHeaderSize:], nil
+	}
+	_, frames, err := r.enc.readParityGroup(io.NewSectionReader(r.backing, g.offset, r.layout.end-g.offset))
+	if err != nil {
+		return nil, err
+	}
+	return frames[i][frameHeaderSize:], nil
+}
+
+// chunkLayout locates the sealed chunks of a stream.
+type chunkLayout struct {
+	start      int64   // offset of the first chunk
+	end        int64   // size of the stream
+	sealedSize int64   // size of all but the final chunk of unframed streams
+	framed     bool    // chunks are preceded by their length
+	offsets    []int64 // start of each sealed chunk of framed streams
+	lengths    []int64 // of each sealed chunk of streams with parity
+	groups     []layoutGroup
+}
+
+// layoutGroup is a parity block of a stream.
+type layoutGroup struct {
+	offset int64 // of the block
+	block  *parityBlock
+}
+
+// newChunkLayout finds the chunks of the stream of size end in r. The
+// frames of framed streams are walked once, reading only their lengths.
+func (e *Encryptor) newChunkLayout(r io.ReaderAt, end int64) (*chunkLayout, error) {
+	l := chunkLayout{start: e.headerSize(), end: end, sealedSize: e.chunkSize + e.Overhead, framed: e.framed()}
+	if !l.framed {
+		if l.count() > 0 {
+			if _, length := l.chunk(l.count() - 1); length < e.Overhead {
+				return nil, ErrTruncated
+			}
+		}
+		return &l, nil
+	}
+	if e.parity != 0 {
+		return e.newParityLayout(r, l)
+	}
+	maxSize := e.maxSealedSize()
+	size := make([]byte, frameHeaderSize)
+	for pos := l.start; pos < end; {
+		if end-pos < int64(frameHeaderSize) {
+			return nil, ErrTruncated
+		}
+		_, err := r.ReadAt(size, pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		frameSize := int64(binary.LittleEndian.Uint32(size))
+		if frameSize > maxSize {
+			return nil, fmt.Errorf("%w: size %d", ErrBadChunk, frameSize)
+		}
+		pos += int64(frameHeaderSize)
+		if pos+frameSize > end {
+			return nil, ErrTruncated
+		}
+		l.offsets = append(l.offsets, pos)
+		pos += frameSize
+	}
+	return &l, nil
+}
+
+// newParityLayout finds the chunks of a stream with parity from the
+// headers of its parity blocks, which are walked once. The frame headers
+// are not trusted, as they may be damaged.
+func (e *Encryptor) newParityLayout(r io.ReaderAt, l chunkLayout) (*chunkLayout, error) {
+	l.groups = []layoutGroup{}
+	for pos := l.start; ; {
+		if l.end-pos < 2*e.parityHeaderSize() {
+			return nil, ErrTruncated
+		}
+		header, err := readSealed(r, nil, pos, 2*e.parityHeaderSize())
+		if err != nil {
+			return nil, err
+		}
+		block, err := e.parseParity(header)
+		if err != nil {
+			return nil, err
+		}
+		l.groups = append(l.groups, layoutGroup{offset: pos, block: block})
+		pos += e.parityBlockSize(block)
+		for _, length := range block.lengths {
+			l.offsets = append(l.offsets, pos+int64(frameHeaderSize))
+			l.lengths = append(l.lengths, length-int64(frameHeaderSize))
+			pos += length
+		}
+		if pos > l.end {
+			return nil, ErrTruncated
+		}
+		if block.final {
+			if pos != l.end {
+				return nil, ErrTrailingData
+			}
+			return &l, nil
+		}
+	}
+}
+
+// count returns the number of chunks.
+func (l *chunkLayout) count() int64 {
+	if l.framed {
+		return int64(len(l.offsets))
+	}
+	if l.end <= l.start {
+		return 0
+	}
+	return (l.end - l.start + l.sealedSize - 1) / l.sealedSize
+}
+
+// chunk returns the offset and length of sealed chunk idx.
+func (l *chunkLayout) chunk(idx int64) (offset, length int64) {
+	if l.lengths != nil {
+		return l.offsets[idx], l.lengths[idx]
+	}
+	if l.framed {
+		next := l.end
+		if idx+1 < int64(len(l.offsets)) {
+			next = l.offsets[idx+1] - int64(frameHeaderSize)
+		}
+		return l.offsets[idx], next - l.offsets[idx]
+	}
+	offset = l.start + idx*l.sealedSize
+	length = l.sealedSize
+	if offset+length > l.end {
+		length = l.end - offset
+	}
+	return offset, length
+}
+
+// readSeekerAt reads at offsets by seeking. It is not safe for concurrent
+// use.
+type readSeekerAt struct {
+	rs io.ReadSeeker
+}
+
+func (r readSeekerAt) ReadAt(b []byte, off int64) (int, error) {
+	_, err := r.rs.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rs, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
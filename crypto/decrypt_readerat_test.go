@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestDecryptReaderAt(t *testing.T) {
+	plain := testPlaintext(5*int(ChunkSize) + 1234)
+	ciphertext := &bytes.Buffer{}
+	enc := testEncryptor()
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	backing := bytes.NewReader(ciphertext.Bytes())
+
+	r, err := NewDecryptReaderAt(enc.GetKey(), backing, backing.Size(), 2)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	if r.Size() != int64(len(plain)) {
+		t.Errorf("unexpected size %d", r.Size())
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			b := make([]byte, 5000)
+			for i := 0; i < 200; i++ {
+				off := rnd.Int63n(int64(len(plain)))
+				n, err := r.ReadAt(b, off)
+				if err != nil && err != io.EOF {
+					t.Errorf("unexpected error %v", err)
+					return
+				}
+				if err == io.EOF && off+int64(len(b)) <= int64(len(plain)) {
+					t.Errorf("unexpected EOF at %d", off)
+					return
+				}
+				if !bytes.Equal(b[:n], plain[off:off+int64(n)]) {
+					t.Errorf("bytes differ at offset %d", off)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	hits, misses := r.CacheStats()
+	if hits == 0 || misses == 0 {
+		t.Errorf("unexpected cache stats %d %d", hits, misses)
+	}
+	if r.lru.Len() > 2 || len(r.chunks) > 2 {
+		t.Errorf("cache grew beyond its size: %d", r.lru.Len())
+	}
+
+	// a read spanning chunks and the end
+	b := make([]byte, 3*int(ChunkSize))
+	n, err := r.ReadAt(b, 3*ChunkSize-10)
+	if err != io.EOF || n != len(plain)-int(3*ChunkSize-10) {
+		t.Errorf("unexpected read at end %d %v", n, err)
+	}
+	if !bytes.Equal(b[:n], plain[3*ChunkSize-10:]) {
+		t.Errorf("bytes differ at end")
+	}
+
+	truncated := ciphertext.Bytes()[:enc.headerSize()+2*(ChunkSize+16)]
+	_, err = NewDecryptReaderAt(enc.GetKey(), bytes.NewReader(truncated), int64(len(truncated)), 0)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+
+	// an object shorter than the size it is opened with, cut at a chunk
+	// boundary or within a chunk
+	full := int64(ciphertext.Len())
+	for _, end := range []int64{enc.headerSize() + 2*(ChunkSize+16), full - 1} {
+		short := bytes.NewReader(ciphertext.Bytes()[:end])
+		_, err = NewDecryptReaderAt(enc.GetKey(), short, full, 0)
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d: expected ErrTruncated, got %v", end, err)
+		}
+	}
+}
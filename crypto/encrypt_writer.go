@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EncryptWriter encrypts everything written to it into the current stream
+// format. Plaintext is buffered up to the chunk size, and a full chunk is
+// sealed and written once more plaintext arrives, since only then is it
+// known not to be the final chunk. Close seals the final chunk. The
+// header is written with the first chunk, once the compression of the
+// stream can be chosen. Close also writes the padding of padded streams.
+// With parity, chunks are held back until their group is complete.
+// The output is identical to Encrypt with the same key and iv.
+type EncryptWriter struct {
+	enc      *Encryptor // the settings of the stream, a copy of the caller's
+	out      io.Writer
+	buf      []byte
+	packed   []byte
+	sealed   []byte
+	parity   *parityWriter
+	chunkIdx int64
+	inSize   int64
+	outSize  int64
+	started  bool
+	closed   bool
+	err      error
+	inHash   *HashSet
+	outHash  *HashSet
+}
+
+// NewEncryptWriter returns a writer encrypting to out with the key, iv
+// and settings of e. e itself is not changed, so it can go on being used
+// for other streams; the format of this one is reported by Format.
+func NewEncryptWriter(e *Encryptor, out io.Writer) *EncryptWriter {
+	stream := *e
+	stream.version = currentVersion
+	stream.compression = CompressionNone
+	stream.ChunkIdx = 0
+	w := &EncryptWriter{
+		enc: &stream,
+		out: out,
+		buf: make([]byte, 0, e.chunkSize),
+	}
+	// an error is returned by the first Write or Close
+	w.inHash, w.err = NewHashSet(e.hashes)
+	if w.err == nil {
+		w.outHash, w.err = NewHashSet(e.hashes)
+	}
+	return w
+}
+
+func (w *EncryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			w.err = w.flush(false)
+			if w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		w.inHash.Write(p[:n])
+		w.inSize += int64(n)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals and writes the final chunk, and the padding of padded
+// streams. It does not close the underlying writer.
+func (w *EncryptWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	padded := w.enc.padding != PaddingNone
+	if w.err == nil {
+		w.err = w.flush(!padded)
+	}
+	if w.err == nil && padded {
+		w.chunkIdx, w.err = w.enc.sealPadding(w.outSize, w.chunkIdx, w.inSize, w.write)
+	}
+	if w.err == nil && w.parity != nil {
+		w.err = w.parity.close()
+	}
+	w.closed = true
+	return w.err
+}
+
+// Format returns the format of the stream, as Encryptor.Format does. The
+// compression is only known once the first chunk is written.
+func (w *EncryptWriter) Format() int {
+	return w.enc.Format()
+}
+
+// Hash returns the hashes of the plaintext and ciphertext written so far.
+// They are complete once the writer is closed.
+func (w *EncryptWriter) Hash() Hash {
+	if w.inHash == nil || w.outHash == nil {
+		return Hash{}
+	}
+	return Hash{In: w.inHash.Digests(), Out: w.outHash.Digests()}
+}
+
+// flush seals the buffered plaintext as the next chunk, after writing the
+// header if this is the first chunk.
+func (w *EncryptWriter) flush(last bool) error {
+	if !w.started {
+		if len(w.enc.iv) != ivSize {
+			return fmt.Errorf("%w: no iv to encrypt with", ErrBadKey)
+		}
+		w.enc.chooseCompression(w.buf)
+		err := w.write(w.enc.header())
+		if err != nil {
+			return err
+		}
+		if w.enc.parity != 0 {
+			w.parity = newParityWriter(w.enc, w.writeOut)
+		}
+		w.started = true
+	}
+	var err error
+	w.sealed, w.packed, err = w.enc.encodeChunk(w.sealed[:0], w.packed, w.buf, w.chunkIdx, last)
+	if err != nil {
+		return err
+	}
+	err = w.write(w.sealed)
+	if err != nil {
+		return err
+	}
+	w.chunkIdx += 1
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// write writes the next piece of the stream, through the parity groups
+// once they have started. outSize counts the stream without parity, which
+// padding is computed from.
+func (w *EncryptWriter) write(b []byte) error {
+	w.outSize += int64(len(b))
+	if w.parity != nil {
+		return w.parity.add(b)
+	}
+	return w.writeOut(b)
+}
+
+func (w *EncryptWriter) writeOut(b []byte) error {
+	n, err := w.out.Write(b)
+	if debug {
+		fmt.Printf("wrote %d bytes\n", n)
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return errors.New(fmt.Sprintf("Expected to write %d, but actually wrote %d", len(b), n))
+	}
+	w.outHash.Write(b)
+	return nil
+}
@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptWriter(t *testing.T) {
+	sizes := []int{0, 1, int(ChunkSize), 2*int(ChunkSize) + 5}
+	for _, size := range sizes {
+		plain := testPlaintext(size)
+		expected := &bytes.Buffer{}
+		expectedHash, err := testEncryptor().Encrypt(expected, bytes.NewReader(plain), true)
+		if err != nil {
+			t.Fatalf("%d: could not encrypt: %v", size, err)
+		}
+
+		out := &bytes.Buffer{}
+		w := NewEncryptWriter(testEncryptor(), out)
+		// odd sized writes cross chunk boundaries
+		for p := plain; len(p) > 0; {
+			n := 1000 + len(p)%7
+			if n > len(p) {
+				n = len(p)
+			}
+			_, err = w.Write(p[:n])
+			if err != nil {
+				t.Fatalf("%d: could not write: %v", size, err)
+			}
+			p = p[n:]
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("%d: could not close: %v", size, err)
+		}
+		if !bytes.Equal(expected.Bytes(), out.Bytes()) {
+			t.Errorf("%d: output differs from Encrypt", size)
+		}
+		if !EqualHash(expectedHash, w.Hash()) {
+			t.Errorf("%d: hash differs from Encrypt", size)
+		}
+		_, err = w.Write([]byte{1})
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("%d: expected ErrClosed, got %v", size, err)
+		}
+	}
+}
+
+func TestEncryptWriterGzip(t *testing.T) {
+	plain := bytes.Repeat([]byte("some log line\n"), 100000)
+	out := &bytes.Buffer{}
+	w := NewEncryptWriter(testEncryptor(), out)
+	zw := gzip.NewWriter(w)
+	_, err := zw.Write(plain)
+	if err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	zw.Close()
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+
+	compressed := &bytes.Buffer{}
+	_, err = testEncryptor().Encrypt(compressed, out, false)
+	if err != nil {
+		t.Fatalf("could not decrypt: %v", err)
+	}
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatalf("could not gunzip: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("could not gunzip: %v", err)
+	}
+	if !bytes.Equal(plain, decrypted) {
+		t.Errorf("decrypted text differs")
+	}
+}
+
+func TestEncryptWriterFormat(t *testing.T) {
+	e := testEncryptor()
+	e.SetCompression(CompressionZstd)
+	before := e.Format()
+
+	// compressible text is compressed, random text is not, and e is left
+	// as it was by both
+	tests := []struct {
+		plain       []byte
+		compression Compression
+	}{
+		{bytes.Repeat([]byte("a"), 10000), CompressionZstd},
+		{testPlaintext(10000), CompressionNone},
+	}
+	for _, test := range tests {
+		w := NewEncryptWriter(e, &bytes.Buffer{})
+		_, err := w.Write(test.plain)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("could not encrypt: %v", err)
+		}
+		if e.Format() != before {
+			t.Errorf("encryptor format changed from %x to %x", before, e.Format())
+		}
+		if FormatVersion(w.Format()) != currentVersion {
+			t.Errorf("unexpected version in format %x", w.Format())
+		}
+		if FormatCompression(w.Format()) != test.compression {
+			t.Errorf("unexpected compression in format %x", w.Format())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the crypto package, usually wrapped with details.
+// Test for them with errors.Is.
+var (
+	// ErrBadKey is returned for keys and ivs that are not valid base64 or
+	// have the wrong length.
+	ErrBadKey = errors.New("invalid key")
+	// ErrBadHeader is returned when a stream does not start with a valid
+	// header.
+	ErrBadHeader = errors.New("invalid header")
+	// ErrUnsupportedVersion is returned for streams of a format version
+	// that cannot be decrypted.
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	// ErrAuthFailed is returned when a chunk does not authenticate with
+	// the key: it was modified, or the key is wrong.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrBadChunk is returned for a chunk that authenticates but cannot
+	// be decoded, or has the wrong size.
+	ErrBadChunk = errors.New("invalid chunk")
+	// ErrTruncated is returned when a stream ends before its final chunk.
+	ErrTruncated = errors.New("truncated ciphertext")
+	// ErrTrailingData is returned when a stream continues after its final
+	// chunk.
+	ErrTrailingData = errors.New("data after final chunk")
+	// ErrBadOption is returned when setting an encryption option, such as
+	// the chunk size or the padding, to a value out of range.
+	ErrBadOption = errors.New("invalid option")
+	// ErrBadKDFParams is returned for Argon2id parameters that would make
+	// deriving a key panic or use too much memory.
+	ErrBadKDFParams = errors.New("invalid key derivation parameters")
+	// ErrPaddingSize is returned when a padded stream does not hold as much
+	// plaintext as its final chunk says.
+	ErrPaddingSize = errors.New("plaintext size does not match padding")
+	// ErrClosed is returned when writing to a closed EncryptWriter.
+	ErrClosed = errors.New("write to closed writer")
+	// ErrWrongPassphrase is returned when a master key does not match the
+	// key id it is checked against.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrWrongMasterKey is returned when a wrapped key was wrapped by a
+	// different master key.
+	ErrWrongMasterKey = errors.New("key is wrapped by a different master key")
+	// ErrNoIdentity is returned when a sealed key was not sealed to the
+	// identity trying to open it.
+	ErrNoIdentity = errors.New("key is not sealed to this identity")
+	// ErrShareChecksum is returned for a share that was mistyped or
+	// damaged.
+	ErrShareChecksum = errors.New("share checksum mismatch")
+	// ErrShareMismatch is returned when combining shares of different
+	// splits.
+	ErrShareMismatch = errors.New("shares are from different splits")
+	// ErrNotEnoughShares is returned when combining fewer shares than the
+	// threshold.
+	ErrNotEnoughShares = errors.New("not enough shares")
+	// ErrPaperKeyChecksum is returned for a paper key that was mistyped or
+	// damaged.
+	ErrPaperKeyChecksum = errors.New("paper key checksum mismatch")
+)
+
+// ChunkError is an error decrypting one chunk of a stream.
+type ChunkError struct {
+	Index int64 // of the chunk in the stream
+	Err   error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d: %v", e.Index, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// randomBytes returns n bytes from the system's random number generator.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not read random bytes: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	plain := testPlaintext(3*int(ChunkSize) + 100)
+	ciphertext := &bytes.Buffer{}
+	enc := testEncryptor()
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	full := ciphertext.Bytes()
+	headerSize := int(enc.headerSize())
+
+	decrypt := func(b []byte) error {
+		_, err := testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(b), false)
+		return err
+	}
+
+	// a flipped bit in the second chunk
+	tampered := append([]byte{}, full...)
+	tampered[headerSize+int(ChunkSize)+100] ^= 1
+	err = decrypt(tampered)
+	var chunkErr *ChunkError
+	if !errors.Is(err, ErrAuthFailed) || !errors.As(err, &chunkErr) || chunkErr.Index != 1 {
+		t.Errorf("expected ErrAuthFailed in chunk 1, got %v", err)
+	}
+
+	badHeader := append([]byte{}, full...)
+	badHeader[0] = 'x'
+	if err = decrypt(badHeader); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected ErrBadHeader, got %v", err)
+	}
+
+	future := append([]byte{}, full...)
+	future[1] = 9
+	if err = decrypt(future); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+
+	// an empty stream, a partial header, and a stream cut after chunk 1
+	for _, end := range []int{0, headerSize / 2, headerSize + 2*(int(ChunkSize)+16)} {
+		if err = decrypt(full[:end]); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d: expected ErrTruncated, got %v", end, err)
+		}
+	}
+
+	// the wrong key fails to authenticate the first chunk
+	wrongKey, err := NewDecryptor(testKey(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wrongKey.Encrypt(ioutil.Discard, bytes.NewReader(full), false)
+	if !errors.Is(err, ErrAuthFailed) || !errors.As(err, &chunkErr) || chunkErr.Index != 0 {
+		t.Errorf("expected ErrAuthFailed in chunk 0, got %v", err)
+	}
+}
+
+func TestBadKey(t *testing.T) {
+	for _, key := range []string{"", "not base64!", "AAAA"} {
+		if _, err := NewDecryptor(key, ""); !errors.Is(err, ErrBadKey) {
+			t.Errorf("%q: expected ErrBadKey, got %v", key, err)
+		}
+	}
+	if _, err := NewDecryptor(testKey(t), "AAAA"); !errors.Is(err, ErrBadKey) {
+		t.Errorf("expected ErrBadKey for a short iv, got %v", err)
+	}
+
+	enc := testEncryptor()
+	if err := enc.SetKey("AAAA"); !errors.Is(err, ErrBadKey) {
+		t.Errorf("expected ErrBadKey, got %v", err)
+	}
+	if enc.GetKey() != testEncryptor().GetKey() {
+		t.Errorf("invalid key was set")
+	}
+
+	// a decryptor without an iv cannot encrypt
+	dec, err := NewDecryptor(testKey(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dec.Encrypt(ioutil.Discard, bytes.NewReader([]byte("plain")), true)
+	if !errors.Is(err, ErrBadKey) {
+		t.Errorf("expected ErrBadKey encrypting without an iv, got %v", err)
+	}
+}
+
+func TestBadOption(t *testing.T) {
+	enc := testEncryptor()
+	errs := []error{
+		enc.SetChunkSize(MinChunkSize - 1),
+		enc.SetChunkSize(MaxChunkSize + 1),
+		enc.SetCompression(Compression(200)),
+		enc.SetPadding(Padding(200)),
+		enc.SetParity(-1),
+		enc.SetParity(MaxParity + 1),
+		enc.SetHashes("md5"),
+	}
+	_, err := ParseCompression("lz4")
+	errs = append(errs, err)
+	_, err = ParsePadding("random")
+	errs = append(errs, err)
+	_, err = NewHashSet([]HashAlgorithm{"md5"})
+	errs = append(errs, err)
+	for i, err := range errs {
+		if !errors.Is(err, ErrBadOption) {
+			t.Errorf("%d: expected ErrBadOption, got %v", i, err)
+		}
+	}
+	if enc.GetChunkSize() != ChunkSize || enc.GetParity() != 0 {
+		t.Errorf("invalid option was set")
+	}
+}
@@ -0,0 +1,167 @@
+package crypto
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+)
+
+// HashAlgorithm names a digest computed over the plaintext and the
+// ciphertext of a stream.
+type HashAlgorithm string
+
+const (
+	HashSHA1    HashAlgorithm = "sha1" // only to compare with old backups
+	HashSHA256  HashAlgorithm = "sha256"
+	HashBLAKE2b HashAlgorithm = "blake2b" // BLAKE2b-256
+	HashBLAKE3  HashAlgorithm = "blake3"  // 256 bit output
+)
+
+// DefaultHashes are the hash algorithms of new encryptors.
+var DefaultHashes = []HashAlgorithm{HashSHA256}
+
+func (a HashAlgorithm) new() (hash.Hash, error) {
+	switch a {
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE2b:
+		return blake2b.New256(nil)
+	case HashBLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("%w: unknown hash algorithm %s", ErrBadOption, a)
+}
+
+// ParseHashAlgorithms parses a comma separated list of hash algorithms.
+func ParseHashAlgorithms(s string) ([]HashAlgorithm, error) {
+	algs := []HashAlgorithm{}
+	for _, name := range strings.Split(s, ",") {
+		a := HashAlgorithm(strings.TrimSpace(name))
+		_, err := a.new()
+		if err != nil {
+			return nil, err
+		}
+		algs = append(algs, a)
+	}
+	return algs, nil
+}
+
+// SetHashes sets the hash algorithms computed by Encrypt,
+// EncryptParallel and EncryptWriter. Without any, no digests are
+// computed.
+func (e *Encryptor) SetHashes(algs ...HashAlgorithm) error {
+	for _, a := range algs {
+		_, err := a.new()
+		if err != nil {
+			return err
+		}
+	}
+	e.hashes = append([]HashAlgorithm{}, algs...)
+	return nil
+}
+
+// GetHashes returns the hash algorithms of e.
+func (e *Encryptor) GetHashes() []HashAlgorithm {
+	return append([]HashAlgorithm{}, e.hashes...)
+}
+
+// Digests are hex encoded digests by algorithm.
+type Digests map[HashAlgorithm]string
+
+// String returns the digests as "<algorithm>:<hex> ...", ordered by
+// algorithm, as they are stored in the metadata.
+func (d Digests) String() string {
+	parts := make([]string, 0, len(d))
+	for a, sum := range d {
+		parts = append(parts, string(a)+":"+sum)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// ParseDigests parses the string form of digests.
+func ParseDigests(s string) (Digests, error) {
+	d := Digests{}
+	for _, part := range strings.Fields(s) {
+		i := strings.IndexByte(part, ':')
+		if i <= 0 {
+			return nil, errors.New("invalid digest " + part)
+		}
+		d[HashAlgorithm(part[:i])] = part[i+1:]
+	}
+	return d, nil
+}
+
+// Equal reports whether d and other have the same digests for the same
+// algorithms.
+func (d Digests) Equal(other Digests) bool {
+	if len(d) != len(other) {
+		return false
+	}
+	for a, sum := range d {
+		if other[a] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// Common returns whether d and other have an algorithm in common, and if
+// so whether all the common digests match. Digests computed with
+// different algorithms can be compared this way.
+func (d Digests) Common(other Digests) (common, match bool) {
+	match = true
+	for a, sum := range d {
+		if o, ok := other[a]; ok {
+			common = true
+			match = match && o == sum
+		}
+	}
+	return common, common && match
+}
+
+// HashSet is a writer computing the digests of everything written to it.
+type HashSet struct {
+	algs   []HashAlgorithm
+	hashes []hash.Hash
+	w      io.Writer
+}
+
+// NewHashSet returns a hash set of algs.
+func NewHashSet(algs []HashAlgorithm) (*HashSet, error) {
+	s := &HashSet{algs: algs}
+	writers := make([]io.Writer, 0, len(algs))
+	for _, a := range algs {
+		h, err := a.new()
+		if err != nil {
+			return nil, err
+		}
+		s.hashes = append(s.hashes, h)
+		writers = append(writers, h)
+	}
+	s.w = io.MultiWriter(writers...)
+	return s, nil
+}
+
+func (s *HashSet) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+// Digests returns the digests of what was written so far.
+func (s *HashSet) Digests() Digests {
+	d := make(Digests, len(s.algs))
+	for i, a := range s.algs {
+		d[a] = fmt.Sprintf("%x", s.hashes[i].Sum(nil))
+	}
+	return d
+}
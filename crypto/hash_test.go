@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	// digests of "abc"
+	expected := Digests{
+		HashSHA1:    "a9993e364706816aba3e25717850c26c9cd0d89d",
+		HashSHA256:  "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		HashBLAKE2b: "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319",
+		HashBLAKE3:  "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+	}
+	s, err := NewHashSet([]HashAlgorithm{HashSHA1, HashSHA256, HashBLAKE2b, HashBLAKE3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("ab"))
+	s.Write([]byte("c"))
+	d := s.Digests()
+	if !d.Equal(expected) {
+		t.Errorf("unexpected digests %s", d)
+	}
+
+	parsed, err := ParseDigests(d.String())
+	if err != nil || !parsed.Equal(d) {
+		t.Errorf("could not parse %q: %v %v", d.String(), parsed, err)
+	}
+	if _, err := ParseDigests("sha256"); err == nil {
+		t.Errorf("expected error parsing digest without algorithm")
+	}
+
+	common, match := Digests{HashSHA256: d[HashSHA256], HashBLAKE3: "00"}.Common(Digests{HashSHA256: d[HashSHA256]})
+	if !common || !match {
+		t.Errorf("expected common matching digest")
+	}
+	common, _ = Digests{HashBLAKE3: d[HashBLAKE3]}.Common(Digests{HashSHA256: d[HashSHA256]})
+	if common {
+		t.Errorf("expected no common digest")
+	}
+}
+
+func TestSetHashes(t *testing.T) {
+	e := testEncryptor()
+	if err := e.SetHashes("md5"); err == nil {
+		t.Errorf("expected error for unknown algorithm")
+	}
+	algs, err := ParseHashAlgorithms("sha256, blake3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetHashes(algs...); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := e.Encrypt(&bytes.Buffer{}, bytes.NewReader([]byte("abc")), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash.In) != 2 || hash.In[HashBLAKE3] == "" || hash.Out[HashSHA256] == "" {
+		t.Errorf("unexpected hash %+v", hash)
+	}
+
+	e = testEncryptor()
+	e.SetHashes()
+	hash, err = e.Encrypt(&bytes.Buffer{}, bytes.NewReader([]byte("abc")), true)
+	if err != nil || len(hash.In) != 0 || len(hash.Out) != 0 {
+		t.Errorf("expected no digests, got %+v %v", hash, err)
+	}
+}
@@ -0,0 +1,189 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Chunk sizes a stream may declare. The upper bound keeps a corrupt or
+// hostile header from making readers allocate huge buffers.
+const (
+	MinChunkSize = 1024             // 1KiB
+	MaxChunkSize = 64 * 1024 * 1024 // 64MiB
+)
+
+// The stream header is
+//
+//	'b', version     2 bytes
+//	iv              24 bytes
+//
+// and from version 3 on, followed by
+//
+//	chunk size       4 bytes, little endian
+//	options length   1 byte
+//	options          a list of option id, value length, value
+//
+// Options are only written if they differ from the default. Readers
+// reject options they don't know. The whole header is authenticated with
+// every chunk from version 2 on.
+
+// header option ids
+const (
+	optionCompression = 1 // 1 byte Compression, chunks are framed
+	optionPadding     = 2 // 1 byte Padding, chunks are framed
+	optionParity      = 3 // 1 byte group size, 1 byte parity shards, chunks are framed
+)
+
+// header returns the stream header.
+func (e *Encryptor) header() []byte {
+	header := make([]byte, 0, headerOffset+5)
+	header = append(header, 'b', e.version)
+	header = append(header, e.iv...)
+	if e.version < 3 {
+		return header
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(e.chunkSize))
+	header = append(header, size...)
+	options := e.options()
+	header = append(header, byte(len(options)))
+	return append(header, options...)
+}
+
+// options returns the header options of the stream.
+func (e *Encryptor) options() []byte {
+	options := []byte{}
+	if e.compression != CompressionNone {
+		options = append(options, optionCompression, 1, byte(e.compression))
+	}
+	if e.padding != PaddingNone {
+		options = append(options, optionPadding, 1, byte(e.padding))
+	}
+	if e.parity != 0 {
+		options = append(options, optionParity, 2, byte(e.parityGroup), byte(e.parity))
+	}
+	return options
+}
+
+// setOptions sets the stream options from a header.
+func (e *Encryptor) setOptions(options []byte) error {
+	e.compression = CompressionNone
+	e.padding = PaddingNone
+	e.parity, e.parityGroup = 0, 0
+	for len(options) > 0 {
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return fmt.Errorf("%w: options", ErrBadHeader)
+		}
+		id, value := options[0], options[2:2+int(options[1])]
+		options = options[2+len(value):]
+		switch {
+		case id == optionCompression && len(value) == 1 && Compression(value[0]).valid():
+			e.compression = Compression(value[0])
+		case id == optionPadding && len(value) == 1 && Padding(value[0]).valid():
+			e.padding = Padding(value[0])
+		case id == optionParity && len(value) == 2 && value[0] >= 1 && value[0] <= maxParityGroup &&
+			value[1] >= 1 && value[1] <= MaxParity:
+			e.parityGroup, e.parity = int(value[0]), int(value[1])
+		default:
+			return fmt.Errorf("%w: option %d", ErrUnsupportedVersion, id)
+		}
+	}
+	return nil
+}
+
+// headerSize returns the length of the stream header.
+func (e *Encryptor) headerSize() int64 {
+	if e.version < 3 {
+		return int64(headerOffset)
+	}
+	return int64(headerOffset) + 5 + int64(len(e.options()))
+}
+
+// readHeader reads the stream header from in and sets it.
+func (e *Encryptor) readHeader(in io.Reader) ([]byte, error) {
+	header := make([]byte, headerOffset)
+	n, err := io.ReadFull(in, header)
+	if err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, fmt.Errorf("%w: empty stream", ErrTruncated)
+		}
+		return nil, ErrTruncated
+	}
+	if header[0] == 'b' && header[1] >= 3 {
+		rest := make([]byte, 5)
+		_, err = io.ReadFull(in, rest)
+		if err != nil {
+			return nil, ErrTruncated
+		}
+		header = append(header, rest...)
+		options := make([]byte, rest[4])
+		_, err = io.ReadFull(in, options)
+		if err != nil {
+			return nil, ErrTruncated
+		}
+		header = append(header, options...)
+	}
+	return header, e.setHeader(header)
+}
+
+// setHeader checks a stream header and takes the version, iv, chunk size
+// and options from it.
+func (e *Encryptor) setHeader(header []byte) error {
+	if len(header) < headerOffset || header[0] != 'b' {
+		return ErrBadHeader
+	}
+	version := header[1]
+	if !supportedVersion(version) {
+		return fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+	}
+	chunkSize := ChunkSize
+	e.compression = CompressionNone
+	e.padding = PaddingNone
+	e.parity, e.parityGroup = 0, 0
+	if version >= 3 {
+		if len(header) < headerOffset+5 || len(header) != headerOffset+5+int(header[headerOffset+4]) {
+			return ErrBadHeader
+		}
+		chunkSize = int64(binary.LittleEndian.Uint32(header[headerOffset:]))
+		if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+			return fmt.Errorf("%w: chunk size %d", ErrBadHeader, chunkSize)
+		}
+		err := e.setOptions(header[headerOffset+5:])
+		if err != nil {
+			return err
+		}
+	} else if len(header) != headerOffset {
+		return ErrBadHeader
+	}
+	e.version = version
+	e.iv = append([]byte{}, header[2:headerOffset]...)
+	e.chunkSize = chunkSize
+	return nil
+}
+
+func supportedVersion(v byte) bool {
+	for _, s := range versions {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetChunkSize sets the chunk size of the streams e encrypts. Small chunks
+// waste less space on tiny files, large chunks spend less on per-chunk
+// overhead. Streams are always decrypted with the chunk size in their
+// header.
+func (e *Encryptor) SetChunkSize(size int64) error {
+	if size < MinChunkSize || size > MaxChunkSize {
+		return fmt.Errorf("%w: chunk size %d out of range", ErrBadOption, size)
+	}
+	e.chunkSize = size
+	return nil
+}
+
+// GetChunkSize returns the chunk size of the stream.
+func (e *Encryptor) GetChunkSize() int64 {
+	return e.chunkSize
+}
@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const wrapPrefix = "w1."
+
+// KDFParams are the Argon2id parameters used to derive a master key from
+// a passphrase.
+type KDFParams struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// MaxKDFMemory is the most memory, in KiB, KDFParams may use: 4 GiB.
+const MaxKDFMemory = 4 * 1024 * 1024
+
+// Check returns ErrBadKDFParams unless p has a time and threads of at
+// least 1, and a memory of at least 8 KiB per thread, as Argon2 needs, and
+// at most MaxKDFMemory. Parameters read from a header or the config should
+// be checked before deriving a key with them.
+func (p KDFParams) Check() error {
+	switch {
+	case p.Time < 1:
+		return fmt.Errorf("%w: time %d", ErrBadKDFParams, p.Time)
+	case p.Threads < 1:
+		return fmt.Errorf("%w: threads %d", ErrBadKDFParams, p.Threads)
+	case p.Memory < 8*uint32(p.Threads) || p.Memory > MaxKDFMemory:
+		return fmt.Errorf("%w: memory %d KiB", ErrBadKDFParams, p.Memory)
+	}
+	return nil
+}
+
+// NewKDFParams returns the recommended Argon2id parameters with a new
+// random 128 bit salt.
+func NewKDFParams() (KDFParams, error) {
+	salt, err := randomBytes(128 / 8)
+	if err != nil {
+		return KDFParams{}, err
+	}
+	return KDFParams{Salt: salt, Time: 3, Memory: 64 * 1024, Threads: 4}, nil
+}
+
+// MasterKey wraps and unwraps the per-file keys stored in the metadata.
+type MasterKey struct {
+	aead     cipher.AEAD
+	key      []byte // 32 bytes or 256 bits
+	ID       string // identifies the key without revealing it
+	identity *Identity
+}
+
+// DeriveMasterKey derives the master key from passphrase using Argon2id.
+// ErrBadKDFParams is returned for parameters p.Check rejects.
+func DeriveMasterKey(passphrase string, p KDFParams) (*MasterKey, error) {
+	err := p.Check()
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, 256/8)
+	return newMasterKey(key)
+}
+
+func newMasterKey(key []byte) (*MasterKey, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: master key: %v", ErrBadKey, err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bbackup master key id"))
+	id := hex.EncodeToString(mac.Sum(nil)[:8])
+
+	identity := &Identity{}
+	mac = hmac.New(sha256.New, key)
+	mac.Write([]byte("bbackup master key identity"))
+	copy(identity.private[:], mac.Sum(nil))
+	curve25519.ScalarBaseMult(&identity.public, &identity.private)
+	return &MasterKey{aead: aead, key: key, ID: id, identity: identity}, nil
+}
+
+// Identity returns the identity derived from the master key. Keys sealed
+// to its Recipient, which may be stored without the master key, are
+// recovered by whatever recovers the master key: the passphrase, shares
+// or a paper key.
+func (m *MasterKey) Identity() *Identity {
+	return m.identity
+}
+
+// Check returns ErrWrongPassphrase unless the key has the given id.
+func (m *MasterKey) Check(id string) error {
+	if !hmac.Equal([]byte(m.ID), []byte(id)) {
+		return ErrWrongPassphrase
+	}
+	return nil
+}
+
+// IsWrapped reports whether key was produced by WrapKey.
+func IsWrapped(key string) bool {
+	return strings.HasPrefix(key, wrapPrefix)
+}
+
+// WrappedKeyID returns the id of the master key that wrapped key.
+func WrappedKeyID(key string) string {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || !IsWrapped(key) {
+		return ""
+	}
+	return parts[1]
+}
+
+// WrapKey encrypts a per-file key. The result has the form
+// "w1.<master key id>.<base64 of nonce and sealed key>".
+func (m *MasterKey) WrapKey(key string) (string, error) {
+	nonce, err := randomBytes(m.aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := m.aead.Seal(nonce, nonce, []byte(key), []byte(wrapPrefix+m.ID))
+	return wrapPrefix + m.ID + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// UnwrapKey decrypts a key produced by WrapKey.
+func (m *MasterKey) UnwrapKey(wrapped string) (string, error) {
+	id := WrappedKeyID(wrapped)
+	if id == "" {
+		return "", errors.New("not a wrapped key")
+	}
+	if id != m.ID {
+		return "", ErrWrongMasterKey
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(wrapped[len(wrapPrefix)+len(id)+1:])
+	if err != nil {
+		return "", err
+	}
+	nonceSize := m.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("wrapped key too short")
+	}
+	key, err := m.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(wrapPrefix+id))
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	return string(key), nil
+}
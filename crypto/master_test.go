@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func testKDFParams() KDFParams {
+	return KDFParams{Salt: []byte("0123456789abcdef"), Time: 1, Memory: 1024, Threads: 1}
+}
+
+// testMasterKey derives a master key from passphrase with testKDFParams
+func testMasterKey(t *testing.T, passphrase string) *MasterKey {
+	master, err := DeriveMasterKey(passphrase, testKDFParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+func TestWrapKey(t *testing.T) {
+	master := testMasterKey(t, "correct horse")
+	key := testKey(t)
+
+	wrapped, err := master.WrapKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsWrapped(wrapped) {
+		t.Errorf("expected wrapped key, got %s", wrapped)
+	}
+	if WrappedKeyID(wrapped) != master.ID {
+		t.Errorf("unexpected key id %s", WrappedKeyID(wrapped))
+	}
+	unwrapped, err := master.UnwrapKey(wrapped)
+	if err != nil {
+		t.Fatalf("could not unwrap: %v", err)
+	}
+	if unwrapped != key {
+		t.Errorf("unwrapped key differs")
+	}
+
+	same := testMasterKey(t, "correct horse")
+	if same.Check(master.ID) != nil {
+		t.Errorf("same passphrase should give the same key")
+	}
+	other := testMasterKey(t, "battery staple")
+	if other.Check(master.ID) != ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase")
+	}
+	_, err = other.UnwrapKey(wrapped)
+	if !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("expected ErrWrongMasterKey, got %v", err)
+	}
+
+	tampered := wrapped[:len(wrapped)-2] + "AA"
+	_, err = master.UnwrapKey(tampered)
+	if err == nil {
+		t.Errorf("expected error unwrapping tampered key")
+	}
+}
+
+func TestMasterKeyIdentity(t *testing.T) {
+	master := testMasterKey(t, "correct horse")
+	key := testKey(t)
+	sealed, err := SealKey(key, []*Recipient{master.Identity().Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key derived again, as from the passphrase, shares or a paper
+	// key, has the same identity
+	same := testMasterKey(t, "correct horse")
+	if unsealed, err := same.Identity().UnsealKey(sealed); err != nil || unsealed != key {
+		t.Errorf("could not unseal with the same master key: %v", err)
+	}
+	other := testMasterKey(t, "battery staple")
+	if _, err = other.Identity().UnsealKey(sealed); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("expected ErrNoIdentity, got %v", err)
+	}
+}
+
+func TestKDFParamsCheck(t *testing.T) {
+	p, err := NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Check(); err != nil {
+		t.Errorf("recommended parameters rejected: %v", err)
+	}
+	bad := []KDFParams{
+		{Time: 0, Memory: 1024, Threads: 1},
+		{Time: 1, Memory: 1024, Threads: 0},
+		{Time: 1, Memory: 7, Threads: 1},
+		{Time: 1, Memory: 1024, Threads: 255},
+		{Time: 1, Memory: MaxKDFMemory + 1, Threads: 1},
+	}
+	for _, p := range bad {
+		if err = p.Check(); !errors.Is(err, ErrBadKDFParams) {
+			t.Errorf("%+v: expected ErrBadKDFParams, got %v", p, err)
+		}
+		if _, err = DeriveMasterKey("x", p); !errors.Is(err, ErrBadKDFParams) {
+			t.Errorf("%+v: expected ErrBadKDFParams deriving, got %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Padding is the scheme the size of encrypted objects is rounded up with,
+// so the size of the ciphertext doesn't tell the exact plaintext size.
+type Padding byte
+
+const (
+	PaddingNone  Padding = 0
+	PaddingPadme Padding = 1 // Padmé, at most 12% overhead
+	PaddingPow2  Padding = 2 // powers of two, at most 100% overhead
+)
+
+// Flags of the last byte of the additional data of a chunk.
+const (
+	chunkLast    = 1
+	chunkPadding = 2
+)
+
+// The final chunk of a padded stream ends with the size of the plaintext.
+const paddingTrailerSize = 8
+
+func (p Padding) String() string {
+	switch p {
+	case PaddingNone:
+		return "none"
+	case PaddingPadme:
+		return "padme"
+	case PaddingPow2:
+		return "pow2"
+	}
+	return fmt.Sprintf("padding(%d)", byte(p))
+}
+
+// ParsePadding returns the padding scheme with the given name.
+func ParsePadding(name string) (Padding, error) {
+	for _, p := range []Padding{PaddingNone, PaddingPadme, PaddingPow2} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return PaddingNone, fmt.Errorf("%w: unknown padding %s", ErrBadOption, name)
+}
+
+func (p Padding) valid() bool {
+	return p <= PaddingPow2
+}
+
+// pad returns the size an object of size bytes is padded to.
+func (p Padding) pad(size int64) int64 {
+	if size < 2 {
+		return size
+	}
+	switch p {
+	case PaddingPadme:
+		// keep the top log2(log2(size))+1 bits of the size, rounding up
+		e := bits.Len64(uint64(size)) - 1
+		s := bits.Len64(uint64(e))
+		mask := int64(1)<<uint(e-s) - 1
+		return (size + mask) &^ mask
+	case PaddingPow2:
+		return int64(1) << uint(bits.Len64(uint64(size-1)))
+	}
+	return size
+}
+
+// SetPadding sets the padding scheme of the streams e encrypts. Padded
+// streams are followed by padding chunks up to the padded size, and the
+// final chunk records the plaintext size.
+func (e *Encryptor) SetPadding(p Padding) error {
+	if !p.valid() {
+		return fmt.Errorf("%w: unknown padding %d", ErrBadOption, p)
+	}
+	e.padding = p
+	return nil
+}
+
+// GetPadding returns the padding scheme of the stream.
+func (e *Encryptor) GetPadding() Padding {
+	return e.padding
+}
+
+// paddingFrameOverhead returns the bytes a padding chunk takes beyond its
+// zeros or trailer.
+func (e *Encryptor) paddingFrameOverhead() int64 {
+	overhead := int64(frameHeaderSize) + e.Overhead
+	if e.compression != CompressionNone {
+		overhead += 1 // chunkRaw
+	}
+	return overhead
+}
+
+// sealPadding seals padding chunks after written bytes of stream, the
+// next chunk being idx and the plaintext size bytes, and passes each
+// framed chunk to write. The chunks fill the stream up to its padded
+// size. It returns the index after the final chunk.
+func (e *Encryptor) sealPadding(written, idx, size int64, write func([]byte) error) (int64, error) {
+	overhead := e.paddingFrameOverhead()
+	minFinal := overhead + paddingTrailerSize
+	maxFrame := overhead + e.chunkSize
+	remaining := e.padding.pad(written+minFinal) - written
+
+	plain := make([]byte, 0, e.chunkSize+1)
+	frame := make([]byte, 0, maxFrame)
+	for {
+		last := remaining <= maxFrame
+		frameSize := remaining
+		if !last && remaining-minFinal < maxFrame {
+			frameSize = remaining - minFinal
+		} else if !last {
+			frameSize = maxFrame
+		}
+
+		plain = plain[:0]
+		if e.compression != CompressionNone {
+			plain = append(plain, chunkRaw)
+		}
+		plain = append(plain, make([]byte, frameSize-overhead)...)
+		if last {
+			binary.LittleEndian.PutUint64(plain[len(plain)-paddingTrailerSize:], uint64(size))
+		}
+		frame = append(frame[:0], make([]byte, frameHeaderSize)...)
+		frame = e.aead.Seal(frame, e.chunkNonce(idx), plain, e.additionalData(last, true))
+		binary.LittleEndian.PutUint32(frame, uint32(len(frame)-frameHeaderSize))
+		err := write(frame)
+		if err != nil {
+			return idx, err
+		}
+		idx += 1
+		remaining -= frameSize
+		if last {
+			return idx, nil
+		}
+	}
+}
+
+// openPadded opens a chunk of a padded stream, which is either plaintext
+// or padding. Padding chunks yield no plaintext; the final one yields the
+// plaintext size of the stream, which is -1 for other chunks.
+func (e *Encryptor) openPadded(dst, cipherBytes []byte, idx int64, last bool) ([]byte, int64, error) {
+	if len(cipherBytes) == 0 && last {
+		return nil, -1, ErrTruncated
+	}
+	nonce := e.chunkNonce(idx)
+	// plaintext chunks are never final in padded streams
+	packed, err := e.aead.Open(nil, nonce, cipherBytes, e.additionalData(false, false))
+	if err == nil {
+		if last {
+			return nil, -1, ErrTruncated
+		}
+		plain, err := e.unpackChunk(dst, packed)
+		return plain, -1, err
+	}
+	packed, err = e.openChunkFlags(nil, cipherBytes, idx, last, true)
+	if err != nil {
+		return nil, -1, err
+	}
+	if !last {
+		return dst, -1, nil
+	}
+	if len(packed) < paddingTrailerSize {
+		return nil, -1, fmt.Errorf("%w: padding", ErrBadChunk)
+	}
+	size := binary.LittleEndian.Uint64(packed[len(packed)-paddingTrailerSize:])
+	if size > 1<<62 {
+		return nil, -1, fmt.Errorf("%w: padding", ErrBadChunk)
+	}
+	return dst, int64(size), nil
+}
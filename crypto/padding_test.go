@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		p      Padding
+		size   int64
+		padded int64
+	}{
+		{PaddingNone, 1000, 1000},
+		{PaddingPow2, 1, 1},
+		{PaddingPow2, 1000, 1024},
+		{PaddingPow2, 1024, 1024},
+		{PaddingPadme, 1000, 1024},
+		{PaddingPadme, 1024, 1024},
+		{PaddingPadme, 1025, 1088},
+		{PaddingPadme, 1000000, 1015808},
+	}
+	for _, test := range tests {
+		padded := test.p.pad(test.size)
+		if padded != test.padded {
+			t.Errorf("%v %d: got %d, expected %d", test.p, test.size, padded, test.padded)
+		}
+	}
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, int(ChunkSize) - 3, int(ChunkSize), 3*int(ChunkSize) + 100}
+	for _, p := range []Padding{PaddingPadme, PaddingPow2} {
+		for _, c := range []Compression{CompressionNone, CompressionZstd} {
+			for _, size := range sizes {
+				plain := testPlaintext(size)
+				enc := testEncryptor()
+				enc.SetPadding(p)
+				enc.SetCompression(c)
+				ciphertext := &bytes.Buffer{}
+				_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+				if err != nil {
+					t.Fatalf("%v %v %d: could not encrypt: %v", p, c, size, err)
+				}
+				if FormatPadding(enc.Format()) != p {
+					t.Errorf("%v %v %d: unexpected format %x", p, c, size, enc.Format())
+				}
+				if int64(ciphertext.Len()) != p.pad(int64(ciphertext.Len())) {
+					t.Errorf("%v %v %d: ciphertext size %d not padded", p, c, size, ciphertext.Len())
+				}
+
+				parallel := &bytes.Buffer{}
+				enc = testEncryptor()
+				enc.SetPadding(p)
+				enc.SetCompression(c)
+				_, err = enc.EncryptParallel(parallel, bytes.NewReader(plain), true, 3)
+				if err != nil {
+					t.Fatalf("%v %v %d: could not encrypt in parallel: %v", p, c, size, err)
+				}
+				if !bytes.Equal(ciphertext.Bytes(), parallel.Bytes()) {
+					t.Errorf("%v %v %d: parallel ciphertext differs", p, c, size)
+				}
+
+				decrypted := &bytes.Buffer{}
+				_, err = testEncryptor().Encrypt(decrypted, bytes.NewReader(ciphertext.Bytes()), false)
+				if err != nil {
+					t.Fatalf("%v %v %d: could not decrypt: %v", p, c, size, err)
+				}
+				if !bytes.Equal(plain, decrypted.Bytes()) {
+					t.Errorf("%v %v %d: decrypted text differs", p, c, size)
+				}
+
+				decrypted.Reset()
+				_, err = testEncryptor().EncryptParallel(decrypted, bytes.NewReader(ciphertext.Bytes()), false, 3)
+				if err != nil {
+					t.Fatalf("%v %v %d: could not decrypt in parallel: %v", p, c, size, err)
+				}
+				if !bytes.Equal(plain, decrypted.Bytes()) {
+					t.Errorf("%v %v %d: parallel decrypted text differs", p, c, size)
+				}
+
+				rs, err := NewDecryptReadSeeker(enc.GetKey(), bytes.NewReader(ciphertext.Bytes()))
+				if err != nil {
+					t.Fatalf("%v %v %d: could not open: %v", p, c, size, err)
+				}
+				end, err := rs.Seek(0, io.SeekEnd)
+				if err != nil || end != int64(size) {
+					t.Errorf("%v %v %d: seek to end gave %d %v", p, c, size, end, err)
+				}
+				rs.Seek(0, io.SeekStart)
+				read, err := ioutil.ReadAll(rs)
+				if err != nil {
+					t.Fatalf("%v %v %d: could not read: %v", p, c, size, err)
+				}
+				if !bytes.Equal(plain, read) {
+					t.Errorf("%v %v %d: read text differs", p, c, size)
+				}
+			}
+		}
+	}
+}
+
+func TestPaddingTruncated(t *testing.T) {
+	plain := testPlaintext(3*int(ChunkSize) + 100)
+	enc := testEncryptor()
+	enc.SetPadding(PaddingPow2)
+	ciphertext := &bytes.Buffer{}
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	full := ciphertext.Bytes()
+
+	// drop the final padding chunk
+	r, err := NewDecryptReaderAt(enc.GetKey(), bytes.NewReader(full), int64(len(full)), 0)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	offset, _ := r.layout.chunk(r.lastChunk)
+	truncated := full[:offset-int64(frameHeaderSize)]
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(truncated), false)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	_, err = NewDecryptReaderAt(enc.GetKey(), bytes.NewReader(truncated), int64(len(truncated)), 0)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// A paper key is an offline copy of the master key and its Argon2id
+// parameters, as
+//
+//	version (1) | master key (32) | time (4) | memory (4) | threads (1) |
+//	salt length (1) | salt | checksum (4)
+//
+// where the checksum is the start of the SHA-256 of everything before
+// it. It is written out either as one word of paperWords per byte, or in
+// base64 after paperKeyPrefix for QR codes.
+const (
+	paperKeyVersion = 1
+	paperKeyPrefix  = "bbk1."
+	paperSumSize    = 4
+)
+
+// PaperKey is a master key with the parameters it was derived with.
+type PaperKey struct {
+	Master *MasterKey
+	Params KDFParams
+}
+
+func (p *PaperKey) bytes() []byte {
+	b := make([]byte, 0, 43+len(p.Params.Salt)+paperSumSize)
+	b = append(b, paperKeyVersion)
+	b = append(b, p.Master.key...)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-8:], p.Params.Time)
+	binary.BigEndian.PutUint32(b[len(b)-4:], p.Params.Memory)
+	b = append(b, p.Params.Threads, byte(len(p.Params.Salt)))
+	b = append(b, p.Params.Salt...)
+	sum := sha256.Sum256(b)
+	return append(b, sum[:paperSumSize]...)
+}
+
+// Words returns the paper key as words, one per byte.
+func (p *PaperKey) Words() []string {
+	b := p.bytes()
+	words := make([]string, len(b))
+	for i, c := range b {
+		words[i] = paperWords[c]
+	}
+	return words
+}
+
+// String returns the compact form of the paper key, for QR codes.
+func (p *PaperKey) String() string {
+	return paperKeyPrefix + base64.RawURLEncoding.EncodeToString(p.bytes())
+}
+
+// ParsePaperKey parses a paper key in either form. Words may be
+// abbreviated to their first four letters, and numbers such as line
+// numbers between them are ignored. ErrPaperKeyChecksum is returned if
+// the key is damaged.
+func ParsePaperKey(text string) (*PaperKey, error) {
+	text = strings.TrimSpace(text)
+	var b []byte
+	if strings.HasPrefix(text, paperKeyPrefix) {
+		var err error
+		b, err = base64.RawURLEncoding.DecodeString(text[len(paperKeyPrefix):])
+		if err != nil {
+			return nil, ErrPaperKeyChecksum
+		}
+	} else {
+		for _, field := range strings.Fields(strings.ToLower(text)) {
+			field = strings.TrimSuffix(field, ":")
+			if strings.Trim(field, "0123456789") == "" {
+				continue
+			}
+			c, ok := paperWordIndex[paperWordKey(field)]
+			if !ok {
+				return nil, fmt.Errorf("unknown word %q in paper key", field)
+			}
+			b = append(b, c)
+		}
+	}
+
+	n := len(b) - paperSumSize
+	if n < 43 || n != 43+int(b[42]) {
+		return nil, ErrPaperKeyChecksum
+	}
+	sum := sha256.Sum256(b[:n])
+	if !bytes.Equal(sum[:paperSumSize], b[n:]) {
+		return nil, ErrPaperKeyChecksum
+	}
+	if b[0] != paperKeyVersion {
+		return nil, fmt.Errorf("unsupported paper key version %d", b[0])
+	}
+	key := append([]byte{}, b[1:33]...)
+	params := KDFParams{
+		Time:    binary.BigEndian.Uint32(b[33:37]),
+		Memory:  binary.BigEndian.Uint32(b[37:41]),
+		Threads: b[41],
+		Salt:    append([]byte{}, b[43:n]...),
+	}
+	err := params.Check()
+	if err != nil {
+		return nil, err
+	}
+	master, err := newMasterKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &PaperKey{Master: master, Params: params}, nil
+}
+
+// paperWordKey returns the abbreviation words are looked up by.
+func paperWordKey(word string) string {
+	if len(word) > 4 {
+		return word[:4]
+	}
+	return word
+}
+
+var paperWordIndex = func() map[string]byte {
+	index := make(map[string]byte, len(paperWords))
+	for i, w := range paperWords {
+		index[paperWordKey(w)] = byte(i)
+	}
+	return index
+}()
+
+// paperWords encode one byte each. Their first four letters are unique.
+var paperWords = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "angel", "ankle", "apple", "apron", "arena", "armor", "arrow",
+	"atlas", "attic", "audio", "autumn", "avenue", "bacon", "badge", "bagel",
+	"baker", "bamboo", "banjo", "barn", "basil", "basket", "beach", "beard",
+	"beaver", "bench", "berry", "bicycle", "bison", "blade", "blanket", "blossom",
+	"board", "boat", "bonus", "book", "border", "bottle", "bounce", "bracket",
+	"brain", "brick", "bridge", "broom", "bubble", "bucket", "buffalo", "bundle",
+	"burger", "butter", "cabin", "cactus", "camel", "canal", "candle", "canoe",
+	"canyon", "carbon", "carpet", "castle", "cattle", "cedar", "cello", "chalk",
+	"cherry", "chess", "chimney", "circus", "clock", "cloud", "clover", "coach",
+	"cobalt", "coconut", "coffee", "comet", "copper", "coral", "cotton", "cousin",
+	"coyote", "crane", "crayon", "cricket", "crystal", "cupboard", "curtain", "cushion",
+	"dagger", "daisy", "dancer", "delta", "denim", "desert", "diesel", "dinner",
+	"doctor", "dolphin", "donkey", "dragon", "drawer", "dream", "drum", "eagle",
+	"earth", "easel", "echo", "eclipse", "elbow", "elder", "ember", "engine",
+	"envelope", "escape", "fabric", "falcon", "feather", "fence", "ferry", "fiber",
+	"fiddle", "finger", "flame", "flute", "forest", "fossil", "fountain", "fox",
+	"frame", "galaxy", "garden", "garlic", "gazelle", "giant", "ginger", "glacier",
+	"glove", "goat", "gravel", "guitar", "hammer", "harbor", "harvest", "hazel",
+	"helmet", "hermit", "hollow", "honey", "horizon", "hotel", "iceberg", "igloo",
+	"island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw", "jungle",
+	"kayak", "kettle", "kitten", "koala", "ladder", "lagoon", "lantern", "laptop",
+	"lemon", "leopard", "lettuce", "lily", "lobster", "locket", "lunar", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "mirror", "mitten", "monkey",
+	"mosaic", "muffin", "napkin", "nectar", "needle", "nickel", "noodle", "oasis",
+	"ocean", "olive", "onion", "orbit", "orchid", "otter", "oyster", "paddle",
+	"palace", "panda", "parrot", "peach", "pebble", "pepper", "piano", "pillow",
+	"pirate", "planet", "plum", "pocket", "potato", "puzzle", "quartz", "rabbit",
+	"radar", "radish", "raven", "ribbon", "river", "robot", "rocket", "saddle",
+	"salmon", "sandal", "scarf", "shadow", "shovel", "silver", "sketch", "spider",
+	"spoon", "squid", "statue", "sunset", "tablet", "tiger", "tomato", "tunnel",
+	"turtle", "velvet", "violin", "volcano", "walnut", "wizard", "yogurt", "zebra",
+}
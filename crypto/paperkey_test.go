@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPaperKey(t *testing.T) {
+	params := testKDFParams()
+	paper := &PaperKey{Master: testMasterKey(t, "correct horse"), Params: params}
+	words := paper.Words()
+	if len(words) != 43+len(params.Salt)+paperSumSize {
+		t.Errorf("unexpected number of words %d", len(words))
+	}
+
+	// typed back in with line numbers, abbreviated and in upper case
+	lines := []string{}
+	for i := 0; i < len(words); i += 8 {
+		end := i + 8
+		if end > len(words) {
+			end = len(words)
+		}
+		line := []string{}
+		for _, w := range words[i:end] {
+			line = append(line, strings.ToUpper(paperWordKey(w)))
+		}
+		lines = append(lines, string(rune('1'+i/8))+": "+strings.Join(line, " "))
+	}
+	for _, text := range []string{strings.Join(words, " "), strings.Join(lines, "\n"), paper.String()} {
+		parsed, err := ParsePaperKey(text)
+		if err != nil {
+			t.Fatalf("could not parse %q: %v", text, err)
+		}
+		if parsed.Master.ID != paper.Master.ID || parsed.Params.Time != params.Time ||
+			parsed.Params.Memory != params.Memory || parsed.Params.Threads != params.Threads ||
+			string(parsed.Params.Salt) != string(params.Salt) {
+			t.Errorf("parsed paper key differs")
+		}
+	}
+
+	swapped := append([]string{}, words...)
+	swapped[3], swapped[4] = swapped[4], swapped[3]
+	if _, err := ParsePaperKey(strings.Join(swapped, " ")); err != ErrPaperKeyChecksum && words[3] != words[4] {
+		t.Errorf("expected ErrPaperKeyChecksum, got %v", err)
+	}
+	if _, err := ParsePaperKey(strings.Join(words[1:], " ")); err != ErrPaperKeyChecksum {
+		t.Errorf("expected ErrPaperKeyChecksum for a missing word, got %v", err)
+	}
+	if _, err := ParsePaperKey("acid notaword"); err == nil {
+		t.Errorf("expected error for an unknown word")
+	}
+}
+
+func TestPaperWords(t *testing.T) {
+	if len(paperWordIndex) != len(paperWords) {
+		t.Errorf("abbreviations of paper words are not unique")
+	}
+}
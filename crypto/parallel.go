@@ -0,0 +1,218 @@
+package crypto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// chunkJob is one chunk travelling through the parallel pipeline.
+type chunkJob struct {
+	idx    int64
+	last   bool
+	in     []byte
+	packed []byte
+	out    []byte
+	size   int64 // plaintext size recorded by the final padding chunk
+	err    error
+	done   chan struct{}
+}
+
+// EncryptParallel does the same as Encrypt, but seals or opens up to
+// workers chunks at once. If workers is 0 or less, runtime.NumCPU() is
+// used. Chunks are read and hashed in order by the calling goroutine,
+// handed to the workers, and written and hashed in order by a writer
+// goroutine, so the output and hashes are identical to Encrypt. Like
+// Encrypt, it leaves e reporting the format of the stream in Format, but
+// keeps its settings.
+func (e *Encryptor) EncryptParallel(out io.Writer, in io.Reader, encrypt bool, workers int) (Hash, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	hash := Hash{}
+	// the stream is read and written with a copy of e, so that the format
+	// of one stream does not carry over to the next
+	stream := *e
+
+	inHash, err := NewHashSet(stream.hashes)
+	if err != nil {
+		return hash, err
+	}
+	outHash, err := NewHashSet(stream.hashes)
+	if err != nil {
+		return hash, err
+	}
+	out = io.MultiWriter(out, outHash)
+
+	var inChunkSize, outChunkSize int64
+	var written, size, inSize int64 // plaintext or ciphertext written, and plaintext size
+	size = -1
+	if encrypt {
+		if len(stream.iv) != ivSize {
+			return hash, fmt.Errorf("%w: no iv to encrypt with", ErrBadKey)
+		}
+		stream.version = currentVersion
+		// the first chunk decides the compression of the stream
+		buffered := bufio.NewReaderSize(in, int(stream.chunkSize))
+		sample, _ := buffered.Peek(int(stream.chunkSize))
+		stream.chooseCompression(sample)
+		in = buffered
+		inChunkSize = stream.chunkSize
+		outChunkSize = stream.maxSealedSize() + int64(frameHeaderSize)
+		header := stream.header()
+		err := writeAll(out, header)
+		if err != nil {
+			return hash, err
+		}
+		written = int64(len(header))
+	} else {
+		header, err := stream.readHeader(in)
+		if err != nil {
+			return hash, err
+		}
+		inHash.Write(header)
+		inChunkSize = stream.maxSealedSize()
+		outChunkSize = stream.chunkSize
+	}
+
+	// at most 2*workers chunks are in flight; their buffers are reused
+	inFlight := 2 * workers
+	free := make(chan *chunkJob, inFlight)
+	for i := 0; i < inFlight; i++ {
+		free <- &chunkJob{in: make([]byte, 0, inChunkSize), out: make([]byte, 0, outChunkSize)}
+	}
+	jobs := make(chan *chunkJob, inFlight)
+	ordered := make(chan *chunkJob, inFlight)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if encrypt {
+					j.out, j.packed, j.err = stream.encodeChunk(j.out[:0], j.packed, j.in, j.idx, j.last)
+				} else {
+					j.out, j.size, j.err = stream.decodeChunk(j.out[:0], j.in, j.idx, j.last)
+				}
+				close(j.done)
+			}
+		}()
+	}
+
+	// the writer keeps draining after an error so the reader never blocks
+	writeErr := make(chan error, 1)
+	var failed sync.Once
+	stop := make(chan struct{})
+	// the frames of streams with parity are written in groups
+	write := func(b []byte) error {
+		return writeAll(out, b)
+	}
+	var parity *parityWriter
+	if encrypt && stream.parity != 0 {
+		parity = newParityWriter(&stream, write)
+		write = parity.add
+	}
+	go func() {
+		var err error
+		for j := range ordered {
+			<-j.done
+			if err == nil {
+				err = j.err
+				if err == nil {
+					err = write(j.out)
+					written += int64(len(j.out))
+				}
+				if j.size >= 0 {
+					size = j.size
+				}
+				if err != nil {
+					failed.Do(func() { close(stop) })
+				}
+			}
+			free <- j
+		}
+		writeErr <- err
+	}()
+
+	idx := int64(0)
+	readFn := func(chunk []byte, last bool) error {
+		if !encrypt && len(chunk) == 0 && idx == 0 && stream.version == 1 {
+			return nil // version 1 does not write a chunk for empty input
+		}
+		var j *chunkJob
+		select {
+		case <-stop:
+			return errors.New("stopped")
+		default:
+		}
+		select {
+		case j = <-free:
+		case <-stop:
+			return errors.New("stopped")
+		}
+		j.idx = idx
+		// the padding follows the final plaintext chunk of padded streams
+		j.last = last && !(encrypt && stream.padding != PaddingNone)
+		j.in = append(j.in[:0], chunk...)
+		j.size = -1
+		j.err = nil
+		inSize += int64(len(chunk))
+		j.done = make(chan struct{})
+		ordered <- j
+		jobs <- j
+		idx += 1
+		return nil
+	}
+	if encrypt {
+		err = readChunks(io.TeeReader(in, inHash), inChunkSize, readFn)
+	} else {
+		err = stream.readSealedChunks(io.TeeReader(in, inHash), readFn)
+	}
+	close(jobs)
+	close(ordered)
+	wg.Wait()
+	werr := <-writeErr
+	if werr != nil {
+		return hash, werr
+	}
+	if err != nil {
+		return hash, err
+	}
+	if stream.padding != PaddingNone {
+		if encrypt {
+			idx, err = stream.sealPadding(written, idx, inSize, write)
+			if err != nil {
+				return hash, err
+			}
+		} else if size != written {
+			return hash, ErrPaddingSize
+		}
+	}
+	if parity != nil {
+		err = parity.close()
+		if err != nil {
+			return hash, err
+		}
+	}
+	stream.ChunkIdx = idx
+	e.version, e.compression, e.ChunkIdx = stream.version, stream.compression, stream.ChunkIdx
+
+	hash.In = inHash.Digests()
+	hash.Out = outHash.Digests()
+	return hash, nil
+}
+
+func writeAll(out io.Writer, b []byte) error {
+	w, err := out.Write(b)
+	if err != nil {
+		return err
+	}
+	if w != len(b) {
+		return errors.New(fmt.Sprintf("Expected to write %d, but actually wrote %d", len(b), w))
+	}
+	return nil
+}
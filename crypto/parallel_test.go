@@ -0,0 +1,154 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptParallel(t *testing.T) {
+	sizes := []int{0, 1, int(ChunkSize), 7*int(ChunkSize) + 3}
+	for _, size := range sizes {
+		plain := testPlaintext(size)
+		serial := &bytes.Buffer{}
+		serialHash, err := testEncryptor().Encrypt(serial, bytes.NewReader(plain), true)
+		if err != nil {
+			t.Fatalf("%d: could not encrypt: %v", size, err)
+		}
+		for _, workers := range []int{0, 1, 3} {
+			parallel := &bytes.Buffer{}
+			hash, err := testEncryptor().EncryptParallel(parallel, bytes.NewReader(plain), true, workers)
+			if err != nil {
+				t.Fatalf("%d/%d: could not encrypt: %v", size, workers, err)
+			}
+			if !bytes.Equal(serial.Bytes(), parallel.Bytes()) || !EqualHash(serialHash, hash) {
+				t.Errorf("%d/%d: parallel encryption differs", size, workers)
+			}
+
+			decrypted := &bytes.Buffer{}
+			_, err = testEncryptor().EncryptParallel(decrypted, bytes.NewReader(parallel.Bytes()), false, workers)
+			if err != nil {
+				t.Fatalf("%d/%d: could not decrypt: %v", size, workers, err)
+			}
+			if !bytes.Equal(plain, decrypted.Bytes()) {
+				t.Errorf("%d/%d: parallel decryption differs", size, workers)
+			}
+		}
+	}
+}
+
+func TestEncryptParallelErrors(t *testing.T) {
+	plain := testPlaintext(10 * int(ChunkSize))
+	ciphertext := &bytes.Buffer{}
+	enc := testEncryptor()
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	cipherChunkSize := int(ChunkSize) + 16
+	headerSize := int(enc.headerSize())
+
+	truncated := ciphertext.Bytes()[:headerSize+5*cipherChunkSize]
+	_, err = testEncryptor().EncryptParallel(ioutil.Discard, bytes.NewReader(truncated), false, 4)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+
+	corrupt := append([]byte{}, ciphertext.Bytes()...)
+	corrupt[headerSize+2*cipherChunkSize] ^= 1
+	_, err = testEncryptor().EncryptParallel(ioutil.Discard, bytes.NewReader(corrupt), false, 4)
+	if err == nil {
+		t.Errorf("expected error decrypting corrupt chunk")
+	}
+
+	for _, n := range []int{0, 3 * cipherChunkSize} {
+		_, err = testEncryptor().EncryptParallel(&failingWriter{n}, bytes.NewReader(plain), true, 4)
+		if err == nil || err.Error() != "write failed" {
+			t.Errorf("%d: expected write error, got %v", n, err)
+		}
+	}
+}
+
+// failingWriter fails once more than n bytes are written
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		return 0, errors.New("write failed")
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+const benchSize = 64 * 1024 * 1024
+
+func benchmarkEncrypt(b *testing.B, workers int, encrypt bool) {
+	in := testPlaintext(benchSize)
+	if !encrypt {
+		ciphertext := &bytes.Buffer{}
+		testEncryptor().Encrypt(ciphertext, bytes.NewReader(in), true)
+		in = ciphertext.Bytes()
+	}
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if workers == 0 {
+			_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(in), encrypt)
+		} else {
+			_, err = testEncryptor().EncryptParallel(ioutil.Discard, bytes.NewReader(in), encrypt, workers)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptSerial(b *testing.B)    { benchmarkEncrypt(b, 0, true) }
+func BenchmarkEncryptParallel1(b *testing.B) { benchmarkEncrypt(b, 1, true) }
+func BenchmarkEncryptParallel4(b *testing.B) { benchmarkEncrypt(b, 4, true) }
+func BenchmarkDecryptSerial(b *testing.B)    { benchmarkEncrypt(b, 0, false) }
+func BenchmarkDecryptParallel1(b *testing.B) { benchmarkEncrypt(b, 1, false) }
+func BenchmarkDecryptParallel4(b *testing.B) { benchmarkEncrypt(b, 4, false) }
+
+func TestEncryptParallelReuse(t *testing.T) {
+	// a padded stream with a smaller chunk size, decrypted with enc
+	other := testEncryptor()
+	other.SetPadding(PaddingPadme)
+	other.SetChunkSize(MinChunkSize)
+	padded := &bytes.Buffer{}
+	_, err := other.Encrypt(padded, bytes.NewReader(testPlaintext(100)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := testEncryptor()
+	enc.SetCompression(CompressionZstd)
+	_, err = enc.EncryptParallel(ioutil.Discard, bytes.NewReader(padded.Bytes()), false, 2)
+	if err != nil {
+		t.Fatalf("could not decrypt: %v", err)
+	}
+
+	// two streams encrypted with enc, one that does not compress and one
+	// that does, come out as with a fresh encryptor each
+	inputs := [][]byte{testPlaintext(3 * int(ChunkSize)), bytes.Repeat([]byte("compressible "), int(ChunkSize))}
+	for i, plain := range inputs {
+		fresh := testEncryptor()
+		fresh.SetCompression(CompressionZstd)
+		expected := &bytes.Buffer{}
+		_, err = fresh.Encrypt(expected, bytes.NewReader(plain), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parallel := &bytes.Buffer{}
+		_, err = enc.EncryptParallel(parallel, bytes.NewReader(plain), true, 2)
+		if err != nil {
+			t.Fatalf("%d: could not encrypt: %v", i, err)
+		}
+		if !bytes.Equal(expected.Bytes(), parallel.Bytes()) || enc.Format() != fresh.Format() {
+			t.Errorf("%d: stream differs from one of a fresh encryptor", i)
+		}
+	}
+}
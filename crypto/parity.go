@@ -0,0 +1,304 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// The chunks of a stream with parity are framed, and come in groups of
+// up to the group size of the header. Each group is preceded by its
+// parity block:
+//
+//	block header     twice, in case one copy is damaged:
+//	    final        1 byte, 1 for the final group
+//	    chunks       1 byte, in the group
+//	    shard size   4 bytes
+//	    frames       group size × (frame length 4 bytes, CRC-32C 4 bytes)
+//	    parity       parity shards × CRC-32C 4 bytes
+//	    CRC-32C      4 bytes, of the above
+//	parity shards    parity shards × shard size bytes
+//
+// The data shards of the Reed-Solomon code are the frames of the group,
+// each zero padded to the shard size, so up to as many damaged frames as
+// there are parity shards can be rebuilt. The CRCs only find the damaged
+// frames; the chunks are authenticated as usual.
+
+// ParityGroup is the number of chunks a parity block protects.
+const ParityGroup = 16
+
+// MaxParity is the most parity shards a group may have.
+const MaxParity = 16
+
+// maxParityGroup bounds the group size a header may declare.
+const maxParityGroup = 64
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SetParity sets the number of parity shards per group of ParityGroup
+// chunks of new streams; 0, the default, adds no parity.
+func (e *Encryptor) SetParity(shards int) error {
+	if shards < 0 || shards > MaxParity {
+		return fmt.Errorf("%w: parity %d out of range", ErrBadOption, shards)
+	}
+	e.parity = shards
+	e.parityGroup = ParityGroup
+	return nil
+}
+
+// GetParity returns the parity shards per group of the stream.
+func (e *Encryptor) GetParity() int {
+	return e.parity
+}
+
+// parityBlock is the parsed header of a parity block.
+type parityBlock struct {
+	final      bool
+	shardSize  int64
+	lengths    []int64  // of the frames, frame header included
+	sums       []uint32 // of the frames
+	paritySums []uint32 // of the parity shards
+}
+
+// parityHeaderSize returns the size of one copy of a block header.
+func (e *Encryptor) parityHeaderSize() int64 {
+	return 6 + 8*int64(e.parityGroup) + 4*int64(e.parity) + 4
+}
+
+// parityBlockSize returns the size of the parity block of b.
+func (e *Encryptor) parityBlockSize(b *parityBlock) int64 {
+	return 2*e.parityHeaderSize() + int64(e.parity)*b.shardSize
+}
+
+// encodeParity returns the parity block of the frames of a group.
+func (e *Encryptor) encodeParity(frames [][]byte, final bool) ([]byte, error) {
+	shardSize := 0
+	for _, f := range frames {
+		if len(f) > shardSize {
+			shardSize = len(f)
+		}
+	}
+	shards := make([][]byte, len(frames)+e.parity)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < len(frames) {
+			copy(shards[i], frames[i])
+		}
+	}
+	rs, err := reedsolomon.New(len(frames), e.parity)
+	if err != nil {
+		return nil, err
+	}
+	err = rs.Encode(shards)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, e.parityHeaderSize())
+	if final {
+		header[0] = 1
+	}
+	header[1] = byte(len(frames))
+	binary.LittleEndian.PutUint32(header[2:], uint32(shardSize))
+	for i, f := range frames {
+		binary.LittleEndian.PutUint32(header[6+8*i:], uint32(len(f)))
+		binary.LittleEndian.PutUint32(header[10+8*i:], crc32.Checksum(f, crcTable))
+	}
+	sums := header[6+8*e.parityGroup:]
+	for i, p := range shards[len(frames):] {
+		binary.LittleEndian.PutUint32(sums[4*i:], crc32.Checksum(p, crcTable))
+	}
+	binary.LittleEndian.PutUint32(header[len(header)-4:], crc32.Checksum(header[:len(header)-4], crcTable))
+
+	block := make([]byte, 0, 2*len(header)+e.parity*shardSize)
+	block = append(append(block, header...), header...)
+	for _, p := range shards[len(frames):] {
+		block = append(block, p...)
+	}
+	return block, nil
+}
+
+// parseParity parses the two copies of a block header in b, using the
+// first one that is intact.
+func (e *Encryptor) parseParity(b []byte) (*parityBlock, error) {
+	size := e.parityHeaderSize()
+	for _, header := range [][]byte{b[:size], b[size : 2*size]} {
+		if crc32.Checksum(header[:size-4], crcTable) != binary.LittleEndian.Uint32(header[size-4:]) {
+			continue
+		}
+		block := parityBlock{final: header[0] == 1, shardSize: int64(binary.LittleEndian.Uint32(header[2:]))}
+		n := int(header[1])
+		if header[0] > 1 || n < 1 || n > e.parityGroup || (!block.final && n != e.parityGroup) ||
+			block.shardSize > e.maxSealedSize()+int64(frameHeaderSize) {
+			return nil, fmt.Errorf("%w: parity block", ErrBadChunk)
+		}
+		for i := 0; i < n; i++ {
+			length := int64(binary.LittleEndian.Uint32(header[6+8*i:]))
+			if length < int64(frameHeaderSize) || length > block.shardSize {
+				return nil, fmt.Errorf("%w: parity block", ErrBadChunk)
+			}
+			block.lengths = append(block.lengths, length)
+			block.sums = append(block.sums, binary.LittleEndian.Uint32(header[10+8*i:]))
+		}
+		sums := header[6+8*e.parityGroup:]
+		for i := 0; i < e.parity; i++ {
+			block.paritySums = append(block.paritySums, binary.LittleEndian.Uint32(sums[4*i:]))
+		}
+		return &block, nil
+	}
+	return nil, fmt.Errorf("%w: parity block checksum", ErrBadChunk)
+}
+
+// readParityGroup reads the parity block and frames of a group from in,
+// and rebuilds the damaged frames if there is enough parity left. It
+// returns the block and the frames, frame headers included.
+func (e *Encryptor) readParityGroup(in io.Reader) (*parityBlock, [][]byte, error) {
+	header := make([]byte, 2*e.parityHeaderSize())
+	_, err := io.ReadFull(in, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil, ErrTruncated
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := e.parseParity(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	parity := make([][]byte, e.parity)
+	frames := make([][]byte, len(block.lengths))
+	for i := range parity {
+		parity[i] = make([]byte, block.shardSize)
+	}
+	for i, length := range block.lengths {
+		frames[i] = make([]byte, length)
+	}
+	for _, b := range append(append([][]byte{}, parity...), frames...) {
+		_, err = io.ReadFull(in, b)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrTruncated
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = e.repairGroup(block, frames, parity)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, frames, nil
+}
+
+// repairGroup rebuilds the frames of a group whose CRC doesn't match
+// from the intact frames and parity shards. Frames that can't be rebuilt
+// are left as they are, to fail authentication.
+func (e *Encryptor) repairGroup(block *parityBlock, frames, parity [][]byte) error {
+	shards := make([][]byte, len(frames)+len(parity))
+	damaged, intact := []int{}, 0
+	for i, f := range frames {
+		if crc32.Checksum(f, crcTable) != block.sums[i] {
+			damaged = append(damaged, i)
+			continue
+		}
+		shards[i] = make([]byte, block.shardSize)
+		copy(shards[i], f)
+		intact++
+	}
+	if len(damaged) == 0 {
+		return nil
+	}
+	for i, p := range parity {
+		if crc32.Checksum(p, crcTable) == block.paritySums[i] {
+			shards[len(frames)+i] = p
+			intact++
+		}
+	}
+	if intact < len(frames) {
+		return nil
+	}
+	rs, err := reedsolomon.New(len(frames), len(parity))
+	if err != nil {
+		return err
+	}
+	err = rs.ReconstructData(shards)
+	if err != nil {
+		return nil
+	}
+	for _, i := range damaged {
+		copy(frames[i], shards[i])
+	}
+	return nil
+}
+
+// readParityGroups reads the groups of a stream with parity from in,
+// and calls fn for each of their sealed chunks like readChunks does.
+func (e *Encryptor) readParityGroups(in io.Reader, fn func(chunk []byte, last bool) error) error {
+	for {
+		block, frames, err := e.readParityGroup(in)
+		if err != nil {
+			return err
+		}
+		for i, f := range frames {
+			err = fn(f[frameHeaderSize:], block.final && i == len(frames)-1)
+			if err != nil {
+				return err
+			}
+		}
+		if block.final {
+			n, _ := readFull(in, make([]byte, 1))
+			if n > 0 {
+				return ErrTrailingData
+			}
+			return nil
+		}
+	}
+}
+
+// parityWriter collects the frames of a stream with parity, and writes
+// each group of them after its parity block.
+type parityWriter struct {
+	enc    *Encryptor
+	write  func([]byte) error
+	frames [][]byte
+	n      int
+}
+
+func newParityWriter(e *Encryptor, write func([]byte) error) *parityWriter {
+	return &parityWriter{enc: e, write: write, frames: make([][]byte, e.parityGroup)}
+}
+
+// add adds the next frame, writing the previous group if it is full.
+func (p *parityWriter) add(frame []byte) error {
+	if p.n == len(p.frames) {
+		err := p.flush(false)
+		if err != nil {
+			return err
+		}
+	}
+	p.frames[p.n] = append(p.frames[p.n][:0], frame...)
+	p.n += 1
+	return nil
+}
+
+// close writes the final group.
+func (p *parityWriter) close() error {
+	return p.flush(true)
+}
+
+func (p *parityWriter) flush(final bool) error {
+	block, err := p.enc.encodeParity(p.frames[:p.n], final)
+	if err != nil {
+		return err
+	}
+	err = p.write(block)
+	for _, f := range p.frames[:p.n] {
+		if err == nil {
+			err = p.write(f)
+		}
+	}
+	p.n = 0
+	return err
+}
@@ -0,0 +1,185 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// parityEncryptor returns a test encryptor with small chunks, so that
+// streams have several parity groups.
+func parityEncryptor(parity int) *Encryptor {
+	enc := testEncryptor()
+	enc.SetChunkSize(MinChunkSize)
+	enc.SetParity(parity)
+	return enc
+}
+
+// decryptAll decrypts b with Encrypt, EncryptParallel and
+// DecryptReaderAt, and checks that each gives plain.
+func decryptAll(t *testing.T, name string, b, plain []byte) {
+	decrypted := &bytes.Buffer{}
+	_, err := testEncryptor().Encrypt(decrypted, bytes.NewReader(b), false)
+	if err != nil {
+		t.Fatalf("%s: could not decrypt: %v", name, err)
+	}
+	if !bytes.Equal(plain, decrypted.Bytes()) {
+		t.Errorf("%s: decrypted text differs", name)
+	}
+
+	decrypted.Reset()
+	_, err = testEncryptor().EncryptParallel(decrypted, bytes.NewReader(b), false, 3)
+	if err != nil {
+		t.Fatalf("%s: could not decrypt in parallel: %v", name, err)
+	}
+	if !bytes.Equal(plain, decrypted.Bytes()) {
+		t.Errorf("%s: parallel decrypted text differs", name)
+	}
+
+	r, err := NewDecryptReaderAt(testEncryptor().GetKey(), bytes.NewReader(b), int64(len(b)), 0)
+	if err != nil {
+		t.Fatalf("%s: could not open: %v", name, err)
+	}
+	read := make([]byte, r.Size())
+	_, err = r.ReadAt(read, 0)
+	if err != nil {
+		t.Fatalf("%s: could not read: %v", name, err)
+	}
+	if !bytes.Equal(plain, read) {
+		t.Errorf("%s: read text differs", name)
+	}
+}
+
+func TestParityRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 16 * MinChunkSize, 40*MinChunkSize + 100}
+	for _, parity := range []int{1, 3} {
+		for _, p := range []Padding{PaddingNone, PaddingPadme} {
+			for _, size := range sizes {
+				plain := testPlaintext(size)
+				enc := parityEncryptor(parity)
+				enc.SetPadding(p)
+				ciphertext := &bytes.Buffer{}
+				_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+				if err != nil {
+					t.Fatalf("%d %v %d: could not encrypt: %v", parity, p, size, err)
+				}
+				if FormatParity(enc.Format()) != parity || FormatPadding(enc.Format()) != p {
+					t.Errorf("%d %v %d: unexpected format %x", parity, p, size, enc.Format())
+				}
+
+				parallel := &bytes.Buffer{}
+				enc = parityEncryptor(parity)
+				enc.SetPadding(p)
+				_, err = enc.EncryptParallel(parallel, bytes.NewReader(plain), true, 3)
+				if err != nil {
+					t.Fatalf("%d %v %d: could not encrypt in parallel: %v", parity, p, size, err)
+				}
+				if !bytes.Equal(ciphertext.Bytes(), parallel.Bytes()) {
+					t.Errorf("%d %v %d: parallel ciphertext differs", parity, p, size)
+				}
+				decryptAll(t, "round trip", ciphertext.Bytes(), plain)
+			}
+		}
+	}
+}
+
+func TestParityRepair(t *testing.T) {
+	plain := testPlaintext(40*MinChunkSize + 100)
+	enc := parityEncryptor(2)
+	ciphertext := &bytes.Buffer{}
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	full := ciphertext.Bytes()
+	r, err := NewDecryptReaderAt(enc.GetKey(), bytes.NewReader(full), int64(len(full)), 0)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	l := r.layout
+	if len(l.groups) != 3 || l.count() != 41 {
+		t.Fatalf("unexpected layout of %d groups, %d chunks", len(l.groups), l.count())
+	}
+
+	// two damaged chunks in the first group, one with a damaged frame
+	// length, and a damaged copy of the header of the second group
+	damaged := append([]byte{}, full...)
+	offset, _ := l.chunk(3)
+	damaged[offset+10] ^= 1
+	offset, _ = l.chunk(7)
+	damaged[offset-int64(frameHeaderSize)] ^= 1
+	damaged[l.groups[1].offset+2] ^= 1
+	// and a damaged final chunk
+	offset, length := l.chunk(40)
+	damaged[offset+length-1] ^= 1
+	decryptAll(t, "repaired", damaged, plain)
+
+	out, report := salvage(t, damaged, -1, SalvageZeroFill)
+	if !bytes.Equal(out, plain) || len(report.Damaged) != 0 {
+		t.Errorf("repaired stream salvaged with %v", report.Damaged)
+	}
+
+	// a third damaged frame is more than the parity of the group; the
+	// chunk with only a damaged frame length still authenticates
+	offset, _ = l.chunk(12)
+	damaged[offset] ^= 1
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(damaged), false)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("expected ErrAuthFailed, got %v", err)
+	}
+	out, report = salvage(t, damaged, -1, SalvageZeroFill)
+	if len(report.Damaged) != 2 || report.Damaged[0].Chunk != 3 || report.Damaged[1].Chunk != 12 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+	c := int64(MinChunkSize)
+	if !bytes.Equal(out, zeroed(zeroed(plain, 3*c, c), 12*c, c)) {
+		t.Errorf("damaged chunks not zero filled")
+	}
+
+	// both copies of a block header
+	damaged = append([]byte{}, full...)
+	damaged[l.groups[1].offset+2] ^= 1
+	damaged[l.groups[1].offset+enc.parityHeaderSize()+2] ^= 1
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(damaged), false)
+	if !errors.Is(err, ErrBadChunk) {
+		t.Errorf("expected ErrBadChunk, got %v", err)
+	}
+	out, report = salvage(t, damaged, -1, SalvageSkip)
+	if !bytes.Equal(out, plain[:16*c]) || len(report.Damaged) != 1 || report.Damaged[0].Chunk != 16 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+
+	// a truncated stream
+	truncated := full[:l.groups[2].offset]
+	_, err = testEncryptor().Encrypt(ioutil.Discard, bytes.NewReader(truncated), false)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	_, err = NewDecryptReaderAt(enc.GetKey(), bytes.NewReader(truncated), int64(len(truncated)), 0)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestParityOption(t *testing.T) {
+	enc := testEncryptor()
+	if enc.SetParity(MaxParity+1) == nil || enc.SetParity(-1) == nil {
+		t.Errorf("expected error for invalid parity")
+	}
+	enc.SetParity(4)
+	enc.version = currentVersion
+	header := enc.header()
+	dec := testEncryptor()
+	err := dec.setHeader(header)
+	if err != nil || dec.GetParity() != 4 || dec.parityGroup != ParityGroup {
+		t.Errorf("parity not read from header: %v", err)
+	}
+
+	// a parity of 0 is not a valid option
+	header[len(header)-1] = 0
+	err = dec.setHeader(header)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	identityPrefix  = "bbackup-identity-"
+	recipientPrefix = "bbackup-recipient-"
+	sealPrefix      = "r1."
+	sealInfo        = "bbackup recipient key"
+)
+
+// Identity is an X25519 private key that can unseal keys sealed to its
+// Recipient.
+type Identity struct {
+	private [32]byte
+	public  [32]byte
+}
+
+// Recipient is an X25519 public key that per-file keys can be sealed to.
+type Recipient struct {
+	public [32]byte
+}
+
+// GenerateIdentity returns a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	id := Identity{}
+	_, err := rand.Read(id.private[:])
+	if err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&id.public, &id.private)
+	return &id, nil
+}
+
+// ParseIdentity parses the string form of an identity.
+func ParseIdentity(s string) (*Identity, error) {
+	b, err := decodeKey(s, identityPrefix)
+	if err != nil {
+		return nil, err
+	}
+	id := Identity{}
+	copy(id.private[:], b)
+	curve25519.ScalarBaseMult(&id.public, &id.private)
+	return &id, nil
+}
+
+// ParseRecipient parses the string form of a recipient.
+func ParseRecipient(s string) (*Recipient, error) {
+	b, err := decodeKey(s, recipientPrefix)
+	if err != nil {
+		return nil, err
+	}
+	r := Recipient{}
+	copy(r.public[:], b)
+	return &r, nil
+}
+
+func decodeKey(s, prefix string) ([]byte, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("expected key starting with " + prefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, errors.New("invalid key length")
+	}
+	return b, nil
+}
+
+// String returns the secret string form of the identity.
+func (id *Identity) String() string {
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(id.private[:])
+}
+
+// Recipient returns the public half of the identity.
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{public: id.public}
+}
+
+func (r *Recipient) String() string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(r.public[:])
+}
+
+// IsSealed reports whether key was produced by SealKey.
+func IsSealed(key string) bool {
+	return strings.HasPrefix(key, sealPrefix)
+}
+
+// SealKey encrypts a per-file key to each of the recipients. Any one of
+// the matching identities can unseal it. The result has the form
+// "r1.<stanza>.<stanza>...", where each stanza is the base64 of an
+// ephemeral public key followed by the key sealed with a key derived from
+// the X25519 shared secret.
+func SealKey(key string, recipients []*Recipient) (string, error) {
+	if len(recipients) == 0 {
+		return "", errors.New("no recipients")
+	}
+	stanzas := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		stanza, err := sealStanza(key, r)
+		if err != nil {
+			return "", err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+	return sealPrefix + strings.Join(stanzas, "."), nil
+}
+
+// UnsealKey decrypts a key produced by SealKey. ErrNoIdentity is returned
+// if the key was not sealed to the identity.
+func (id *Identity) UnsealKey(sealed string) (string, error) {
+	if !IsSealed(sealed) {
+		return "", errors.New("not a sealed key")
+	}
+	for _, stanza := range strings.Split(sealed[len(sealPrefix):], ".") {
+		key, err := id.openStanza(stanza)
+		if err != ErrNoIdentity {
+			return key, err
+		}
+	}
+	return "", ErrNoIdentity
+}
+
+// ResealKey replaces the stanza of sealed that the identity opens by one
+// sealed to r, leaving those of the other recipients as they are.
+// ErrNoIdentity is returned if the key was not sealed to the identity.
+func (id *Identity) ResealKey(sealed string, r *Recipient) (string, error) {
+	if !IsSealed(sealed) {
+		return "", errors.New("not a sealed key")
+	}
+	stanzas := strings.Split(sealed[len(sealPrefix):], ".")
+	for i, stanza := range stanzas {
+		key, err := id.openStanza(stanza)
+		if err == ErrNoIdentity {
+			continue
+		}
+		if err == nil {
+			stanzas[i], err = sealStanza(key, r)
+		}
+		if err != nil {
+			return "", err
+		}
+		return sealPrefix + strings.Join(stanzas, "."), nil
+	}
+	return "", ErrNoIdentity
+}
+
+// sealStanza returns the stanza of key sealed to r.
+func sealStanza(key string, r *Recipient) (string, error) {
+	ephemeral, err := GenerateIdentity()
+	if err != nil {
+		return "", err
+	}
+	aead, err := stanzaAead(&ephemeral.private, &r.public, &ephemeral.public, &r.public)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize()) // the key is never reused
+	sealed := aead.Seal(append([]byte{}, ephemeral.public[:]...), nonce, []byte(key), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openStanza returns the key sealed in stanza, or ErrNoIdentity if it was
+// sealed to another recipient.
+func (id *Identity) openStanza(stanza string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(stanza)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < 32 {
+		return "", errors.New("sealed key too short")
+	}
+	ephemeral := [32]byte{}
+	copy(ephemeral[:], b[:32])
+	aead, err := stanzaAead(&id.private, &ephemeral, &ephemeral, &id.public)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	key, err := aead.Open(nil, nonce, b[32:], nil)
+	if err != nil {
+		return "", ErrNoIdentity
+	}
+	return string(key), nil
+}
+
+// stanzaAead derives the aead sealing a key from the shared secret of
+// private and peer. The ephemeral and recipient public keys are bound to
+// the derived key.
+func stanzaAead(private, peer, ephemeral, recipient *[32]byte) (cipher.AEAD, error) {
+	shared := [32]byte{}
+	curve25519.ScalarMult(&shared, private, peer)
+	zero := [32]byte{}
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errors.New("invalid public key")
+	}
+	salt := append(append([]byte{}, ephemeral[:]...), recipient[:]...)
+	wrapKey := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte(sealInfo)), wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(wrapKey)
+}
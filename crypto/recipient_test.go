@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSealKey(t *testing.T) {
+	alice := testIdentity(t)
+	bob := testIdentity(t)
+	eve := testIdentity(t)
+	key := testKey(t)
+
+	sealed, err := SealKey(key, []*Recipient{alice.Recipient(), bob.Recipient()})
+	if err != nil {
+		t.Fatalf("could not seal: %v", err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, key) {
+		t.Errorf("unexpected sealed key %s", sealed)
+	}
+	for _, id := range []*Identity{alice, bob} {
+		unsealed, err := id.UnsealKey(sealed)
+		if err != nil {
+			t.Fatalf("could not unseal: %v", err)
+		}
+		if unsealed != key {
+			t.Errorf("unsealed key differs")
+		}
+	}
+	_, err = eve.UnsealKey(sealed)
+	if !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("expected ErrNoIdentity, got %v", err)
+	}
+
+	parsed, err := ParseIdentity(alice.String())
+	if err != nil {
+		t.Fatalf("could not parse identity: %v", err)
+	}
+	if parsed.Recipient().String() != alice.Recipient().String() {
+		t.Errorf("parsed identity differs")
+	}
+	r, err := ParseRecipient(bob.Recipient().String())
+	if err != nil || r.String() != bob.Recipient().String() {
+		t.Errorf("could not parse recipient: %v", err)
+	}
+	_, err = ParseRecipient(alice.String())
+	if err == nil {
+		t.Errorf("an identity is not a recipient")
+	}
+}
+
+func TestResealKey(t *testing.T) {
+	alice := testIdentity(t)
+	bob := testIdentity(t)
+	carol := testIdentity(t)
+	key := testKey(t)
+	sealed, err := SealKey(key, []*Recipient{alice.Recipient(), bob.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob's stanza goes to carol, alice's is kept
+	resealed, err := bob.ResealKey(sealed, carol.Recipient())
+	if err != nil {
+		t.Fatalf("could not reseal: %v", err)
+	}
+	if strings.Split(resealed, ".")[1] != strings.Split(sealed, ".")[1] {
+		t.Errorf("alice's stanza changed")
+	}
+	for _, id := range []*Identity{alice, carol} {
+		if unsealed, err := id.UnsealKey(resealed); err != nil || unsealed != key {
+			t.Errorf("could not unseal the resealed key: %v", err)
+		}
+	}
+	if _, err = bob.UnsealKey(resealed); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("expected ErrNoIdentity for bob, got %v", err)
+	}
+	if _, err = bob.ResealKey(resealed, bob.Recipient()); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("expected ErrNoIdentity resealing, got %v", err)
+	}
+}
+
+func testIdentity(t *testing.T) *Identity {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -0,0 +1,368 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SalvageMode says what Salvage writes in place of a damaged chunk.
+type SalvageMode int
+
+const (
+	// SalvageZeroFill writes zeros, so the good data keeps its offsets.
+	// Damaged chunks of unknown length are still left out.
+	SalvageZeroFill SalvageMode = iota
+	// SalvageSkip leaves damaged chunks out of the output.
+	SalvageSkip
+)
+
+// DamagedRange is plaintext that Salvage could not recover.
+type DamagedRange struct {
+	Chunk  int64 // index of the damaged chunk in the stream
+	Offset int64 // of the plaintext in the stream
+	Length int64 // of the plaintext, 0 for padding, -1 if unknown
+	Err    error
+}
+
+func (d DamagedRange) String() string {
+	switch {
+	case d.Length < 0:
+		return fmt.Sprintf("chunk %d: bytes %d to the end: %v", d.Chunk, d.Offset, d.Err)
+	case d.Length == 0:
+		return fmt.Sprintf("chunk %d: padding only: %v", d.Chunk, d.Err)
+	}
+	return fmt.Sprintf("chunk %d: bytes %d-%d: %v", d.Chunk, d.Offset, d.Offset+d.Length-1, d.Err)
+}
+
+// SalvageReport tells what Salvage recovered.
+type SalvageReport struct {
+	Chunks  int64          // sealed chunks found in the stream
+	Damaged []DamagedRange // in stream order
+	Written int64          // bytes written to out, zeros included
+}
+
+// salvagedChunk is a sealed chunk found by Salvage.
+type salvagedChunk struct {
+	offset int64  // of the sealed chunk, after its frame header
+	length int64  // of the sealed chunk, -1 if its frame is damaged
+	final  bool   // authenticated as the final chunk
+	plain  int64  // plaintext bytes of a good chunk
+	size   int64  // plaintext size of the stream from a padding trailer, or -1
+	rest   bool   // the stream can't be followed past this chunk
+	sealed []byte // the chunk rebuilt from parity, if it was damaged
+	err    error
+}
+
+// Salvage decrypts what is left of a damaged stream of size bytes in in.
+// Every chunk that still authenticates is written to out, and damaged
+// chunks are zero filled or skipped according to mode. plainSize is the
+// plaintext size if it is known from elsewhere, and -1 otherwise; it
+// gives the length of damaged chunks the stream itself can't tell. The
+// frames of compressed and padded streams are searched for past a damaged
+// frame length, and damaged chunks of streams with parity are rebuilt if
+// they can be. Only a damaged header, and errors reading in or writing
+// out, are returned as errors.
+func (e *Encryptor) Salvage(out io.Writer, in io.ReaderAt, size, plainSize int64, mode SalvageMode) (*SalvageReport, error) {
+	_, err := e.readHeader(io.NewSectionReader(in, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []salvagedChunk
+	if e.parity != 0 {
+		chunks, err = e.scanParityGroups(in, size)
+	} else if e.framed() {
+		chunks, err = e.scanFrames(in, size)
+	} else {
+		chunks, err = e.scanChunks(in, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the trailer of a padded stream has the plaintext size, and padding
+	// only follows the plaintext
+	sawPadding := false
+	for _, c := range chunks {
+		if c.err == nil && c.size >= 0 {
+			plainSize = c.size
+		}
+		if c.err == nil && e.padding != PaddingNone && c.plain == 0 {
+			sawPadding = true
+		}
+	}
+	plainAfter := make([]bool, len(chunks)) // a later chunk has plaintext
+	for i := len(chunks) - 2; i >= 0; i-- {
+		plainAfter[i] = plainAfter[i+1] || (chunks[i+1].err == nil && chunks[i+1].plain > 0)
+	}
+
+	report := &SalvageReport{Chunks: int64(len(chunks))}
+	zeros := make([]byte, e.chunkSize)
+	write := func(b []byte) error {
+		report.Written += int64(len(b))
+		return writeAll(out, b)
+	}
+	damaged := func(d DamagedRange) error {
+		report.Damaged = append(report.Damaged, d)
+		for n := d.Length; mode == SalvageZeroFill && n > 0; {
+			z := zeros
+			if n < int64(len(z)) {
+				z = z[:n]
+			}
+			err := write(z)
+			if err != nil {
+				return err
+			}
+			n -= int64(len(z))
+		}
+		return nil
+	}
+
+	var sealed, plain []byte
+	padding := false
+	for i, c := range chunks {
+		idx := int64(i)
+		padding = padding || (e.padding != PaddingNone && c.err == nil && c.plain == 0)
+		if c.err != nil {
+			d := DamagedRange{Chunk: idx, Offset: idx * e.chunkSize, Length: -1, Err: c.err}
+			switch {
+			case padding:
+				d.Length = 0
+			case plainSize >= 0:
+				d.Length = plainSize - d.Offset
+				if d.Length > e.chunkSize && !c.rest {
+					d.Length = e.chunkSize
+				}
+				if d.Length < 0 {
+					d.Offset, d.Length = plainSize, 0
+				}
+			case c.rest:
+			case plainAfter[i], e.padding == PaddingNone && i < len(chunks)-1:
+				d.Length = e.chunkSize
+			case !e.framed() && c.length >= e.Overhead:
+				d.Length = c.length - e.Overhead
+			}
+			err = damaged(d)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sealed, err = readSealed(in, sealed, c.offset, c.length)
+		if err != nil {
+			return nil, err
+		}
+		if c.sealed != nil {
+			sealed = c.sealed
+		}
+		plain, _, err = e.decodeChunk(plain[:0], sealed, idx, c.final)
+		if err != nil {
+			return nil, err // it authenticated a moment ago
+		}
+		err = write(plain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a stream whose last chunk is good but not final was truncated
+	last := len(chunks) - 1
+	if e.version >= 2 && !sawPadding && (last < 0 || (chunks[last].err == nil && !chunks[last].final)) {
+		d := DamagedRange{Chunk: int64(len(chunks)), Offset: int64(len(chunks)) * e.chunkSize, Length: -1, Err: ErrTruncated}
+		if plainSize >= 0 {
+			d.Length = plainSize - d.Offset
+		}
+		if d.Length != 0 {
+			err = damaged(d)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// scanChunks authenticates the chunks of an unframed stream, which are
+// all the same size but for the final one.
+func (e *Encryptor) scanChunks(in io.ReaderAt, end int64) ([]salvagedChunk, error) {
+	l := chunkLayout{start: e.headerSize(), end: end, sealedSize: e.chunkSize + e.Overhead}
+	chunks := make([]salvagedChunk, 0, l.count())
+	var sealed []byte
+	var err error
+	for idx := int64(0); idx < l.count(); idx++ {
+		c := salvagedChunk{size: -1}
+		c.offset, c.length = l.chunk(idx)
+		sealed, err = readSealed(in, sealed, c.offset, c.length)
+		if err != nil {
+			return nil, err
+		}
+		e.salvageChunk(&c, sealed, idx, idx == l.count()-1)
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// scanFrames authenticates the chunks of a framed stream. After a damaged
+// chunk the next frame is searched for, in case the length of the damaged
+// frame is wrong; if there is none, the length is trusted if it is
+// plausible, and otherwise the rest of the stream is given up.
+func (e *Encryptor) scanFrames(in io.ReaderAt, end int64) ([]salvagedChunk, error) {
+	chunks := make([]salvagedChunk, 0)
+	var buf []byte
+	for pos, idx := e.headerSize(), int64(0); pos < end; idx++ {
+		c, err := e.salvageFrame(in, &buf, pos, end, idx)
+		if err != nil {
+			return nil, err
+		}
+		if c.err != nil {
+			next, err := e.nextFrame(in, &buf, pos, end, idx+1)
+			if err != nil {
+				return nil, err
+			}
+			if next > 0 {
+				c.length = next - c.offset
+			} else if c.length < 0 {
+				c.length = end - c.offset
+				c.rest = true
+			}
+		}
+		chunks = append(chunks, c)
+		if c.rest {
+			break
+		}
+		pos = c.offset + c.length
+	}
+	return chunks, nil
+}
+
+// scanParityGroups authenticates the chunks of a stream with parity,
+// rebuilding those it can. The rest of the stream is given up after a
+// damaged parity block header, as the frames that follow can't be told
+// apart.
+func (e *Encryptor) scanParityGroups(in io.ReaderAt, end int64) ([]salvagedChunk, error) {
+	chunks := make([]salvagedChunk, 0)
+	var raw []byte
+	for pos, idx := e.headerSize(), int64(0); pos < end; {
+		block, frames, err := e.readParityGroup(io.NewSectionReader(in, pos, end-pos))
+		if errors.Is(err, ErrTruncated) || errors.Is(err, ErrBadChunk) {
+			chunks = append(chunks, salvagedChunk{offset: pos, length: end - pos, size: -1, rest: true, err: err})
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos += e.parityBlockSize(block)
+		for i, f := range frames {
+			c := salvagedChunk{offset: pos + int64(frameHeaderSize), length: int64(len(f) - frameHeaderSize), size: -1}
+			raw, err = readSealed(in, raw, c.offset, c.length)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(raw, f[frameHeaderSize:]) {
+				c.sealed = f[frameHeaderSize:]
+			}
+			e.salvageChunk(&c, f[frameHeaderSize:], idx, block.final && i == len(frames)-1)
+			chunks = append(chunks, c)
+			pos += int64(len(f))
+			idx++
+		}
+		if block.final {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+// salvageFrame reads the frame at pos and authenticates it as chunk idx.
+// The length of the returned chunk is -1 if the frame length is not
+// plausible.
+func (e *Encryptor) salvageFrame(in io.ReaderAt, buf *[]byte, pos, end, idx int64) (salvagedChunk, error) {
+	c := salvagedChunk{offset: pos + int64(frameHeaderSize), length: -1, size: -1}
+	if c.offset > end {
+		c.offset, c.err = end, ErrTruncated
+		return c, nil
+	}
+	size, err := readSealed(in, nil, pos, int64(frameHeaderSize))
+	if err != nil {
+		return c, err
+	}
+	length := int64(binary.LittleEndian.Uint32(size))
+	if length < e.Overhead || length > e.maxSealedSize() || c.offset+length > end {
+		c.err = fmt.Errorf("%w: size %d", ErrBadChunk, length)
+		return c, nil
+	}
+	c.length = length
+	*buf, err = readSealed(in, *buf, c.offset, c.length)
+	if err != nil {
+		return c, err
+	}
+	e.salvageChunk(&c, *buf, idx, c.offset+c.length == end)
+	return c, nil
+}
+
+// nextFrame searches the frames that could follow a damaged frame at pos
+// for one that authenticates as chunk idx, and returns its position, or 0
+// if there is none.
+func (e *Encryptor) nextFrame(in io.ReaderAt, buf *[]byte, pos, end, idx int64) (int64, error) {
+	first := pos + int64(frameHeaderSize) + e.Overhead
+	if first >= end {
+		return 0, nil
+	}
+	window, err := readSealed(in, nil, first, min64(end-first, e.maxSealedSize()-e.Overhead+int64(frameHeaderSize)))
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i+frameHeaderSize <= len(window); i++ {
+		next := first + int64(i)
+		length := int64(binary.LittleEndian.Uint32(window[i:]))
+		if length < e.Overhead || length > e.maxSealedSize() || next+int64(frameHeaderSize)+length > end {
+			continue
+		}
+		c, err := e.salvageFrame(in, buf, next, end, idx)
+		if err != nil {
+			return 0, err
+		}
+		if c.err == nil {
+			return next, nil
+		}
+	}
+	return 0, nil
+}
+
+// salvageChunk decodes sealed chunk idx to tell whether it is good. A
+// chunk that only authenticates with the opposite final flag is good too,
+// as a truncated or extended stream is reported separately.
+func (e *Encryptor) salvageChunk(c *salvagedChunk, sealed []byte, idx int64, last bool) {
+	c.final = last
+	plain, size, err := e.decodeChunk(nil, sealed, idx, last)
+	if err != nil && e.version >= 2 && (errors.Is(err, ErrTruncated) || errors.Is(err, ErrTrailingData)) {
+		var err2 error
+		plain, size, err2 = e.decodeChunk(nil, sealed, idx, !last)
+		if err2 == nil {
+			c.final, err = !last, nil
+		}
+	}
+	c.plain, c.size, c.err = int64(len(plain)), size, err
+}
+
+// readSealed reads length bytes at offset of in into buf.
+func readSealed(in io.ReaderAt, buf []byte, offset, length int64) ([]byte, error) {
+	if int64(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	n, err := in.ReadAt(buf, offset)
+	if err != nil && !(err == io.EOF && n == len(buf)) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
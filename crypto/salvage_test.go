@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// salvage salvages b with a fresh decryptor.
+func salvage(t *testing.T, b []byte, plainSize int64, mode SalvageMode) ([]byte, *SalvageReport) {
+	out := &bytes.Buffer{}
+	report, err := testEncryptor().Salvage(out, bytes.NewReader(b), int64(len(b)), plainSize, mode)
+	if err != nil {
+		t.Fatalf("could not salvage: %v", err)
+	}
+	if report.Written != int64(out.Len()) {
+		t.Errorf("reported %d bytes written, wrote %d", report.Written, out.Len())
+	}
+	return out.Bytes(), report
+}
+
+// zeroed returns a copy of b with length bytes at offset set to zero.
+func zeroed(b []byte, offset, length int64) []byte {
+	z := append([]byte{}, b...)
+	copy(z[offset:offset+length], make([]byte, length))
+	return z
+}
+
+func TestSalvage(t *testing.T) {
+	c := ChunkSize
+	plain := testPlaintext(3*int(c) + 100)
+	ciphertext := &bytes.Buffer{}
+	enc := testEncryptor()
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	full := ciphertext.Bytes()
+	start := enc.headerSize()
+	sealed := c + enc.Overhead
+
+	out, report := salvage(t, full, -1, SalvageZeroFill)
+	if !bytes.Equal(out, plain) || len(report.Damaged) != 0 || report.Chunks != 4 {
+		t.Errorf("undamaged stream salvaged with %v", report.Damaged)
+	}
+
+	// a flipped bit in chunk 1
+	damaged := append([]byte{}, full...)
+	damaged[start+sealed+10] ^= 1
+	out, report = salvage(t, damaged, -1, SalvageZeroFill)
+	if !bytes.Equal(out, zeroed(plain, c, c)) {
+		t.Errorf("chunk 1 not zero filled")
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].Chunk != 1 || report.Damaged[0].Offset != c ||
+		report.Damaged[0].Length != c || !errors.Is(report.Damaged[0].Err, ErrAuthFailed) {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+	out, _ = salvage(t, damaged, -1, SalvageSkip)
+	if !bytes.Equal(out, append(append([]byte{}, plain[:c]...), plain[2*c:]...)) {
+		t.Errorf("chunk 1 not skipped")
+	}
+
+	// a flipped bit in the final chunk, whose length the stream tells
+	damaged = append([]byte{}, full...)
+	damaged[len(damaged)-1] ^= 1
+	out, report = salvage(t, damaged, -1, SalvageZeroFill)
+	if !bytes.Equal(out, zeroed(plain, 3*c, 100)) || len(report.Damaged) != 1 || report.Damaged[0].Length != 100 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+
+	// the final chunk lost, its length known from elsewhere
+	out, report = salvage(t, full[:start+3*sealed], int64(len(plain)), SalvageZeroFill)
+	if !bytes.Equal(out, zeroed(plain, 3*c, 100)) || len(report.Damaged) != 1 ||
+		!errors.Is(report.Damaged[0].Err, ErrTruncated) || report.Damaged[0].Chunk != 3 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+	out, report = salvage(t, full[:start+3*sealed], -1, SalvageZeroFill)
+	if !bytes.Equal(out, plain[:3*c]) || len(report.Damaged) != 1 || report.Damaged[0].Length != -1 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+
+	// a damaged header can't be salvaged
+	damaged = append([]byte{}, full...)
+	damaged[0] = 'x'
+	_, err = testEncryptor().Salvage(&bytes.Buffer{}, bytes.NewReader(damaged), int64(len(damaged)), -1, SalvageZeroFill)
+	if !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected ErrBadHeader, got %v", err)
+	}
+}
+
+func TestSalvageFramed(t *testing.T) {
+	c := ChunkSize
+	plain := testPlaintext(3*int(c) + 100)
+	ciphertext := &bytes.Buffer{}
+	enc := testEncryptor()
+	enc.SetPadding(PaddingPadme)
+	_, err := enc.Encrypt(ciphertext, bytes.NewReader(plain), true)
+	if err != nil {
+		t.Fatalf("could not encrypt: %v", err)
+	}
+	full := ciphertext.Bytes()
+	frame := int64(frameHeaderSize) + c + enc.Overhead
+	chunk1 := enc.headerSize() + frame
+
+	// the length of frame 1 is damaged, so frame 2 has to be searched for
+	damaged := append([]byte{}, full...)
+	binary.LittleEndian.PutUint32(damaged[chunk1:], 0xffffffff)
+	out, report := salvage(t, damaged, -1, SalvageZeroFill)
+	if !bytes.Equal(out, zeroed(plain, c, c)) {
+		t.Errorf("chunk 1 not zero filled")
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].Chunk != 1 || report.Damaged[0].Length != c {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+
+	// a wrong but plausible length
+	damaged = append([]byte{}, full...)
+	binary.LittleEndian.PutUint32(damaged[chunk1:], 100)
+	out, report = salvage(t, damaged, -1, SalvageZeroFill)
+	if !bytes.Equal(out, zeroed(plain, c, c)) || len(report.Damaged) != 1 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+
+	// the padding trailer is damaged, so the size of the final plaintext
+	// chunk is unknown unless it is given
+	damaged = append([]byte{}, full...)
+	damaged[len(damaged)-1] ^= 1
+	damaged[chunk1+2*frame+10] ^= 1
+	_, report = salvage(t, damaged, -1, SalvageZeroFill)
+	if len(report.Damaged) != 2 || report.Damaged[0].Chunk != 3 || report.Damaged[0].Length != -1 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+	out, report = salvage(t, damaged, int64(len(plain)), SalvageZeroFill)
+	if !bytes.Equal(out, zeroed(plain, 3*c, 100)) || len(report.Damaged) != 2 || report.Damaged[1].Length != 0 {
+		t.Errorf("unexpected damage %v", report.Damaged)
+	}
+}
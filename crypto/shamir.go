@@ -0,0 +1,197 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A share is the text form of
+//
+//	version (1) | threshold (1) | x (1) | set id (4) | master key id (8) |
+//	y (32) | checksum (8)
+//
+// in base32, where y is the value at x of a random polynomial over
+// GF(256) per key byte, whose constant term is that byte of the master
+// key, and the checksum is the start of the SHA-256 of everything before
+// it. The 55 bytes are a whole number of base32 characters, so every
+// character is covered by the checksum. Any threshold shares of one
+// split recover the key; fewer reveal nothing about it.
+const (
+	shareVersion  = 1
+	shareSetSize  = 4
+	shareIDSize   = 8
+	shareSumSize  = 8
+	shareKeySize  = 256 / 8
+	shareSize     = 3 + shareSetSize + shareIDSize + shareKeySize + shareSumSize
+	shareGroupLen = 4 // characters per group of the text form
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Share is one share of a split master key.
+type Share struct {
+	Threshold int
+	X         int // 1 to the number of shares
+	set       []byte
+	keyID     []byte
+	y         []byte
+}
+
+// SplitMasterKey splits m into n shares, any k of which recover it.
+func SplitMasterKey(m *MasterKey, k, n int) ([]*Share, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares", k, n)
+	}
+	keyID, err := hex.DecodeString(m.ID)
+	if err != nil || len(keyID) != shareIDSize || len(m.key) != shareKeySize {
+		return nil, errors.New("invalid master key")
+	}
+	set := make([]byte, shareSetSize)
+	coeffs := make([]byte, len(m.key)*(k-1))
+	_, err = rand.Read(set)
+	if err == nil {
+		_, err = rand.Read(coeffs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]*Share, n)
+	for i := range shares {
+		x := byte(i + 1)
+		y := make([]byte, len(m.key))
+		for b, secret := range m.key {
+			// Horner's rule, highest coefficient first
+			v := byte(0)
+			for c := k - 2; c >= 0; c-- {
+				v = gfMul(v, x) ^ coeffs[b*(k-1)+c]
+			}
+			y[b] = gfMul(v, x) ^ secret
+		}
+		shares[i] = &Share{Threshold: k, X: int(x), set: set, keyID: keyID, y: y}
+	}
+	return shares, nil
+}
+
+// CombineShares recovers the master key from at least threshold shares.
+func CombineShares(shares []*Share) (*MasterKey, error) {
+	if len(shares) == 0 {
+		return nil, ErrNotEnoughShares
+	}
+	first := shares[0]
+	seen := make(map[int]bool)
+	for _, s := range shares {
+		if s.Threshold != first.Threshold || !bytes.Equal(s.set, first.set) || !bytes.Equal(s.keyID, first.keyID) {
+			return nil, ErrShareMismatch
+		}
+		seen[s.X] = true
+	}
+	if len(seen) < first.Threshold {
+		return nil, ErrNotEnoughShares
+	}
+
+	// Lagrange interpolation at 0 with the first threshold distinct shares
+	points := make([]*Share, 0, first.Threshold)
+	for _, s := range shares {
+		if len(points) < first.Threshold && seen[s.X] {
+			points = append(points, s)
+			delete(seen, s.X)
+		}
+	}
+	key := make([]byte, shareKeySize)
+	for i, p := range points {
+		basis := byte(1)
+		for j, q := range points {
+			if i != j {
+				// x_j / (x_j - x_i), subtraction being xor
+				basis = gfMul(basis, gfDiv(byte(q.X), byte(q.X)^byte(p.X)))
+			}
+		}
+		for b := range key {
+			key[b] ^= gfMul(basis, p.y[b])
+		}
+	}
+	m, err := newMasterKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID != hex.EncodeToString(first.keyID) {
+		return nil, ErrShareMismatch
+	}
+	return m, nil
+}
+
+// String returns the share as base32 in groups of four characters.
+func (s *Share) String() string {
+	b := make([]byte, 0, shareSize)
+	b = append(b, shareVersion, byte(s.Threshold), byte(s.X))
+	b = append(b, s.set...)
+	b = append(b, s.keyID...)
+	b = append(b, s.y...)
+	sum := sha256.Sum256(b)
+	b = append(b, sum[:shareSumSize]...)
+	text := shareEncoding.EncodeToString(b)
+	groups := make([]string, 0, len(text)/shareGroupLen+1)
+	for len(text) > shareGroupLen {
+		groups = append(groups, text[:shareGroupLen])
+		text = text[shareGroupLen:]
+	}
+	return strings.Join(append(groups, text), " ")
+}
+
+// ParseShare parses the text form of a share. Case, spaces and dashes
+// are ignored. ErrShareChecksum is returned if the share is damaged.
+func ParseShare(text string) (*Share, error) {
+	text = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '\t' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(text))
+	b, err := shareEncoding.DecodeString(text)
+	if err != nil || len(b) != shareSize {
+		return nil, ErrShareChecksum
+	}
+	sum := sha256.Sum256(b[:shareSize-shareSumSize])
+	if !bytes.Equal(sum[:shareSumSize], b[shareSize-shareSumSize:]) {
+		return nil, ErrShareChecksum
+	}
+	if b[0] != shareVersion {
+		return nil, fmt.Errorf("unsupported share version %d", b[0])
+	}
+	s := &Share{Threshold: int(b[1]), X: int(b[2])}
+	if s.Threshold < 2 || s.X == 0 {
+		return nil, errors.New("invalid share")
+	}
+	b = b[3:]
+	s.set, b = b[:shareSetSize], b[shareSetSize:]
+	s.keyID, b = b[:shareIDSize], b[shareIDSize:]
+	s.y = b[:shareKeySize]
+	return s, nil
+}
+
+// gfMul multiplies in GF(256) with the AES polynomial, in constant time.
+func gfMul(a, b byte) byte {
+	p := byte(0)
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfDiv divides a by b, which must not be 0, as a times b^254.
+func gfDiv(a, b byte) byte {
+	inv := byte(1)
+	for i := 0; i < 254; i++ {
+		inv = gfMul(inv, b)
+	}
+	return gfMul(a, inv)
+}
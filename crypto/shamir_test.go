@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	master := testMasterKey(t, "correct horse")
+	shares, err := SplitMasterKey(master, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := make([]*Share, len(shares))
+	for i, s := range shares {
+		// shares are typed back in with other spacing and case
+		text := strings.ToLower(strings.Replace(s.String(), " ", "-", -1))
+		parsed[i], err = ParseShare(text)
+		if err != nil {
+			t.Fatalf("could not parse share %d: %v", i, err)
+		}
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		picked := []*Share{}
+		for _, i := range subset {
+			picked = append(picked, parsed[i])
+		}
+		m, err := CombineShares(picked)
+		if err != nil {
+			t.Errorf("could not combine %v: %v", subset, err)
+		} else if string(m.key) != string(master.key) || m.ID != master.ID {
+			t.Errorf("shares %v combine to a different key", subset)
+		}
+	}
+	if _, err := CombineShares([]*Share{parsed[0], parsed[1], parsed[1]}); err != ErrNotEnoughShares {
+		t.Errorf("expected ErrNotEnoughShares, got %v", err)
+	}
+
+	other, _ := SplitMasterKey(master, 3, 5)
+	if _, err := CombineShares([]*Share{parsed[0], parsed[1], other[2]}); err != ErrShareMismatch {
+		t.Errorf("expected ErrShareMismatch, got %v", err)
+	}
+
+	// every single character change is detected
+	text := strings.Replace(shares[2].String(), " ", "", -1)
+	for i := range text {
+		c := byte('A')
+		if text[i] == 'A' {
+			c = 'B'
+		}
+		damaged := text[:i] + string(c) + text[i+1:]
+		if _, err := ParseShare(damaged); err == nil {
+			t.Errorf("damaged share accepted: %s", damaged)
+		}
+	}
+	if _, err := SplitMasterKey(master, 1, 5); err == nil {
+		t.Errorf("expected error for a threshold of 1")
+	}
+}
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(gfDiv(1, byte(a)), byte(a)) != 1 {
+			t.Fatalf("no inverse of %d", a)
+		}
+	}
+	if gfMul(0x57, 0x83) != 0xc1 {
+		t.Errorf("unexpected product %x", gfMul(0x57, 0x83))
+	}
+}
@@ -1,7 +1,17 @@
 module github.com/timothyham/bbackup
 
+go 1.27.1
+
 require (
+	github.com/klauspost/compress v1.11.13
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/mattn/go-sqlite3 v1.9.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.0.0-20180806190021-80fca2ff14a3
-	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8 // indirect
+	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8
+	lukechampine.com/blake3 v1.0.0
+)
+
+require (
+	github.com/klauspost/cpuid v1.3.1 // indirect
 )
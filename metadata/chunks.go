@@ -0,0 +1,267 @@
+package info
+
+import (
+	"database/sql"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+const (
+	ChunkTableName     = "chunks"
+	FileChunkTableName = "filechunks"
+	chunkColumns       = "chunkid, encname, encformat, key, iv, size"
+	selectChunkQuery   = "select id, " + chunkColumns + " from " + ChunkTableName
+)
+
+// config table keys of the dedup key, wrapped with the master key and
+// sealed to the recipients of the db
+const (
+	dedupKeyKey       = "dedup.key"
+	dedupSealedKeyKey = "dedup.sealed"
+)
+
+// Chunk is a piece of the content of deduplicated files. Each chunk is
+// stored once, as its own object, however many files contain it.
+type Chunk struct {
+	ID      int64
+	ChunkID string // crypto.DedupKey.ChunkID() of the plaintext
+
+	Encname   string
+	EncFormat int // crypto.Encryptor.Format() of the stored object
+	Key       string
+	IV        string
+	Size      int64 // plaintext bytes
+}
+
+// DedupKey returns the dedup key of the db, creating it on first use.
+// It is never stored in the clear: it is wrapped with the master key and,
+// if the db has recipients, sealed to them and to the identity of the
+// master key, so reading it needs the master key unlocked or the identity
+// of a recipient. A db with recipients creates it while locked too.
+// ErrLocked is returned if the key can't be read or stored, or
+// crypto.ErrNoIdentity for a db without a master key.
+func (db *Db) DedupKey() (*crypto.DedupKey, error) {
+	wrapped, err := db.dedupConfig(dedupKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := db.dedupConfig(dedupSealedKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	var s string
+	for _, stored := range []string{wrapped, sealed} {
+		if stored == "" {
+			continue
+		}
+		s, err = db.unwrapKey(stored)
+		if err != nil {
+			return nil, err
+		}
+		if !crypto.IsWrapped(s) && !crypto.IsSealed(s) {
+			break
+		}
+		s = ""
+	}
+	var key *crypto.DedupKey
+	switch {
+	case s != "":
+		key, err = crypto.ParseDedupKey(s)
+	case wrapped == "" && sealed == "":
+		key, err = crypto.NewDedupKey()
+	case !db.HasMasterKey():
+		return nil, crypto.ErrNoIdentity
+	default:
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, db.storeDedupKey(key, wrapped, sealed)
+}
+
+// dedupConfig returns the config value name, or "" if it is not set.
+func (db *Db) dedupConfig(name string) (string, error) {
+	value, err := db.GetConfig(name)
+	if err == NoResultError {
+		return "", nil
+	}
+	return value, err
+}
+
+// storeDedupKey stores the forms of key missing from wrapped and sealed,
+// the ones stored, as far as the db can: wrapping it needs the master key
+// unlocked, and sealing it recipients. A key stored in the clear by an
+// older version is replaced.
+func (db *Db) storeDedupKey(key *crypto.DedupKey, wrapped, sealed string) error {
+	stored := crypto.IsWrapped(wrapped) || crypto.IsSealed(sealed)
+	clear := wrapped != "" && !crypto.IsWrapped(wrapped)
+	if db.master != nil && !crypto.IsWrapped(wrapped) {
+		w, err := db.master.WrapKey(key.String())
+		if err == nil {
+			err = db.SetConfig(dedupKeyKey, w)
+		}
+		if err != nil {
+			return err
+		}
+		stored, clear = true, false
+	}
+	if !crypto.IsSealed(sealed) {
+		s, ok, err := db.sealKey(key.String())
+		if err == nil && ok {
+			err = db.SetConfig(dedupSealedKeyKey, s)
+			stored = true
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !stored {
+		if db.HasMasterKey() {
+			return ErrLocked
+		}
+		return ErrNoMasterKey
+	}
+	if clear {
+		return db.DeleteConfig(dedupKeyKey)
+	}
+	return nil
+}
+
+// GetChunk returns the chunk with chunkID, or NoResultError.
+func (db *Db) GetChunk(chunkID string) (*Chunk, error) {
+	rows, err := db.db.Query(selectChunkQuery+" where chunkid = ?", chunkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, NoResultError
+	}
+	return db.scanChunk(rows)
+}
+
+// InsertChunk stores c and sets its ID.
+func (db *Db) InsertChunk(c *Chunk) error {
+	key, err := db.wrapKey(c.Key)
+	if err != nil {
+		return err
+	}
+	res, err := db.db.Exec("insert into "+ChunkTableName+" ("+chunkColumns+") values (?,?,?,?,?,?)",
+		c.ChunkID, c.Encname, c.EncFormat, key, c.IV, c.Size)
+	if err != nil {
+		return err
+	}
+	c.ID, err = res.LastInsertId()
+	return err
+}
+
+// InsertChunked inserts or updates m as a deduplicated file made of
+// chunks, which must have been inserted. The info and its chunk list are
+// stored in one transaction.
+func (db *Db) InsertChunked(m *Info, chunks []*Chunk) error {
+	values, err := db.infoValues(m)
+	if err != nil {
+		return err
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = insertChunkedTx(tx, m, values, chunks)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertChunkedTx(tx *sql.Tx, m *Info, values []interface{}, chunks []*Chunk) error {
+	if m.ID == 0 {
+		res, err := tx.Exec("insert into "+InfoTableName+" ("+infoColumns+") values "+
+			infoPlaceholders, values...)
+		if err != nil {
+			return err
+		}
+		m.ID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := tx.Exec("update "+InfoTableName+" set ("+infoColumns+") = "+
+			infoPlaceholders+" where id = ?", append(values, m.ID)...)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("delete from "+FileChunkTableName+" where info = ?", m.ID)
+		if err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare("insert into " + FileChunkTableName + " (info, seq, chunk) values (?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for seq, c := range chunks {
+		_, err = stmt.Exec(m.ID, seq, c.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileChunks returns the chunks of the deduplicated file m in order.
+func (db *Db) FileChunks(m *Info) ([]*Chunk, error) {
+	rows, err := db.db.Query("select c.id, c.chunkid, c.encname, c.encformat, c.key, c.iv, c.size"+
+		" from "+FileChunkTableName+" f join "+ChunkTableName+" c on c.id = f.chunk"+
+		" where f.info = ? order by f.seq", m.ID)
+	if err != nil {
+		return nil, err
+	}
+	return db.scanChunks(rows)
+}
+
+// UnreferencedChunks returns the chunks no file refers to any more.
+func (db *Db) UnreferencedChunks() ([]*Chunk, error) {
+	rows, err := db.db.Query(selectChunkQuery + " where id not in" +
+		" (select chunk from " + FileChunkTableName + ")")
+	if err != nil {
+		return nil, err
+	}
+	return db.scanChunks(rows)
+}
+
+// DeleteChunk removes c. Its object has to be removed separately.
+func (db *Db) DeleteChunk(c *Chunk) error {
+	_, err := db.db.Exec("delete from "+ChunkTableName+" where id = ?", c.ID)
+	return err
+}
+
+// scanChunks converts rows into chunks and closes them.
+func (db *Db) scanChunks(rows *sql.Rows) ([]*Chunk, error) {
+	defer rows.Close()
+	chunks := make([]*Chunk, 0)
+	for rows.Next() {
+		c, err := db.scanChunk(rows)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+func (db *Db) scanChunk(rows *sql.Rows) (*Chunk, error) {
+	c := &Chunk{}
+	err := rows.Scan(&c.ID, &c.ChunkID, &c.Encname, &c.EncFormat, &c.Key, &c.IV, &c.Size)
+	if err != nil {
+		return nil, err
+	}
+	c.Key, err = db.unwrapKey(c.Key)
+	return c, err
+}
@@ -0,0 +1,200 @@
+package info
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+func TestChunks(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	if _, err := db.DedupKey(); err != ErrNoMasterKey {
+		t.Errorf("expected ErrNoMasterKey, got %v", err)
+	}
+	err := db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedup, err := db.DedupKey()
+	if err != nil {
+		t.Fatalf("could not create dedup key: %v", err)
+	}
+
+	chunks := []*Chunk{}
+	for _, content := range []string{"first", "second"} {
+		c := &Chunk{ChunkID: dedup.ChunkID([]byte(content)), Encname: content,
+			Key: testKey(t), Size: int64(len(content))}
+		err = db.InsertChunk(c)
+		if err != nil {
+			t.Fatalf("could not insert chunk: %v", err)
+		}
+		chunks = append(chunks, c)
+	}
+	if err = db.InsertChunk(&Chunk{ChunkID: chunks[0].ChunkID}); err == nil {
+		t.Errorf("expected a chunk to be stored only once")
+	}
+	c, err := db.GetChunk(chunks[1].ChunkID)
+	if err != nil || *c != *chunks[1] {
+		t.Errorf("unexpected chunk %+v: %v", c, err)
+	}
+
+	// the same chunk twice, and an update to a single chunk
+	m := &Info{Name: "file"}
+	err = db.InsertChunked(m, []*Chunk{chunks[0], chunks[1], chunks[0]})
+	if err != nil || m.ID == 0 {
+		t.Fatalf("could not insert chunked file: %v", err)
+	}
+	got, err := db.FileChunks(m)
+	if err != nil || len(got) != 3 || got[1].ID != chunks[1].ID || got[2].ID != chunks[0].ID {
+		t.Errorf("unexpected file chunks %v: %v", got, err)
+	}
+	err = db.InsertChunked(m, []*Chunk{chunks[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreferenced, err := db.UnreferencedChunks()
+	if err != nil || len(unreferenced) != 1 || unreferenced[0].ID != chunks[1].ID {
+		t.Errorf("unexpected unreferenced chunks %v: %v", unreferenced, err)
+	}
+
+	// keys survive a passphrase change
+	err = db.ChangePassphrase("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	err = db.Unlock("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := db.DedupKey()
+	if err != nil || again.String() != dedup.String() {
+		t.Errorf("dedup key changed: %v", err)
+	}
+	c, err = db.GetChunk(chunks[0].ChunkID)
+	if err != nil || c.Key != chunks[0].Key {
+		t.Errorf("chunk key changed: %v", err)
+	}
+
+	err = db.Delete(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreferenced, _ = db.UnreferencedChunks()
+	if len(unreferenced) != 2 {
+		t.Errorf("expected all chunks unreferenced, got %v", unreferenced)
+	}
+}
+
+func TestDedupKeyRecipients(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wrapped while the db has no recipients
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedup, err := db.DedupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	if _, err = db.DedupKey(); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+
+	// sealed once read unlocked, so backups to the recipients can read it
+	// with an identity instead of the passphrase
+	err = db.Unlock("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.DedupKey(); err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	if _, err = db.DedupKey(); err != ErrLocked {
+		t.Errorf("expected ErrLocked without identity, got %v", err)
+	}
+	db.SetIdentity(id)
+	again, err := db.DedupKey()
+	if err != nil || again.String() != dedup.String() {
+		t.Errorf("dedup key changed: %v", err)
+	}
+	db.SetIdentity(nil)
+	err = db.Unlock("correct horse")
+	if err == nil {
+		err = db.ChangePassphrase("battery staple")
+	}
+	if err != nil {
+		t.Fatalf("could not change passphrase: %v", err)
+	}
+	for _, name := range []string{dedupKeyKey, dedupSealedKeyKey} {
+		stored, err := db.GetConfig(name)
+		if err != nil || strings.Contains(stored, dedup.String()) {
+			t.Errorf("dedup key stored as %q: %v", stored, err)
+		}
+	}
+	// the passphrase still reads it while locked, through the sealed key
+	db.Lock()
+	err = db.Unlock("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteConfig(dedupKeyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err = db.DedupKey(); err != nil || again.String() != dedup.String() {
+		t.Errorf("dedup key changed after passphrase change: %v", err)
+	}
+
+	// a new db with only recipients
+	other, cleanupOther := tempDb(t)
+	defer cleanupOther()
+	err = other.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := other.DedupKey()
+	if err != nil {
+		t.Fatalf("could not create dedup key with recipients: %v", err)
+	}
+	if _, err = other.DedupKey(); err != crypto.ErrNoIdentity {
+		t.Errorf("expected ErrNoIdentity without identity, got %v", err)
+	}
+	other.SetIdentity(id)
+	if again, err = other.DedupKey(); err != nil || again.String() != created.String() {
+		t.Errorf("dedup key changed: %v", err)
+	}
+
+	// a key an older version stored in the clear is sealed instead
+	err = other.SetConfig(dedupKeyKey, dedup.String())
+	if err == nil {
+		err = other.DeleteConfig(dedupSealedKeyKey)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err = other.DedupKey(); err != nil || again.String() != dedup.String() {
+		t.Errorf("clear dedup key not read: %v", err)
+	}
+	if _, err = other.GetConfig(dedupKeyKey); err != NoResultError {
+		t.Errorf("clear dedup key kept: %v", err)
+	}
+	if again, err = other.DedupKey(); err != nil || again.String() != dedup.String() {
+		t.Errorf("dedup key changed after sealing: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package info
+
+import (
+	"database/sql"
+)
+
+// GetConfig returns the value stored under key in the config table, or
+// NoResultError if there is none.
+func (db *Db) GetConfig(key string) (string, error) {
+	query := "select value from " + ConfigTableName + " where key = ?"
+	var value string
+	err := db.db.QueryRow(query, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", NoResultError
+	}
+	return value, err
+}
+
+// SetConfig stores value under key in the config table, replacing any
+// previous value.
+func (db *Db) SetConfig(key, value string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = setConfigTx(tx, key, value)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteConfig removes key from the config table.
+func (db *Db) DeleteConfig(key string) error {
+	_, err := db.db.Exec("delete from "+ConfigTableName+" where key = ?", key)
+	return err
+}
+
+func setConfigTx(tx *sql.Tx, key, value string) error {
+	_, err := tx.Exec("delete from "+ConfigTableName+" where key = ?", key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into "+ConfigTableName+" (key, value) values (?,?)", key, value)
+	return err
+}
+
+// configWithPrefix returns all config values whose key starts with prefix,
+// keyed by the rest of the key.
+func (db *Db) configWithPrefix(prefix string) (map[string]string, error) {
+	query := "select key, value from " + ConfigTableName + " where substr(key, 1, ?) = ?"
+	rows, err := db.db.Query(query, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		values[key[len(prefix):]] = value
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,422 @@
+package info
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+// config table keys for the master key
+const (
+	masterSaltKey    = "master.salt"
+	masterTimeKey    = "master.time"
+	masterMemoryKey  = "master.memory"
+	masterThreadsKey = "master.threads"
+	masterIDKey      = "master.id"
+	// the recipient of the identity of the master key, which keys are
+	// sealed to along with the recipients of the db
+	masterRecipientKey = "master.recipient"
+)
+
+// ErrLocked is returned when a key has to be wrapped or unwrapped but the
+// master key has not been unlocked.
+var ErrLocked = errors.New("master key is locked")
+
+// ErrMasterKeyExists is returned by InitMasterKey if the database already
+// has a master key.
+var ErrMasterKeyExists = errors.New("master key already exists")
+
+// ErrNoMasterKey is returned by Unlock if the database has no master key.
+var ErrNoMasterKey = errors.New("no master key")
+
+// HasMasterKey reports whether a master key has been set up.
+func (db *Db) HasMasterKey() bool {
+	_, err := db.GetConfig(masterIDKey)
+	return err == nil
+}
+
+// InitMasterKey derives a new master key from passphrase and stores its
+// salt, parameters and id in the config table. The db is left unlocked.
+func (db *Db) InitMasterKey(passphrase string) error {
+	if db.HasMasterKey() {
+		return ErrMasterKeyExists
+	}
+	params, err := crypto.NewKDFParams()
+	if err != nil {
+		return err
+	}
+	master, err := crypto.DeriveMasterKey(passphrase, params)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = setMasterConfigTx(tx, params, master)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	db.master = master
+	return nil
+}
+
+// KDFParams returns the stored parameters of the master key.
+func (db *Db) KDFParams() (crypto.KDFParams, error) {
+	params := crypto.KDFParams{}
+	salt, err := db.GetConfig(masterSaltKey)
+	if err == NoResultError {
+		return params, ErrNoMasterKey
+	}
+	if err != nil {
+		return params, err
+	}
+	params.Salt, err = base64.RawURLEncoding.DecodeString(salt)
+	if err != nil {
+		return params, err
+	}
+	values := []struct {
+		key  string
+		bits int
+		set  func(uint64)
+	}{
+		{masterTimeKey, 32, func(v uint64) { params.Time = uint32(v) }},
+		{masterMemoryKey, 32, func(v uint64) { params.Memory = uint32(v) }},
+		{masterThreadsKey, 8, func(v uint64) { params.Threads = uint8(v) }},
+	}
+	for _, v := range values {
+		s, err := db.GetConfig(v.key)
+		if err != nil {
+			return params, err
+		}
+		n, err := strconv.ParseUint(s, 10, v.bits)
+		if err != nil {
+			return params, err
+		}
+		v.set(n)
+	}
+	return params, params.Check()
+}
+
+// Unlock derives the master key from passphrase. crypto.ErrWrongPassphrase
+// is returned if it does not match the stored master key.
+func (db *Db) Unlock(passphrase string) error {
+	params, err := db.KDFParams()
+	if err != nil {
+		return err
+	}
+	master, err := crypto.DeriveMasterKey(passphrase, params)
+	if err != nil {
+		return err
+	}
+	return db.UnlockWithKey(master)
+}
+
+// UnlockWithKey unlocks the db with an already derived master key.
+func (db *Db) UnlockWithKey(master *crypto.MasterKey) error {
+	id, err := db.GetConfig(masterIDKey)
+	if err == NoResultError {
+		return ErrNoMasterKey
+	}
+	if err != nil {
+		return err
+	}
+	err = master.Check(id)
+	if err != nil {
+		return err
+	}
+	// dbs from before keys were sealed to the master key learn its
+	// recipient on the first unlock
+	_, err = db.GetConfig(masterRecipientKey)
+	if err == NoResultError {
+		err = db.SetConfig(masterRecipientKey, master.Identity().Recipient().String())
+	}
+	if err != nil {
+		return err
+	}
+	db.master = master
+	return nil
+}
+
+// masterRecipient returns the recipient of the identity of the master
+// key, or nil if it is not known yet.
+func (db *Db) masterRecipient() (*crypto.Recipient, error) {
+	s, err := db.GetConfig(masterRecipientKey)
+	if err == NoResultError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ParseRecipient(s)
+}
+
+// MasterKey returns the unlocked master key, to split it into shares.
+func (db *Db) MasterKey() (*crypto.MasterKey, error) {
+	if db.master == nil {
+		if db.HasMasterKey() {
+			return nil, ErrLocked
+		}
+		return nil, ErrNoMasterKey
+	}
+	return db.master, nil
+}
+
+// PaperKey returns the unlocked master key with its parameters, to keep
+// an offline copy.
+func (db *Db) PaperKey() (*crypto.PaperKey, error) {
+	master, err := db.MasterKey()
+	if err != nil {
+		return nil, err
+	}
+	params, err := db.KDFParams()
+	if err != nil {
+		return nil, err
+	}
+	return &crypto.PaperKey{Master: master, Params: params}, nil
+}
+
+// Lock forgets the master key.
+func (db *Db) Lock() {
+	db.master = nil
+}
+
+// wrapKey wraps a per-file key before it is written. Keys are sealed if
+// the db has recipients, to them and to the identity of the master key,
+// and otherwise wrapped with the master key. ErrNoMasterKey is returned if
+// the db has neither, rather than storing the key in the clear.
+func (db *Db) wrapKey(key string) (string, error) {
+	if key == "" || crypto.IsWrapped(key) || crypto.IsSealed(key) {
+		return key, nil
+	}
+	sealed, ok, err := db.sealKey(key)
+	if ok || err != nil {
+		return sealed, err
+	}
+	if db.master == nil {
+		if db.HasMasterKey() {
+			return "", ErrLocked
+		}
+		return "", ErrNoMasterKey
+	}
+	return db.master.WrapKey(key)
+}
+
+// unwrapKey unwraps a per-file key after it is read. A locked db returns
+// wrapped keys unchanged. Sealed keys are unsealed with the master key if
+// it is unlocked and they were sealed to it, and otherwise with the
+// identity; without either they are returned unchanged.
+func (db *Db) unwrapKey(key string) (string, error) {
+	if crypto.IsSealed(key) {
+		if db.master != nil {
+			unsealed, err := db.master.Identity().UnsealKey(key)
+			if err != crypto.ErrNoIdentity {
+				return unsealed, err
+			}
+		}
+		if db.identity != nil {
+			return db.identity.UnsealKey(key)
+		}
+		return key, nil
+	}
+	if db.master == nil || !crypto.IsWrapped(key) {
+		return key, nil
+	}
+	return db.master.UnwrapKey(key)
+}
+
+func setMasterConfigTx(tx *sql.Tx, params crypto.KDFParams, master *crypto.MasterKey) error {
+	values := [][2]string{
+		{masterSaltKey, base64.RawURLEncoding.EncodeToString(params.Salt)},
+		{masterTimeKey, strconv.FormatUint(uint64(params.Time), 10)},
+		{masterMemoryKey, strconv.FormatUint(uint64(params.Memory), 10)},
+		{masterThreadsKey, strconv.FormatUint(uint64(params.Threads), 10)},
+		{masterIDKey, master.ID},
+		{masterRecipientKey, master.Identity().Recipient().String()},
+	}
+	for _, v := range values {
+		err := setConfigTx(tx, v[0], v[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangePassphrase derives a new master key from passphrase and rewraps
+// every per-file, extended attribute and chunk key, and the dedup key,
+// with it. Keys are rewrapped and the new key parameters stored in one
+// transaction, so an interrupted change leaves every key wrapped with the
+// old passphrase, and the change can simply be run again. Keys sealed to
+// recipients and the master key are sealed to the new master key instead
+// of the old; those sealed to recipients only are left as they are. If
+// the db has no master key yet, one is created and any keys stored in the
+// clear are wrapped.
+func (db *Db) ChangePassphrase(passphrase string) error {
+	if db.master == nil && db.HasMasterKey() {
+		return ErrLocked
+	}
+	params, err := crypto.NewKDFParams()
+	if err != nil {
+		return err
+	}
+	newMaster, err := crypto.DeriveMasterKey(passphrase, params)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range [][2]string{{InfoTableName, "key"}, {InfoTableName, "xattrkey"}, {ChunkTableName, "key"}} {
+		if err == nil {
+			err = db.rewrapKeysTx(tx, c[0], c[1], newMaster)
+		}
+	}
+	if err == nil {
+		err = db.rewrapDedupKeyTx(tx, newMaster)
+	}
+	if err == nil {
+		err = setMasterConfigTx(tx, params, newMaster)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	db.master = newMaster
+	return nil
+}
+
+// rewrapKeysTx unwraps every key in column of table with the current
+// master key and wraps it with newMaster, and reseals the keys sealed to
+// the current master key to newMaster.
+func (db *Db) rewrapKeysTx(tx *sql.Tx, table, column string, newMaster *crypto.MasterKey) error {
+	rows, err := tx.Query("select id, " + column + " from " + table + " where " + column + " != ''")
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id  int64
+		key string
+	}
+	pending := make([]row, 0)
+	for rows.Next() {
+		r := row{}
+		err = rows.Scan(&r.id, &r.key)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, r)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("update " + table + " set " + column + " = ? where id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range pending {
+		key := r.key
+		if crypto.IsSealed(key) {
+			if db.master == nil {
+				continue
+			}
+			key, err = db.master.Identity().ResealKey(key, newMaster.Identity().Recipient())
+			if err == crypto.ErrNoIdentity {
+				continue // sealed to recipients only
+			}
+			if err == nil {
+				_, err = stmt.Exec(key, r.id)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if crypto.IsWrapped(key) {
+			if db.master == nil {
+				return ErrLocked
+			}
+			key, err = db.master.UnwrapKey(key)
+			if err != nil {
+				return fmt.Errorf("could not unwrap key of %s row %d: %v", table, r.id, err)
+			}
+		}
+		key, err = newMaster.WrapKey(key)
+		if err == nil {
+			_, err = stmt.Exec(key, r.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrapDedupKeyTx wraps the dedup key, if there is one, with newMaster,
+// and reseals it to newMaster if it is sealed to the current master key.
+func (db *Db) rewrapDedupKeyTx(tx *sql.Tx, newMaster *crypto.MasterKey) error {
+	get := func(name string) (string, error) {
+		var value string
+		err := tx.QueryRow("select value from "+ConfigTableName+" where key = ?", name).Scan(&value)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return value, err
+	}
+	wrapped, err := get(dedupKeyKey)
+	if err != nil {
+		return err
+	}
+	if wrapped != "" {
+		key := wrapped // in the clear, from an older version
+		if crypto.IsWrapped(wrapped) {
+			if db.master == nil {
+				return ErrLocked
+			}
+			key, err = db.master.UnwrapKey(wrapped)
+			if err != nil {
+				return fmt.Errorf("could not unwrap dedup key: %v", err)
+			}
+		}
+		wrapped, err = newMaster.WrapKey(key)
+		if err == nil {
+			err = setConfigTx(tx, dedupKeyKey, wrapped)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sealed, err := get(dedupSealedKeyKey)
+	if err != nil || sealed == "" || db.master == nil {
+		return err
+	}
+	sealed, err = db.master.Identity().ResealKey(sealed, newMaster.Identity().Recipient())
+	if err == crypto.ErrNoIdentity {
+		return nil // sealed to recipients only
+	}
+	if err != nil {
+		return err
+	}
+	return setConfigTx(tx, dedupSealedKeyKey, sealed)
+}
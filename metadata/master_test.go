@@ -0,0 +1,231 @@
+package info
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+// tempDb opens a new db in a temporary directory
+func tempDb(t *testing.T) (*Db, func()) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	db := NewDb(filepath.Join(dir, "test.db"))
+	return db, func() {
+		db.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testKey returns a new random per-file key.
+func testKey(t *testing.T) string {
+	enc, err := crypto.NewEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc.GetKey()
+}
+
+func testKDFParams(t *testing.T) crypto.KDFParams {
+	params, err := crypto.NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+// testMasterKey derives a master key from passphrase with new parameters
+func testMasterKey(t *testing.T, passphrase string) *crypto.MasterKey {
+	master, err := crypto.DeriveMasterKey(passphrase, testKDFParams(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+// insertClear inserts m with its key in the clear, as dbs from before
+// the master key stored them.
+func insertClear(t *testing.T, db *Db, m *Info) {
+	key := m.Key
+	m.Key = ""
+	err := db.Insert(m)
+	if err == nil {
+		_, err = db.db.Exec("update "+InfoTableName+" set key = ? where id = ?", key, m.ID)
+	}
+	m.Key = key
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMasterKey(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	key := testKey(t)
+	err := db.Insert(&Info{Name: "plain", Encname: "plain", Key: key})
+	if err != ErrNoMasterKey {
+		t.Errorf("expected ErrNoMasterKey inserting without master key, got %v", err)
+	}
+	insertClear(t, db, &Info{Name: "plain", Encname: "plain", Key: key})
+
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatalf("could not init master key: %v", err)
+	}
+	if db.InitMasterKey("again") != ErrMasterKeyExists {
+		t.Errorf("expected ErrMasterKeyExists")
+	}
+
+	err = db.Insert(&Info{Name: "wrapped", Encname: "wrapped", Key: key})
+	if err != nil {
+		t.Fatalf("could not insert: %v", err)
+	}
+	var stored string
+	err = db.db.QueryRow("select key from "+InfoTableName+" where name = ?", "wrapped").Scan(&stored)
+	if err != nil {
+		t.Fatalf("could not read raw key: %v", err)
+	}
+	if !crypto.IsWrapped(stored) {
+		t.Errorf("key stored in the clear: %s", stored)
+	}
+	m, err := db.GetByName("wrapped")
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if m.Key != key {
+		t.Errorf("key was not unwrapped")
+	}
+
+	db.Lock()
+	err = db.Insert(&Info{Name: "locked", Encname: "locked", Key: key})
+	if err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	m, err = db.GetByName("wrapped")
+	if err != nil {
+		t.Fatalf("could not read locked: %v", err)
+	}
+	if m.Key != stored {
+		t.Errorf("locked db should return the wrapped key")
+	}
+
+	err = db.Unlock("battery staple")
+	if err != crypto.ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	err = db.Unlock("correct horse")
+	if err != nil {
+		t.Fatalf("could not unlock: %v", err)
+	}
+	m, err = db.GetByName("wrapped")
+	if err != nil || m.Key != key {
+		t.Errorf("could not unwrap after unlock: %v", err)
+	}
+	m, err = db.GetByName("plain")
+	if err != nil || m.Key != key {
+		t.Errorf("could not read key stored before the master key: %v", err)
+	}
+
+	// parameters in the config that would make deriving the key panic
+	err = db.SetConfig(masterThreadsKey, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Unlock("correct horse")
+	if !errors.Is(err, crypto.ErrBadKDFParams) {
+		t.Errorf("expected ErrBadKDFParams, got %v", err)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	keys := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		keys[name] = testKey(t)
+		insertClear(t, db, &Info{Name: name, Encname: name, Key: keys[name]})
+	}
+
+	// without a master key, the clear keys get wrapped
+	err := db.ChangePassphrase("first")
+	if err != nil {
+		t.Fatalf("could not set first passphrase: %v", err)
+	}
+	err = db.ChangePassphrase("second")
+	if err != nil {
+		t.Fatalf("could not change passphrase: %v", err)
+	}
+
+	db.Lock()
+	if db.ChangePassphrase("third") != ErrLocked {
+		t.Errorf("expected ErrLocked")
+	}
+	if db.Unlock("first") != crypto.ErrWrongPassphrase {
+		t.Errorf("old passphrase should not unlock")
+	}
+	err = db.Unlock("second")
+	if err != nil {
+		t.Fatalf("could not unlock with new passphrase: %v", err)
+	}
+	for name, key := range keys {
+		m, err := db.GetByName(name)
+		if err != nil || m.Key != key {
+			t.Errorf("%s: key differs after change: %v", name, err)
+		}
+	}
+
+	// a key the current master key can't unwrap aborts the change, and
+	// nothing is modified
+	foreign := testMasterKey(t, "foreign")
+	wrapped, err := foreign.WrapKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.db.Exec("insert into "+InfoTableName+" (name, key) values (?, ?)", "foreign", wrapped)
+	if err != nil {
+		t.Fatalf("could not insert foreign key: %v", err)
+	}
+	err = db.ChangePassphrase("third")
+	if err == nil {
+		t.Fatalf("expected error rewrapping a foreign key")
+	}
+	db.Lock()
+	err = db.Unlock("second")
+	if err != nil {
+		t.Fatalf("failed change should keep the old passphrase: %v", err)
+	}
+	for name, key := range keys {
+		m, err := db.GetByName(name)
+		if err != nil || m.Key != key {
+			t.Errorf("%s: key differs after failed change: %v", name, err)
+		}
+	}
+
+	// once the cause is gone, the change is simply run again
+	_, err = db.db.Exec("delete from "+InfoTableName+" where name = ?", "foreign")
+	if err == nil {
+		err = db.ChangePassphrase("third")
+	}
+	if err != nil {
+		t.Fatalf("could not change passphrase again: %v", err)
+	}
+	db.Lock()
+	err = db.Unlock("third")
+	if err != nil {
+		t.Fatalf("could not unlock with new passphrase: %v", err)
+	}
+	for name, key := range keys {
+		m, err := db.GetByName(name)
+		if err != nil || m.Key != key {
+			t.Errorf("%s: key differs after change run again: %v", name, err)
+		}
+	}
+}
@@ -9,130 +9,195 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/timothyham/bbackup/config"
+	"github.com/timothyham/bbackup/crypto"
 )
 
 const (
-	timeformat      = time.RFC3339
+	timeformat      = time.RFC3339Nano
 	InfoTableName   = "info"
 	ConfigTableName = "config"
-	selectQuery     = "select id, name, modified, size, perms, user, encname, encformat, key, iv, sha1, sha256, encsha1, encsha256" +
-		" from " + InfoTableName
+	infoColumns     = "name, modified, size, perms, user, encname, encformat, key, iv, hashes, enchashes, " +
+		"type, linktarget, grp, accessed, changed, inode, device, rdev, " +
+		"xattrencname, xattrkey, xattriv, xattrhash"
+	infoPlaceholders = "(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+	selectQuery      = "select id, " + infoColumns + " from " + InfoTableName
 )
 
 var NoResultError = errors.New("no results")
 
+// FileType is the kind of file an Info is.
+type FileType int
+
+const (
+	TypeFile FileType = iota // regular file, the only type before there were types
+	TypeDir
+	TypeSymlink
+	TypeHardlink // another name of the regular file LinkTarget in the same snapshot
+	TypeFIFO
+	TypeCharDevice
+	TypeBlockDevice
+)
+
+var fileTypeNames = []string{"file", "dir", "symlink", "hardlink", "fifo", "chardevice", "blockdevice"}
+
+func (t FileType) String() string {
+	if t < 0 || int(t) >= len(fileTypeNames) {
+		return "type" + strconv.Itoa(int(t))
+	}
+	return fileTypeNames[t]
+}
+
 type Info struct {
 	ID       int64
 	Name     string
 	Modified time.Time
 	Size     int64
-	Perms    int
+	Perms    int // permission bits, with the setuid, setgid and sticky bits
 	User     int
-
-	Encname   string
-	EncFormat int
+	Group    int
+
+	Type       FileType
+	LinkTarget string    // of a symlink, or the name a hardlink is another name of
+	Accessed   time.Time // zero for versions from before it was recorded
+	Changed    time.Time // the inode change time, which restoring can't set
+	Inode      uint64    // with Device, tells the names of a file with hardlinks
+	Device     uint64
+	Rdev       uint64 // the device a device file is
+
+	Encname   string // empty if the file is stored as chunks
+	EncFormat int    // crypto.Encryptor.Format() of the stored object
 	Key       string
 	IV        string
 
-	SHA1      string
-	SHA256    string
-	EncSHA1   string
-	EncSHA256 string
+	Hashes    crypto.Digests // of the plaintext
+	EncHashes crypto.Digests // of the stored object
+
+	// The extended attributes, POSIX ACLs among them, encoded with
+	// EncodeXattrs and encrypted to their own object. XattrEncname is
+	// empty if the file has none.
+	XattrEncname string
+	XattrKey     string
+	XattrIV      string
+	XattrHash    string // XattrHash of the attributes, to tell changes
 }
 
 type Db struct {
-	dbPath string
-	db     *sql.DB
+	dbPath   string
+	db       *sql.DB
+	master   *crypto.MasterKey // wraps per-file keys, nil while locked
+	identity *crypto.Identity  // unseals per-file keys sealed to recipients
+
+	sealedPath string // where Save writes a db opened with OpenSealedDb
 }
 
+// NewDb opens the db at dbPath, creating it if need be, and exits if it
+// can't be opened. See OpenDb.
 func NewDb(dbPath string) *Db {
+	db, err := OpenDb(dbPath)
+	if err != nil {
+		config.Logger.Fatal(err)
+		return nil
+	}
+	return db
+}
+
+// OpenDb opens the db at dbPath, creating it if need be, and migrates its
+// schema to the current version. ErrNewerSchema is returned for a db
+// written by a newer version.
+func OpenDb(dbPath string) (*Db, error) {
 	db := Db{}
 	db.dbPath = dbPath
 
 	sqlite, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		config.Logger.Fatal(err)
-		return nil
+		return nil, err
 	}
 	db.db = sqlite
-	err = db.createTableIfNotExists()
+	err = db.migrate()
 	if err != nil {
-		config.Logger.Fatal(err)
-		return nil
+		sqlite.Close()
+		return nil, err
 	}
-	return &db
+	return &db, nil
 }
 
-func (db *Db) createTableIfNotExists() error {
-	query := "create table if not exists " + InfoTableName +
-		" (id integer not null primary key, " +
-		"name text, " +
-		"modified text, " +
-		"size integer, " +
-		"perms integer, " +
-		"user integer, " +
-		"encname text, " +
-		"encformat integer, " +
-		"key text, " +
-		"iv text, " +
-		"sha1 integer, " +
-		"sha256 integer, " +
-		"encsha1 text, " +
-		"encsha256 text " +
-		");"
-
-	_, err := db.db.Exec(query)
+// Insert stores m as a new file version and sets its ID, or updates it
+// if it already has one.
+func (db *Db) Insert(m *Info) error {
+	if m.ID != 0 {
+		return db.Update(m)
+	}
+	values, err := db.infoValues(m)
 	if err != nil {
 		return err
 	}
-
-	query2 := "create table if not exists " + ConfigTableName +
-		" (id integer not null primary key, " +
-		"key text, " +
-		"value text " +
-		");"
-
-	_, err = db.db.Exec(query2)
+	query := "insert into " + InfoTableName +
+		" (" + infoColumns + ") values " + infoPlaceholders
+	res, err := db.db.Exec(query, values...)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	m.ID, err = res.LastInsertId()
+	return err
 }
 
-func (db *Db) Insert(m *Info) error {
-	query := ""
-	if m.ID == 0 {
-		query = "insert into " + InfoTableName +
-			" (name, modified, size, perms, user, encname, encformat, key, iv, sha1, sha256, encsha1, encsha256) values " +
-			"(?,?,?,?,?,?,?,?,?,?,?,?,?)"
-		err := db.execPreparedStmt(query,
-			m.Name, toModtime(m.Modified), m.Size, m.Perms, m.User, m.Encname, m.EncFormat,
-			m.Key, m.IV, m.SHA1, m.SHA256, m.EncSHA1, m.EncSHA256)
-		return err
-	} else {
-		return db.Update(m)
+// infoValues returns the values of infoColumns for m, with its key
+// wrapped.
+func (db *Db) infoValues(m *Info) ([]interface{}, error) {
+	key, err := db.wrapKey(m.Key)
+	if err != nil {
+		return nil, err
+	}
+	xattrKey, err := db.wrapKey(m.XattrKey)
+	if err != nil {
+		return nil, err
 	}
+	return []interface{}{m.Name, toModtime(m.Modified), m.Size, m.Perms, m.User,
+		m.Encname, m.EncFormat, key, m.IV, m.Hashes.String(), m.EncHashes.String(),
+		int(m.Type), m.LinkTarget, m.Group, toModtime(m.Accessed), toModtime(m.Changed),
+		int64(m.Inode), int64(m.Device), int64(m.Rdev),
+		m.XattrEncname, xattrKey, m.XattrIV, m.XattrHash}, nil
 }
 
 // rowsToInfo converts a row into info and closes the row
 func (db *Db) rowsToInfo(rows *sql.Rows) (*Info, error) {
-	var id, size int64
-	var perms, user, encformat int
-	var name, modified, encname, key, iv, sha1, sha256, encsha1, encsha256 string
+	var id, size, inode, device, rdev int64
+	var perms, user, group, encformat, filetype int
+	var name, modified, encname, key, iv, hashes, enchashes string
+	var linktarget, accessed, changed string
+	var xattrEncname, xattrKey, xattrIV, xattrHash string
 
 	var err error
 	if rows.Next() {
 		err = rows.Scan(&id, &name, &modified, &size, &perms, &user,
-			&encname, &encformat, &key, &iv, &sha1, &sha256, &encsha1, &encsha256)
+			&encname, &encformat, &key, &iv, &hashes, &enchashes,
+			&filetype, &linktarget, &group, &accessed, &changed, &inode, &device, &rdev,
+			&xattrEncname, &xattrKey, &xattrIV, &xattrHash)
 	} else {
 		return nil, NoResultError
 	}
 	err = rows.Err()
+	if err == nil {
+		key, err = db.unwrapKey(key)
+	}
+	if err == nil {
+		xattrKey, err = db.unwrapKey(xattrKey)
+	}
+	var inDigests, encDigests crypto.Digests
+	if err == nil {
+		inDigests, err = crypto.ParseDigests(hashes)
+	}
+	if err == nil {
+		encDigests, err = crypto.ParseDigests(enchashes)
+	}
 	modtime := toTime(modified)
 	info := &Info{ID: id, Name: name, Modified: modtime, Size: size, Perms: perms,
 		User: user, Encname: encname, EncFormat: encformat,
-		Key: key, IV: iv, SHA1: sha1, SHA256: sha256, EncSHA1: encsha1, EncSHA256: encsha256,
+		Key: key, IV: iv, Hashes: inDigests, EncHashes: encDigests,
+		Group: group, Type: FileType(filetype), LinkTarget: linktarget,
+		Accessed: toTime(accessed), Changed: toTime(changed),
+		Inode: uint64(inode), Device: uint64(device), Rdev: uint64(rdev),
+		XattrEncname: xattrEncname, XattrKey: xattrKey, XattrIV: xattrIV, XattrHash: xattrHash,
 	}
 	return info, err
 }
@@ -169,8 +234,11 @@ func (db *Db) GetByEncname(encname string) (*Info, error) {
 	return info, err
 }
 
+// GetByName returns the newest version of name, or NoResultError if
+// there is none. The version of a name in a snapshot is found with
+// GetInSnapshot or GetAsOf.
 func (db *Db) GetByName(name string) (*Info, error) {
-	query := selectQuery + " where name = ?"
+	query := selectQuery + " where name = ? order by id desc limit 1"
 
 	rows, err := db.execPreparedQuery(query, name)
 	if err != nil {
@@ -202,22 +270,37 @@ func (db *Db) GetById(sid string) (*Info, error) {
 }
 
 func (db *Db) Update(m *Info) error {
+	values, err := db.infoValues(m)
+	if err != nil {
+		return err
+	}
 	query := "update " + InfoTableName +
-		" set (name, modified, size, perms, user, encname, encformat, key, iv, " +
-		"sha1, sha256, encsha1, encsha256) = " +
-		"(?,?,?,?,?,?,?,?,?,?,?,?,?) where id = ?"
-	err := db.execPreparedStmt(query, m.Name, toModtime(m.Modified), m.Size, m.Perms,
-		m.User, m.Encname, m.EncFormat, m.Key, m.IV, m.SHA1, m.SHA256, m.EncSHA1, m.EncSHA256,
-		m.ID)
+		" set (" + infoColumns + ") = " + infoPlaceholders + " where id = ?"
+	err = db.execPreparedStmt(query, append(values, m.ID)...)
 	return err
 }
 
+// Delete removes m, its chunk list and its place in snapshots.
 func (db *Db) Delete(m *Info) error {
-	query := "delete from " + InfoTableName + " where id = ?"
-	err := db.execPreparedStmt(query, m.ID)
-	return err
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from "+FileChunkTableName+" where info = ?", m.ID)
+	if err == nil {
+		_, err = tx.Exec("delete from "+SnapshotFileTableName+" where info = ?", m.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("delete from "+InfoTableName+" where id = ?", m.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
+// GetAll returns every file version, ordered by name.
 func (db *Db) GetAll() ([]*Info, error) {
 	query := selectQuery + " order by name collate nocase asc"
 
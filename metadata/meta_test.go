@@ -4,6 +4,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/timothyham/bbackup/crypto"
 )
 
 var dbtest bool = true
@@ -20,18 +22,22 @@ func TestDbCrud(t *testing.T) {
 	if db == nil {
 		t.Errorf("No db created")
 	}
+	err := db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	m1 := Info{}
 	m1.IV = "1234"
 	m1.Key = "keykey"
 	m1.Encname = "abcdef"
 	m1.Name = "origname"
-	m1.EncSHA256 = "encsha256"
-	m1.SHA256 = "sha256"
+	m1.EncHashes = crypto.Digests{crypto.HashSHA256: "encsha256"}
+	m1.Hashes = crypto.Digests{crypto.HashSHA256: "sha256", crypto.HashBLAKE3: "blake3"}
 	m1.Size = 1234
 	m1.Modified, _ = time.Parse(time.RFC3339, "2017-09-03T14:16:17-07:00")
 
-	err := db.Insert(&m1)
+	err = db.Insert(&m1)
 	if err != nil {
 		t.Fatalf("could not save: %s\n", err.Error())
 	}
@@ -46,6 +52,9 @@ func TestDbCrud(t *testing.T) {
 	if m1.Size != m2.Size {
 		t.Errorf("Unexpected %v\n", m2.Size)
 	}
+	if !m1.Hashes.Equal(m2.Hashes) || !m1.EncHashes.Equal(m2.EncHashes) {
+		t.Errorf("Unexpected hashes %v %v\n", m2.Hashes, m2.EncHashes)
+	}
 
 	m2, err = db.GetByName(m1.Name)
 	if err != nil {
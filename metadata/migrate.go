@@ -0,0 +1,225 @@
+package info
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// config table key of the schema version of the db
+const schemaVersionKey = "schema.version"
+
+// ErrNewerSchema is returned when opening a db whose schema is newer than
+// this version knows.
+var ErrNewerSchema = errors.New("db schema is newer than supported")
+
+// migrations take the schema from one version to the next; migration i
+// brings it to version i+1. They are only ever appended to. Dbs from
+// before the schema version was recorded are at version 0, whatever
+// tables they already have, so the migrations up to chunkTables have to
+// cope with finding their changes already made.
+var migrations = []func(tx *sql.Tx) error{
+	createTables,
+	hashColumns,
+	chunkTables,
+	snapshotTables,
+	snapshotTags,
+	fileTypeColumns,
+	xattrColumns,
+}
+
+// SchemaVersion is the schema version this version of bbackup writes.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// migrate brings the schema of the db up to date. Each migration runs in
+// its own transaction, together with the update of the schema version,
+// so a failed migration leaves the db at the version before it.
+// ErrNewerSchema is returned if the db is newer than the migrations.
+func (db *Db) migrate() error {
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: version %d, at most %d", ErrNewerSchema, version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+		err = migrations[version](tx)
+		if err == nil {
+			err = setConfigTx(tx, schemaVersionKey, strconv.Itoa(version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema migration to version %d: %v", version+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the schema version recorded in the db, 0 if there
+// is none.
+func (db *Db) schemaVersion() (int, error) {
+	var n int
+	err := db.db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?",
+		ConfigTableName).Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	value, err := db.GetConfig(schemaVersionKey)
+	if err == NoResultError {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid schema version %q", value)
+	}
+	return version, nil
+}
+
+// createTables creates the info and config tables as they first were.
+func createTables(tx *sql.Tx) error {
+	queries := []string{
+		"create table if not exists " + InfoTableName +
+			" (id integer not null primary key, " +
+			"name text, " +
+			"modified text, " +
+			"size integer, " +
+			"perms integer, " +
+			"user integer, " +
+			"encname text, " +
+			"encformat integer, " +
+			"key text, " +
+			"iv text, " +
+			"sha1 integer, " +
+			"sha256 integer, " +
+			"encsha1 text, " +
+			"encsha256 text " +
+			");",
+		"create table if not exists " + ConfigTableName +
+			" (id integer not null primary key, " +
+			"key text, " +
+			"value text " +
+			");",
+	}
+	return execAll(tx, queries)
+}
+
+// hashColumns replaces the fixed sha1, sha256, encsha1 and encsha256
+// columns of the info table by the hashes and enchashes columns, filled
+// from them. The old columns are kept, unused. It is the only place
+// digests are converted; dbs that already had the columns before schema
+// versions were recorded are left as they are.
+func hashColumns(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, InfoTableName)
+	if err != nil || columns["hashes"] {
+		return err
+	}
+	queries := []string{
+		"alter table " + InfoTableName + " add column hashes text not null default ''",
+		"alter table " + InfoTableName + " add column enchashes text not null default ''",
+	}
+	if columns["sha1"] {
+		queries = append(queries, "update "+InfoTableName+" set "+
+			"hashes = trim(case when ifnull(sha1, '') != '' then 'sha1:' || sha1 else '' end || "+
+			"case when ifnull(sha256, '') != '' then ' sha256:' || sha256 else '' end), "+
+			"enchashes = trim(case when ifnull(encsha1, '') != '' then 'sha1:' || encsha1 else '' end || "+
+			"case when ifnull(encsha256, '') != '' then ' sha256:' || encsha256 else '' end)")
+	}
+	return execAll(tx, queries)
+}
+
+// chunkTables creates the tables of deduplicated files.
+func chunkTables(tx *sql.Tx) error {
+	queries := []string{
+		"create table if not exists " + ChunkTableName +
+			" (id integer not null primary key, " +
+			"chunkid text not null unique, " +
+			"encname text, " +
+			"encformat integer, " +
+			"key text, " +
+			"iv text, " +
+			"size integer " +
+			");",
+		// the chunk list of every deduplicated file, in order
+		"create table if not exists " + FileChunkTableName +
+			" (info integer not null, " +
+			"seq integer not null, " +
+			"chunk integer not null, " +
+			"primary key (info, seq) " +
+			");",
+		"create index if not exists " + FileChunkTableName + "_chunk on " +
+			FileChunkTableName + " (chunk);",
+	}
+	return execAll(tx, queries)
+}
+
+// fileTypeColumns adds the columns of the metadata of directories, links
+// and special files. The existing rows are all regular files.
+func fileTypeColumns(tx *sql.Tx) error {
+	queries := []string{
+		"alter table " + InfoTableName + " add column type integer not null default 0",
+		"alter table " + InfoTableName + " add column linktarget text not null default ''",
+		"alter table " + InfoTableName + " add column grp integer not null default 0",
+		"alter table " + InfoTableName + " add column accessed text not null default ''",
+		"alter table " + InfoTableName + " add column changed text not null default ''",
+		"alter table " + InfoTableName + " add column inode integer not null default 0",
+		"alter table " + InfoTableName + " add column device integer not null default 0",
+		"alter table " + InfoTableName + " add column rdev integer not null default 0",
+	}
+	return execAll(tx, queries)
+}
+
+// xattrColumns adds the columns of the object of the extended
+// attributes of a file.
+func xattrColumns(tx *sql.Tx) error {
+	queries := []string{
+		"alter table " + InfoTableName + " add column xattrencname text not null default ''",
+		"alter table " + InfoTableName + " add column xattrkey text not null default ''",
+		"alter table " + InfoTableName + " add column xattriv text not null default ''",
+		"alter table " + InfoTableName + " add column xattrhash text not null default ''",
+	}
+	return execAll(tx, queries)
+}
+
+func execAll(tx *sql.Tx, queries []string) error {
+	for _, query := range queries {
+		_, err := tx.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the names of the columns of table.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("select name from pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
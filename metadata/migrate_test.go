@@ -0,0 +1,185 @@
+package info
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+// baselineDb copies testdata/baseline.db to dir and returns its path. It
+// was written by the first version of bbackup, which had no schema
+// version, and holds docs/a.txt and docs/b.txt, encrypted to objects with
+// their keys in the clear. testdata/baseline-a.enc is the object of
+// docs/a.txt.
+func baselineDb(t *testing.T, dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "baseline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "baseline.db")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := baselineDb(t, dir)
+	db, err := OpenDb(path)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	version, err := db.schemaVersion()
+	if err != nil || version != SchemaVersion() {
+		t.Errorf("schema version %d %v", version, err)
+	}
+
+	m, err := db.GetByName("docs/a.txt")
+	if err != nil {
+		t.Fatalf("could not read migrated db: %v", err)
+	}
+	hashes := crypto.Digests{
+		crypto.HashSHA1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		crypto.HashSHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if m.Size != 5 || m.Perms != 0644 || m.User != 1000 || m.EncFormat != 1 || !m.Hashes.Equal(hashes) ||
+		len(m.EncHashes) != 2 || m.Type != TypeFile || m.LinkTarget != "" || !m.Accessed.IsZero() {
+		t.Errorf("unexpected info %+v", m)
+	}
+	// its key still decrypts its object
+	object, err := os.Open(filepath.Join("testdata", "baseline-a.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	dec, err := crypto.NewDecryptor(m.Key, m.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &bytes.Buffer{}
+	hash, err := dec.Encrypt(plain, object, false)
+	sha256 := crypto.HashSHA256
+	if err != nil || plain.String() != "hello" || hash.In[sha256] != m.EncHashes[sha256] {
+		t.Errorf("could not decrypt the object of the migrated file: %q %v", plain, err)
+	}
+
+	// the files backed up so far make up the first snapshot
+	latest, err := db.LatestSnapshot()
+	if err != nil {
+		t.Fatalf("no snapshot: %v", err)
+	}
+	files, err := db.SnapshotFiles(latest)
+	if err != nil || len(files) != 2 || files[0].Name != "docs/a.txt" || files[1].Name != "docs/b.txt" {
+		t.Errorf("unexpected snapshot files %v: %v", files, err)
+	}
+
+	// the migrated db takes new files, chunked ones too
+	c := &Chunk{ChunkID: "c1", Encname: "CHUNK1", Size: 3}
+	err = db.InsertChunk(c)
+	if err == nil {
+		err = db.InsertChunked(&Info{Name: "c"}, []*Chunk{c})
+	}
+	if err != nil {
+		t.Fatalf("could not insert chunked file: %v", err)
+	}
+	chunks, err := db.FileChunks(mustGetInfo(t, db, "c"))
+	if err != nil || len(chunks) != 1 {
+		t.Errorf("unexpected chunks %v %v", chunks, err)
+	}
+
+	// opening it again has nothing left to do
+	db.Close()
+	db, err = OpenDb(path)
+	if err != nil {
+		t.Fatalf("could not reopen: %v", err)
+	}
+	db.Close()
+}
+
+func TestMigrateNewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "new.db")
+	db, err := OpenDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetConfig(schemaVersionKey, strconv.Itoa(SchemaVersion()+1))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenDb(path)
+	if !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("expected ErrNewerSchema, got %v", err)
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := baselineDb(t, dir)
+
+	// a migration failing halfway through leaves no trace
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(append([]func(*sql.Tx) error{}, saved...), func(tx *sql.Tx) error {
+		_, err := tx.Exec("alter table " + InfoTableName + " add column extra text")
+		if err != nil {
+			return err
+		}
+		return errors.New("failed")
+	})
+	_, err = OpenDb(path)
+	if err == nil {
+		t.Fatalf("expected the failed migration to fail")
+	}
+
+	migrations = saved
+	db, err := OpenDb(path)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	defer db.Close()
+	version, err := db.schemaVersion()
+	if err != nil || version != len(saved) {
+		t.Errorf("schema version %d %v", version, err)
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	columns, err := tableColumns(tx, InfoTableName)
+	if err != nil || columns["extra"] {
+		t.Errorf("failed migration not rolled back: %v %v", columns, err)
+	}
+}
+
+// mustGetInfo returns the info of name in db
+func mustGetInfo(t *testing.T, db *Db, name string) *Info {
+	m, err := db.GetByName(name)
+	if err != nil {
+		t.Fatalf("%s: not in db: %v", name, err)
+	}
+	return m
+}
@@ -0,0 +1,92 @@
+package info
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+const recipientKeyPrefix = "recipient."
+
+// ErrNoRecipient is returned by RemoveRecipient for an unknown name.
+var ErrNoRecipient = errors.New("no such recipient")
+
+// NamedRecipient is a recipient stored in the config table.
+type NamedRecipient struct {
+	Name      string
+	Recipient *crypto.Recipient
+}
+
+// AddRecipient stores a recipient under name. Once a db has recipients,
+// per-file keys are sealed to all of them, and to the identity of the
+// master key, instead of being wrapped with the master key, so the db can
+// be written without a passphrase and still be restored with it.
+func (db *Db) AddRecipient(name string, r *crypto.Recipient) error {
+	if name == "" {
+		return errors.New("empty recipient name")
+	}
+	return db.SetConfig(recipientKeyPrefix+name, r.String())
+}
+
+// RemoveRecipient removes the recipient stored under name. Keys already
+// sealed to it are not changed.
+func (db *Db) RemoveRecipient(name string) error {
+	_, err := db.GetConfig(recipientKeyPrefix + name)
+	if err == NoResultError {
+		return ErrNoRecipient
+	}
+	if err != nil {
+		return err
+	}
+	return db.DeleteConfig(recipientKeyPrefix + name)
+}
+
+// Recipients returns the stored recipients ordered by name.
+func (db *Db) Recipients() ([]NamedRecipient, error) {
+	values, err := db.configWithPrefix(recipientKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]NamedRecipient, 0, len(values))
+	for name, value := range values {
+		r, err := crypto.ParseRecipient(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, NamedRecipient{Name: name, Recipient: r})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// SetIdentity sets the identity used to unseal keys on read. Without it,
+// sealed keys are returned unchanged.
+func (db *Db) SetIdentity(id *crypto.Identity) {
+	db.identity = id
+}
+
+// sealKey seals key to the stored recipients and the recipient of the
+// master key, if there is one. ok is false if there are no recipients.
+// A db with a master key that was never unlocked since keys were sealed
+// to it seals keys to its recipients only; restoring them needs one of
+// their identities.
+func (db *Db) sealKey(key string) (sealed string, ok bool, err error) {
+	named, err := db.Recipients()
+	if err != nil || len(named) == 0 {
+		return "", false, err
+	}
+	recipients := make([]*crypto.Recipient, len(named))
+	for i, n := range named {
+		recipients[i] = n.Recipient
+	}
+	master, err := db.masterRecipient()
+	if err != nil {
+		return "", false, err
+	}
+	if master != nil {
+		recipients = append(recipients, master)
+	}
+	sealed, err = crypto.SealKey(key, recipients)
+	return sealed, true, err
+}
@@ -0,0 +1,124 @@
+package info
+
+import (
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+func TestRecipients(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	err := db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatalf("could not init master key: %v", err)
+	}
+	db.Lock() // the backup host doesn't know the passphrase
+
+	id := testIdentity(t)
+	other := testIdentity(t)
+	err = db.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatalf("could not add recipient: %v", err)
+	}
+	err = db.AddRecipient("other", other.Recipient())
+	if err != nil {
+		t.Fatalf("could not add recipient: %v", err)
+	}
+	recipients, err := db.Recipients()
+	if err != nil || len(recipients) != 2 || recipients[0].Name != "offline" {
+		t.Fatalf("unexpected recipients %v: %v", recipients, err)
+	}
+
+	key := testKey(t)
+	err = db.Insert(&Info{Name: "a", Encname: "a", Key: key})
+	if err != nil {
+		t.Fatalf("could not insert with recipients: %v", err)
+	}
+	m, err := db.GetByName("a")
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if !crypto.IsSealed(m.Key) {
+		t.Errorf("expected sealed key without identity")
+	}
+
+	db.SetIdentity(id)
+	m, err = db.GetByName("a")
+	if err != nil || m.Key != key {
+		t.Errorf("could not unseal with identity: %v", err)
+	}
+
+	err = db.RemoveRecipient("other")
+	if err != nil {
+		t.Fatalf("could not remove recipient: %v", err)
+	}
+	if db.RemoveRecipient("other") != ErrNoRecipient {
+		t.Errorf("expected ErrNoRecipient")
+	}
+	recipients, _ = db.Recipients()
+	if len(recipients) != 1 {
+		t.Errorf("unexpected recipients after remove %v", recipients)
+	}
+}
+
+func TestRecipientsMasterKey(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	err := db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatalf("could not init master key: %v", err)
+	}
+	db.Lock()
+	id := testIdentity(t)
+	err = db.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatalf("could not add recipient: %v", err)
+	}
+	key := testKey(t)
+	err = db.Insert(&Info{Name: "a", Encname: "a", Key: key})
+	if err != nil {
+		t.Fatalf("could not insert with recipients: %v", err)
+	}
+
+	// the passphrase restores keys sealed while locked
+	err = db.Unlock("correct horse")
+	if err != nil {
+		t.Fatalf("could not unlock: %v", err)
+	}
+	m, err := db.GetByName("a")
+	if err != nil || m.Key != key {
+		t.Errorf("could not unseal with master key: %v", err)
+	}
+
+	// and so does the new one after a change, as does the recipient
+	err = db.ChangePassphrase("battery staple")
+	if err != nil {
+		t.Fatalf("could not change passphrase: %v", err)
+	}
+	db.Lock()
+	err = db.Unlock("battery staple")
+	if err != nil {
+		t.Fatalf("could not unlock with new passphrase: %v", err)
+	}
+	m, err = db.GetByName("a")
+	if err != nil || m.Key != key {
+		t.Errorf("could not unseal with new master key: %v", err)
+	}
+	db.Lock()
+	db.SetIdentity(id)
+	m, err = db.GetByName("a")
+	if err != nil || m.Key != key {
+		t.Errorf("could not unseal with identity after change: %v", err)
+	}
+}
+
+func testIdentity(t *testing.T) *crypto.Identity {
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
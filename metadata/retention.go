@@ -0,0 +1,176 @@
+package info
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RetentionPolicy says which snapshots to keep. A snapshot is kept if any
+// rule keeps it. The Last, Hourly, Daily, Weekly, Monthly and Yearly
+// rules keep the newest snapshot of that many of the most recent periods
+// that have one, Last counting each snapshot as its own period.
+type RetentionPolicy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+
+	// Within keeps the snapshots taken at most this long before the
+	// newest one, so that snapshots are not forgotten just because
+	// backups stopped.
+	Within time.Duration
+
+	// Tags keeps the snapshots with any of these tags.
+	Tags []string
+}
+
+// RetentionDecision is what a RetentionPolicy decided for a snapshot.
+type RetentionDecision struct {
+	Snapshot *Snapshot
+	Keep     bool
+	Reasons  []string // the rules that keep it
+}
+
+// Empty reports whether p has no rules, which would forget every
+// snapshot.
+func (p RetentionPolicy) Empty() bool {
+	return p.Last <= 0 && p.Hourly <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 &&
+		p.Yearly <= 0 && p.Within <= 0 && len(p.Tags) == 0
+}
+
+// retentionRule keeps the newest snapshot of each of n periods.
+type retentionRule struct {
+	name   string
+	n      int
+	period func(s *Snapshot) string
+}
+
+// Apply decides which of snapshots p keeps. The decisions are in the
+// order of the snapshots, newest first.
+func (p RetentionPolicy) Apply(snapshots []*Snapshot) []RetentionDecision {
+	sorted := append([]*Snapshot{}, snapshots...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].ID > sorted[j].ID
+		}
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+	rules := []retentionRule{
+		{"last", p.Last, func(s *Snapshot) string { return strconv.FormatInt(s.ID, 10) }},
+		{"hourly", p.Hourly, func(s *Snapshot) string { return s.Time.Format("2006-01-02 15") }},
+		{"daily", p.Daily, func(s *Snapshot) string { return s.Time.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(s *Snapshot) string {
+			year, week := s.Time.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{"monthly", p.Monthly, func(s *Snapshot) string { return s.Time.Format("2006-01") }},
+		{"yearly", p.Yearly, func(s *Snapshot) string { return s.Time.Format("2006") }},
+	}
+	last := make([]string, len(rules)) // period of the snapshot each rule kept last
+
+	decisions := make([]RetentionDecision, 0, len(sorted))
+	for _, s := range sorted {
+		d := RetentionDecision{Snapshot: s}
+		for i := range rules {
+			r := &rules[i]
+			if r.n <= 0 {
+				continue
+			}
+			if period := r.period(s); period != last[i] {
+				last[i] = period
+				r.n--
+				d.Reasons = append(d.Reasons, r.name)
+			}
+		}
+		if p.Within > 0 && sorted[0].Time.Sub(s.Time) <= p.Within {
+			d.Reasons = append(d.Reasons, "within "+p.Within.String())
+		}
+		for _, tag := range p.Tags {
+			if s.HasTag(tag) {
+				d.Reasons = append(d.Reasons, "tag "+tag)
+			}
+		}
+		d.Keep = len(d.Reasons) > 0
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// Forgotten is what Forget dropped from the db. The objects of its file
+// versions and chunks are no longer referenced, and can be removed.
+type Forgotten struct {
+	Snapshots []*Snapshot
+	Files     []*Info  // versions no remaining snapshot holds
+	Chunks    []*Chunk // chunks no remaining version refers to
+}
+
+// Forget removes snapshots, then the file versions no snapshot holds any
+// more, and then the chunks no version refers to any more, in one
+// transaction. With no snapshots it only removes what is left over from
+// failed backup runs. If dryRun is set, the transaction is rolled back,
+// so only what would be removed is returned.
+func (db *Db) Forget(snapshots []*Snapshot, dryRun bool) (*Forgotten, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	forgotten, err := db.forgetTx(tx, snapshots)
+	if err != nil || dryRun {
+		tx.Rollback()
+		return forgotten, err
+	}
+	return forgotten, tx.Commit()
+}
+
+func (db *Db) forgetTx(tx *sql.Tx, snapshots []*Snapshot) (*Forgotten, error) {
+	f := &Forgotten{Snapshots: snapshots}
+	for _, s := range snapshots {
+		_, err := tx.Exec("delete from "+SnapshotFileTableName+" where snapshot = ?", s.ID)
+		if err == nil {
+			_, err = tx.Exec("delete from "+SnapshotTableName+" where id = ?", s.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(selectQuery + " where id not in (select info from " + SnapshotFileTableName + ")")
+	if err != nil {
+		return nil, err
+	}
+	f.Files, err = db.rowsToInfos(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range f.Files {
+		_, err = tx.Exec("delete from "+FileChunkTableName+" where info = ?", m.ID)
+		if err == nil {
+			_, err = tx.Exec("delete from "+InfoTableName+" where id = ?", m.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err = tx.Query(selectChunkQuery + " where id not in (select chunk from " + FileChunkTableName + ")")
+	if err != nil {
+		return nil, err
+	}
+	f.Chunks, err = db.scanChunks(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range f.Chunks {
+		_, err = tx.Exec("delete from "+ChunkTableName+" where id = ?", c.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
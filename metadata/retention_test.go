@@ -0,0 +1,143 @@
+package info
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	day := time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+	// two snapshots a day for ten days, newest first, one of them tagged
+	snapshots := make([]*Snapshot, 0)
+	for i := 0; i < 20; i++ {
+		s := &Snapshot{ID: int64(20 - i), Time: day.Add(-time.Duration(i) * 12 * time.Hour)}
+		if i == 15 {
+			s.Tags = []string{"release"}
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	kept := func(policy RetentionPolicy) []int64 {
+		ids := make([]int64, 0)
+		decisions := policy.Apply(snapshots)
+		for i, d := range decisions {
+			if d.Snapshot != snapshots[i] {
+				t.Fatalf("decision %d is about snapshot %d", i, d.Snapshot.ID)
+			}
+			if d.Keep != (len(d.Reasons) > 0) {
+				t.Errorf("snapshot %d: kept %v for %v", d.Snapshot.ID, d.Keep, d.Reasons)
+			}
+			if d.Keep {
+				ids = append(ids, d.Snapshot.ID)
+			}
+		}
+		return ids
+	}
+	tests := []struct {
+		policy RetentionPolicy
+		ids    []int64
+	}{
+		{RetentionPolicy{Last: 3}, []int64{20, 19, 18}},
+		{RetentionPolicy{Daily: 3}, []int64{20, 18, 16}},
+		{RetentionPolicy{Last: 2, Daily: 3}, []int64{20, 19, 18, 16}},
+		{RetentionPolicy{Hourly: 100}, []int64{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{RetentionPolicy{Within: 36 * time.Hour}, []int64{20, 19, 18, 17}},
+		{RetentionPolicy{Tags: []string{"release", "other"}}, []int64{5}},
+		{RetentionPolicy{Monthly: 2}, []int64{20, 12}},
+		{RetentionPolicy{Yearly: 5}, []int64{20}},
+	}
+	for _, test := range tests {
+		if ids := kept(test.policy); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%+v kept %v, expected %v", test.policy, ids, test.ids)
+		}
+	}
+
+	// 2021-03-04 is a thursday, so the week before starts on 02-22, and
+	// the oldest snapshot is in it
+	if ids := kept(RetentionPolicy{Weekly: 3}); !reflect.DeepEqual(ids, []int64{20, 12}) {
+		t.Errorf("weekly kept %v", ids)
+	}
+	if !(RetentionPolicy{}).Empty() || (RetentionPolicy{Within: time.Hour}).Empty() {
+		t.Errorf("unexpected Empty")
+	}
+}
+
+func TestForget(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	// a is in both snapshots, b1 only in the first and b2 in the second;
+	// b1 and b2 share a chunk
+	a := &Info{Name: "a", Encname: "a1"}
+	err := db.Insert(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, only := &Chunk{ChunkID: "shared", Encname: "c1"}, &Chunk{ChunkID: "only", Encname: "c2"}
+	b1, b2 := &Info{Name: "b"}, &Info{Name: "b"}
+	for _, c := range []*Chunk{shared, only} {
+		if err = db.InsertChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.InsertChunked(b1, []*Chunk{shared, only}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.InsertChunked(b2, []*Chunk{shared}); err != nil {
+		t.Fatal(err)
+	}
+	first := &Snapshot{Time: time.Unix(1000, 0), Tags: []string{"a", "b"}}
+	second := &Snapshot{Time: time.Unix(2000, 0)}
+	if err = db.InsertSnapshot(first, []*Info{a, b1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.InsertSnapshot(second, []*Info{a, b2}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.InsertSnapshot(&Snapshot{Tags: []string{"a b"}}, nil); err == nil {
+		t.Errorf("expected an invalid tag to fail")
+	}
+	snapshots, err := db.Snapshots()
+	if err != nil || len(snapshots) != 2 || !reflect.DeepEqual(snapshots[0].Tags, []string{"a", "b"}) ||
+		len(snapshots[1].Tags) != 0 {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+
+	check := func(f *Forgotten) {
+		if len(f.Snapshots) != 1 || len(f.Files) != 1 || f.Files[0].ID != b1.ID ||
+			len(f.Chunks) != 1 || f.Chunks[0].ID != only.ID {
+			t.Errorf("unexpected forgotten %+v", f)
+		}
+	}
+	f, err := db.Forget([]*Snapshot{first}, true)
+	if err != nil {
+		t.Fatalf("could not forget: %v", err)
+	}
+	check(f)
+	if snapshots, _ = db.Snapshots(); len(snapshots) != 2 {
+		t.Errorf("dry run forgot snapshots")
+	}
+	if chunks, _ := db.FileChunks(b1); len(chunks) != 2 {
+		t.Errorf("dry run forgot chunks")
+	}
+
+	f, err = db.Forget([]*Snapshot{first}, false)
+	if err != nil {
+		t.Fatalf("could not forget: %v", err)
+	}
+	check(f)
+	if snapshots, _ = db.Snapshots(); len(snapshots) != 1 || snapshots[0].ID != second.ID {
+		t.Errorf("unexpected snapshots %v", snapshots)
+	}
+	m, err := db.GetAsOf("b", second.Time)
+	if err != nil || m.ID != b2.ID {
+		t.Errorf("unexpected version %v: %v", m, err)
+	}
+	if chunks, err := db.FileChunks(m); err != nil || len(chunks) != 1 || chunks[0].ID != shared.ID {
+		t.Errorf("unexpected chunks %v: %v", chunks, err)
+	}
+	if _, err = db.GetChunk("only"); err != NoResultError {
+		t.Errorf("expected NoResultError, got %v", err)
+	}
+}
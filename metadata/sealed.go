@@ -0,0 +1,409 @@
+package info
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+// A sealed db is the SQLite file encrypted at rest, so it can be stored
+// next to the backup data. It starts with the line
+//
+//	bbackup-db 1 <salt> <time> <memory> <threads> <wrapped key>
+//
+// holding the Argon2id parameters of the master key and a fresh db key
+// wrapped with it, followed by the db file as a crypto stream under the
+// db key, compressed and padded. A db with recipients starts with the line
+//
+//	bbackup-db 2 <salt> <time> <memory> <threads> <wrapped key> <sealed key>
+//
+// instead, the db key being sealed to the recipients and to the identity
+// of the master key as well. Fields the db has no value for, such as the
+// wrapped key of a db written without its master key unlocked, are "-".
+const sealedDbMagic = "bbackup-db"
+
+// the longest header line accepted
+const maxSealedHeader = 1024
+
+// ErrNotSealed is returned when reading a sealed db from something else.
+var ErrNotSealed = errors.New("not a sealed db")
+
+// IsSealedDb reports whether the file at path is a sealed db.
+func IsSealedDb(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(sealedDbMagic)+1)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == sealedDbMagic+" "
+}
+
+// OpenSealedDb opens the sealed db at sealedPath with passphrase. The db
+// is decrypted to a private temporary working copy, which Save and Close
+// seal back to sealedPath. If sealedPath does not exist, a new db is
+// created with a master key derived from passphrase.
+func OpenSealedDb(sealedPath, passphrase string) (*Db, error) {
+	return openSealedDb(sealedPath, passphraseKey(passphrase), func(db *Db) error {
+		return db.InitMasterKey(passphrase)
+	})
+}
+
+// OpenSealedDbWithKey opens the existing sealed db at sealedPath with an
+// already derived master key, such as one combined from shares.
+func OpenSealedDbWithKey(sealedPath string, master *crypto.MasterKey) (*Db, error) {
+	return openSealedDb(sealedPath, givenKey(master), nil)
+}
+
+// deriveFunc returns the master key for the parameters of a sealed db.
+type deriveFunc func(crypto.KDFParams) (*crypto.MasterKey, error)
+
+// passphraseKey returns a function deriving the master key from
+// passphrase.
+func passphraseKey(passphrase string) deriveFunc {
+	return func(params crypto.KDFParams) (*crypto.MasterKey, error) {
+		return crypto.DeriveMasterKey(passphrase, params)
+	}
+}
+
+// givenKey returns a function returning master, already derived.
+func givenKey(master *crypto.MasterKey) deriveFunc {
+	return func(crypto.KDFParams) (*crypto.MasterKey, error) {
+		return master, nil
+	}
+}
+
+// openSealedDb opens the sealed db at sealedPath with the master key
+// returned by derive. If sealedPath does not exist, init sets up the new
+// db, or os.ErrNotExist is returned if init is nil.
+func openSealedDb(sealedPath string, derive deriveFunc, init func(*Db) error) (*Db, error) {
+	if init == nil {
+		if _, err := os.Stat(sealedPath); err != nil {
+			return nil, err
+		}
+	}
+	work, err := ioutil.TempFile("", "bbackup-*.db")
+	if err != nil {
+		return nil, err
+	}
+	workPath := work.Name()
+	fail := func(err error) (*Db, error) {
+		work.Close()
+		os.Remove(workPath)
+		return nil, err
+	}
+
+	in, err := os.Open(sealedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fail(err)
+	}
+	var master *crypto.MasterKey
+	if err == nil {
+		master, err = readSealedDb(in, derive, nil, work)
+		in.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+	err = work.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	db, err := OpenDb(workPath)
+	if err != nil {
+		os.Remove(workPath)
+		return nil, err
+	}
+	db.sealedPath = sealedPath
+	if master == nil {
+		err = init(db)
+	} else {
+		err = db.UnlockWithKey(master)
+	}
+	if err != nil {
+		db.db.Close()
+		os.Remove(workPath)
+		return nil, err
+	}
+	return db, nil
+}
+
+// Save seals the working copy of a db opened with OpenSealedDb back to
+// its sealed path. The sealed file is replaced atomically.
+func (db *Db) Save() error {
+	if db.sealedPath == "" {
+		return errors.New("db is not sealed")
+	}
+	tmpPath := db.sealedPath + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = db.WriteSealed(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, db.sealedPath)
+}
+
+// Close closes the db. A db opened with OpenSealedDb is saved first and
+// its working copy removed; if saving fails the working copy is kept and
+// its path is part of the error.
+func (db *Db) Close() error {
+	if db.sealedPath == "" {
+		return db.db.Close()
+	}
+	err := db.Save()
+	cerr := db.db.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%v, working copy kept at %s", err, db.dbPath)
+	}
+	return os.Remove(db.dbPath)
+}
+
+// WriteSealed writes the db to out as a sealed db. The db key is wrapped
+// with the master key if the db is unlocked, and sealed to the recipients
+// of the db if it has any, so a db without a passphrase can be written
+// too. ErrLocked or ErrNoMasterKey is returned if it has neither.
+func (db *Db) WriteSealed(out io.Writer) error {
+	enc, err := crypto.NewEncryptor()
+	if err != nil {
+		return err
+	}
+	enc.SetCompression(crypto.CompressionZstd)
+	enc.SetPadding(crypto.PaddingPadme)
+	header, err := db.sealedHeader(enc.GetKey())
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(db.dbPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.WriteString(out, header)
+	if err != nil {
+		return err
+	}
+	w := crypto.NewEncryptWriter(enc, out)
+	_, err = io.Copy(w, in)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// sealedHeader returns the header line of a sealed db under key.
+func (db *Db) sealedHeader(key string) (string, error) {
+	sealed, ok, err := db.sealKey(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok && db.master == nil {
+		if db.HasMasterKey() {
+			return "", ErrLocked
+		}
+		return "", ErrNoMasterKey
+	}
+	fields := []string{"-", "-", "-", "-", "-"}
+	if db.HasMasterKey() {
+		params, err := db.KDFParams()
+		if err != nil {
+			return "", err
+		}
+		fields = []string{base64.RawURLEncoding.EncodeToString(params.Salt),
+			strconv.FormatUint(uint64(params.Time), 10),
+			strconv.FormatUint(uint64(params.Memory), 10),
+			strconv.FormatUint(uint64(params.Threads), 10), "-"}
+	}
+	if db.master != nil {
+		fields[4], err = db.master.WrapKey(key)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		return fmt.Sprintf("%s 1 %s\n", sealedDbMagic, strings.Join(fields, " ")), nil
+	}
+	return fmt.Sprintf("%s 2 %s %s\n", sealedDbMagic, strings.Join(fields, " "), sealed), nil
+}
+
+// RecoverDb writes the db sealed in r to a new plain db at dbPath, and
+// returns it unlocked with passphrase.
+func RecoverDb(r io.Reader, passphrase, dbPath string) (*Db, error) {
+	return recoverDb(r, passphraseKey(passphrase), nil, dbPath)
+}
+
+// RecoverDbWithKey is RecoverDb with an already derived master key, such
+// as one from a paper key.
+func RecoverDbWithKey(r io.Reader, master *crypto.MasterKey, dbPath string) (*Db, error) {
+	return recoverDb(r, givenKey(master), nil, dbPath)
+}
+
+// RecoverDbWithIdentity is RecoverDb for a db sealed to its recipients,
+// which id is one of. The db is returned with id set, and its master key,
+// if any, locked.
+func RecoverDbWithIdentity(r io.Reader, id *crypto.Identity, dbPath string) (*Db, error) {
+	return recoverDb(r, nil, id, dbPath)
+}
+
+func recoverDb(r io.Reader, derive deriveFunc, id *crypto.Identity, dbPath string) (*Db, error) {
+	out, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	master, err := readSealedDb(r, derive, id, out)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dbPath)
+		return nil, err
+	}
+	db, err := OpenDb(dbPath)
+	if err != nil {
+		os.Remove(dbPath)
+		return nil, err
+	}
+	if master == nil {
+		db.SetIdentity(id)
+		return db, nil
+	}
+	err = db.UnlockWithKey(master)
+	if err != nil {
+		db.db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// readSealedDb decrypts a sealed db from in to out. If derive is set, the
+// key is unwrapped, or unsealed, with the master key derive returns for
+// the parameters of the db, which is returned; crypto.ErrWrongPassphrase
+// is returned if it is the wrong key. Otherwise the key is unsealed with
+// id, and no master key is returned.
+func readSealedDb(in io.Reader, derive deriveFunc, id *crypto.Identity, out io.Writer) (*crypto.MasterKey, error) {
+	r := bufio.NewReaderSize(in, maxSealedHeader)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, ErrNotSealed
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != sealedDbMagic {
+		return nil, ErrNotSealed
+	}
+	var master *crypto.MasterKey
+	var key string
+	switch {
+	case fields[1] == "1" && len(fields) == 7:
+		if derive == nil {
+			return nil, ErrNoMasterKey
+		}
+		master, key, err = unwrapSealedKey(fields[2:6], fields[6], "-", derive)
+	case fields[1] == "2" && len(fields) == 8:
+		switch {
+		case derive != nil && fields[2] != "-":
+			master, key, err = unwrapSealedKey(fields[2:6], fields[6], fields[7], derive)
+		case id != nil:
+			key, err = id.UnsealKey(fields[7])
+		default:
+			return nil, crypto.ErrNoIdentity
+		}
+	case fields[1] == "1" || fields[1] == "2":
+		return nil, ErrNotSealed
+	default:
+		return nil, fmt.Errorf("unsupported sealed db version %s", fields[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec, err := crypto.NewDecryptor(key, "")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dec.Encrypt(out, r, false)
+	if err != nil {
+		return nil, err
+	}
+	return master, nil
+}
+
+// unwrapSealedKey returns the master key derive returns for the salt,
+// time, memory and threads in fields, and the db key unwrapped from
+// wrapped with it, or unsealed from sealed if the db was written with the
+// master key locked.
+func unwrapSealedKey(fields []string, wrapped, sealed string, derive deriveFunc) (*crypto.MasterKey, string, error) {
+	params := crypto.KDFParams{}
+	var err error
+	params.Salt, err = base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return nil, "", err
+	}
+	values := []struct {
+		s    string
+		bits int
+		set  func(uint64)
+	}{
+		{fields[1], 32, func(v uint64) { params.Time = uint32(v) }},
+		{fields[2], 32, func(v uint64) { params.Memory = uint32(v) }},
+		{fields[3], 8, func(v uint64) { params.Threads = uint8(v) }},
+	}
+	for _, v := range values {
+		n, err := strconv.ParseUint(v.s, 10, v.bits)
+		if err != nil {
+			return nil, "", err
+		}
+		v.set(n)
+	}
+	err = params.Check()
+	if err != nil {
+		return nil, "", err
+	}
+
+	master, err := derive(params)
+	if err != nil {
+		return nil, "", err
+	}
+	if wrapped == "-" {
+		key, err := master.Identity().UnsealKey(sealed)
+		if err == crypto.ErrNoIdentity {
+			return nil, "", crypto.ErrWrongPassphrase
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return master, key, nil
+	}
+	err = master.Check(crypto.WrappedKeyID(wrapped))
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := master.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, "", err
+	}
+	return master, key, nil
+}
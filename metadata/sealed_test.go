@@ -0,0 +1,214 @@
+package info
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+func TestSealedDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sealedPath := filepath.Join(dir, "sealed.db")
+
+	db, err := OpenSealedDb(sealedPath, "correct horse")
+	if err != nil {
+		t.Fatalf("could not create sealed db: %v", err)
+	}
+	key := testKey(t)
+	err = db.Insert(&Info{Name: "secret-name.txt", Encname: "enc", Key: key, Size: 1234})
+	if err != nil {
+		t.Fatalf("could not insert: %v", err)
+	}
+	workPath := db.dbPath
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+	if _, err := os.Stat(workPath); !os.IsNotExist(err) {
+		t.Errorf("working copy left behind: %v", err)
+	}
+
+	sealed, err := ioutil.ReadFile(sealedPath)
+	if err != nil {
+		t.Fatalf("could not read sealed db: %v", err)
+	}
+	if !IsSealedDb(sealedPath) {
+		t.Errorf("not recognized as sealed")
+	}
+	if bytes.Contains(sealed, []byte("secret-name")) || bytes.Contains(sealed, []byte("SQLite")) {
+		t.Errorf("sealed db contains plaintext")
+	}
+
+	_, err = OpenSealedDb(sealedPath, "battery staple")
+	if err != crypto.ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	db, err = OpenSealedDb(sealedPath, "correct horse")
+	if err != nil {
+		t.Fatalf("could not open sealed db: %v", err)
+	}
+	m, err := db.GetByName("secret-name.txt")
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if m.Key != key || m.Size != 1234 {
+		t.Errorf("unexpected row %+v", m)
+	}
+
+	// the new passphrase is used to seal from now on
+	err = db.ChangePassphrase("battery staple")
+	if err != nil {
+		t.Fatalf("could not change passphrase: %v", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+	db, err = OpenSealedDb(sealedPath, "battery staple")
+	if err != nil {
+		t.Fatalf("could not open with new passphrase: %v", err)
+	}
+	db.Close()
+
+	plain := filepath.Join(dir, "plain.db")
+	ioutil.WriteFile(plain, []byte("SQLite format 3\x00"), 0600)
+	if IsSealedDb(plain) {
+		t.Errorf("plain db recognized as sealed")
+	}
+	_, err = OpenSealedDb(plain, "correct horse")
+	if err != ErrNotSealed {
+		t.Errorf("expected ErrNotSealed, got %v", err)
+	}
+}
+
+func TestSealedDbBadHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sealedPath := filepath.Join(dir, "sealed.db")
+
+	// parameters that would panic deriving the key, or exhaust memory
+	for _, params := range []string{"0 1024 1", "1 1024 0", "1 4294967295 1"} {
+		header := "bbackup-db 1 MDEyMzQ1Njc4OWFiY2RlZg " + params + " w1.0011223344556677.AA\n"
+		ioutil.WriteFile(sealedPath, []byte(header), 0600)
+		_, err = OpenSealedDb(sealedPath, "correct horse")
+		if !errors.Is(err, crypto.ErrBadKDFParams) {
+			t.Errorf("%s: expected ErrBadKDFParams, got %v", params, err)
+		}
+	}
+}
+
+func TestSealedDbWithKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sealedPath := filepath.Join(dir, "sealed.db")
+
+	_, err = OpenSealedDbWithKey(sealedPath, testMasterKey(t, "x"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a missing sealed db not to be created, got %v", err)
+	}
+	db, err := OpenSealedDb(sealedPath, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := db.MasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenSealedDbWithKey(sealedPath, master)
+	if err != nil {
+		t.Fatalf("could not open with the master key: %v", err)
+	}
+	err = db.ChangePassphrase("battery staple")
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenSealedDb(sealedPath, "battery staple")
+	if err != nil {
+		t.Fatalf("could not open with the new passphrase: %v", err)
+	}
+	db.Close()
+}
+
+func TestSealedDbRecipients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbackup")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sealedPath := filepath.Join(dir, "sealed.db")
+	id := testIdentity(t)
+
+	db, err := OpenSealedDb(sealedPath, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddRecipient("offline", id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Insert(&Info{Name: "a", Encname: "a", Key: testKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written unlocked and then locked, both can be read with either
+	for _, locked := range []bool{false, true} {
+		if locked {
+			db.Lock()
+		}
+		out := &bytes.Buffer{}
+		err = db.WriteSealed(out)
+		if err != nil {
+			t.Fatalf("locked %v: could not write: %v", locked, err)
+		}
+		recoverWith := func(name string, derive deriveFunc, id *crypto.Identity) error {
+			recovered, err := recoverDb(bytes.NewReader(out.Bytes()), derive, id, filepath.Join(dir, name))
+			if err == nil {
+				recovered.Close()
+			}
+			return err
+		}
+		name := "unlocked"
+		if locked {
+			name = "locked"
+		}
+		err = recoverWith(name+"-passphrase.db", passphraseKey("correct horse"), nil)
+		if err != nil {
+			t.Errorf("locked %v: could not recover with passphrase: %v", locked, err)
+		}
+		err = recoverWith(name+"-identity.db", nil, id)
+		if err != nil {
+			t.Errorf("locked %v: could not recover with identity: %v", locked, err)
+		}
+		err = recoverWith(name+"-wrong.db", passphraseKey("battery staple"), nil)
+		if err != crypto.ErrWrongPassphrase {
+			t.Errorf("locked %v: expected ErrWrongPassphrase, got %v", locked, err)
+		}
+	}
+	db.db.Close()
+	os.Remove(db.dbPath)
+}
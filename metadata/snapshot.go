@@ -0,0 +1,244 @@
+package info
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	SnapshotTableName     = "snapshots"
+	SnapshotFileTableName = "snapshotfiles"
+	selectSnapshotQuery   = "select id, time, root, tags from " + SnapshotTableName
+)
+
+// Snapshot is a backup run. It holds the versions of the files present
+// at the time of the run; a file that did not change between runs has
+// the same version in both.
+type Snapshot struct {
+	ID   int64
+	Time time.Time
+	Root string   // the directory backed up
+	Tags []string // kept by retention policies naming any of them
+}
+
+// InsertSnapshot stores s with its file versions, which must have been
+// inserted, in one transaction, and sets its ID.
+func (db *Db) InsertSnapshot(s *Snapshot, files []*Info) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = insertSnapshotTx(tx, s, files)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertSnapshotTx(tx *sql.Tx, s *Snapshot, files []*Info) error {
+	for _, tag := range s.Tags {
+		if !ValidTag(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	res, err := tx.Exec("insert into "+SnapshotTableName+" (time, root, tags) values (?,?,?)",
+		s.Time.UnixNano(), s.Root, strings.Join(s.Tags, " "))
+	if err != nil {
+		return err
+	}
+	s.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("insert into " + SnapshotFileTableName + " (snapshot, info) values (?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range files {
+		_, err = stmt.Exec(s.ID, m.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshots returns all snapshots, oldest first.
+func (db *Db) Snapshots() ([]*Snapshot, error) {
+	rows, err := db.db.Query(selectSnapshotQuery + " order by time, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshots := make([]*Snapshot, 0)
+	for rows.Next() {
+		s, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
+}
+
+// LatestSnapshot returns the newest snapshot, or NoResultError if there
+// is none.
+func (db *Db) LatestSnapshot() (*Snapshot, error) {
+	return db.querySnapshot(selectSnapshotQuery + " order by time desc, id desc limit 1")
+}
+
+// SnapshotAsOf returns the newest snapshot taken at or before t, or
+// NoResultError if there is none.
+func (db *Db) SnapshotAsOf(t time.Time) (*Snapshot, error) {
+	return db.querySnapshot(selectSnapshotQuery+" where time <= ? order by time desc, id desc limit 1", t.UnixNano())
+}
+
+// querySnapshot returns the first snapshot query finds, or NoResultError.
+func (db *Db) querySnapshot(query string, args ...interface{}) (*Snapshot, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, NoResultError
+	}
+	return scanSnapshot(rows)
+}
+
+// SnapshotFiles returns the file versions of s, ordered by name.
+func (db *Db) SnapshotFiles(s *Snapshot) ([]*Info, error) {
+	query := selectQuery + " where id in (select info from " + SnapshotFileTableName +
+		" where snapshot = ?) order by name asc"
+	rows, err := db.execPreparedQuery(query, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := db.rowsToInfos(rows)
+	rows.Close()
+	return infos, err
+}
+
+// GetInSnapshot returns the version of name in s, or NoResultError if s
+// does not have it.
+func (db *Db) GetInSnapshot(s *Snapshot, name string) (*Info, error) {
+	query := selectQuery + " where name = ? and id in (select info from " + SnapshotFileTableName +
+		" where snapshot = ?)"
+	rows, err := db.execPreparedQuery(query, name, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := db.rowsToInfo(rows)
+	rows.Close()
+	return info, err
+}
+
+// GetAsOf returns the version of name in the newest snapshot taken at or
+// before t, or NoResultError if there is no such snapshot or the file was
+// not in it.
+func (db *Db) GetAsOf(name string, t time.Time) (*Info, error) {
+	s, err := db.SnapshotAsOf(t)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetInSnapshot(s, name)
+}
+
+// OrphanedFiles returns the file versions no snapshot holds, such as
+// those of a backup run that failed. They can be removed with Delete.
+func (db *Db) OrphanedFiles() ([]*Info, error) {
+	query := selectQuery + " where id not in (select info from " + SnapshotFileTableName + ")"
+	rows, err := db.execPreparedQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := db.rowsToInfos(rows)
+	rows.Close()
+	return infos, err
+}
+
+// HasTag reports whether s is tagged tag.
+func (s *Snapshot) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidTag reports whether tag can be given to a snapshot: it must not be
+// empty, and must not contain spaces or commas.
+func ValidTag(tag string) bool {
+	return tag != "" && strings.IndexFunc(tag, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	}) < 0
+}
+
+func scanSnapshot(rows *sql.Rows) (*Snapshot, error) {
+	s := &Snapshot{}
+	var t int64
+	var tags string
+	err := rows.Scan(&s.ID, &t, &s.Root, &tags)
+	if err != nil {
+		return nil, err
+	}
+	s.Time = time.Unix(0, t)
+	s.Tags = strings.Fields(tags)
+	return s, nil
+}
+
+// snapshotTables creates the snapshot tables, and a first snapshot of
+// the files already backed up, which until now were simply the current
+// ones.
+func snapshotTables(tx *sql.Tx) error {
+	queries := []string{
+		"create table " + SnapshotTableName +
+			" (id integer not null primary key, " +
+			"time integer not null, " + // unix nanoseconds
+			"root text not null default '' " +
+			");",
+		// the file versions of every snapshot
+		"create table " + SnapshotFileTableName +
+			" (snapshot integer not null, " +
+			"info integer not null, " +
+			"primary key (snapshot, info) " +
+			");",
+		"create index " + SnapshotFileTableName + "_info on " +
+			SnapshotFileTableName + " (info);",
+	}
+	err := execAll(tx, queries)
+	if err != nil {
+		return err
+	}
+	var n int
+	err = tx.QueryRow("select count(*) from " + InfoTableName).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	res, err := tx.Exec("insert into "+SnapshotTableName+" (time) values (?)", time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into "+SnapshotFileTableName+" (snapshot, info) select ?, id from "+
+		InfoTableName, id)
+	return err
+}
+
+// snapshotTags adds the tags of snapshots, a space separated list.
+func snapshotTags(tx *sql.Tx) error {
+	_, err := tx.Exec("alter table " + SnapshotTableName + " add column tags text not null default ''")
+	return err
+}
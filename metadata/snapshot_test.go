@@ -0,0 +1,97 @@
+package info
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshots(t *testing.T) {
+	db, cleanup := tempDb(t)
+	defer cleanup()
+
+	if _, err := db.LatestSnapshot(); err != NoResultError {
+		t.Errorf("expected NoResultError, got %v", err)
+	}
+	insert := func(name, encname string) *Info {
+		m := &Info{Name: name, Encname: encname}
+		err := db.Insert(m)
+		if err != nil || m.ID == 0 {
+			t.Fatalf("could not insert %s: %v", name, err)
+		}
+		return m
+	}
+	day := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	// a is unchanged in the second snapshot, b changed and c is gone
+	a, b1, c := insert("a", "a1"), insert("b", "b1"), insert("c", "c1")
+	first := &Snapshot{Time: day, Root: "/root"}
+	err := db.InsertSnapshot(first, []*Info{a, b1, c})
+	if err != nil {
+		t.Fatalf("could not insert snapshot: %v", err)
+	}
+	b2 := insert("b", "b2")
+	second := &Snapshot{Time: day.Add(24 * time.Hour), Root: "/root"}
+	err = db.InsertSnapshot(second, []*Info{a, b2})
+	if err != nil {
+		t.Fatalf("could not insert snapshot: %v", err)
+	}
+	orphan := insert("b", "b3")
+
+	snapshots, err := db.Snapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[0].ID != first.ID ||
+		!snapshots[1].Time.Equal(second.Time) || snapshots[1].Root != "/root" {
+		t.Errorf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	latest, err := db.LatestSnapshot()
+	if err != nil || latest.ID != second.ID {
+		t.Errorf("unexpected latest snapshot %v: %v", latest, err)
+	}
+	files, err := db.SnapshotFiles(first)
+	if err != nil || len(files) != 3 || files[0].ID != a.ID || files[1].ID != b1.ID || files[2].ID != c.ID {
+		t.Errorf("unexpected files %v: %v", files, err)
+	}
+
+	asOf := []struct {
+		name string
+		t    time.Time
+		m    *Info
+	}{
+		{"b", day.Add(-time.Second), nil},
+		{"b", day, b1},
+		{"b", day.Add(time.Hour), b1},
+		{"b", day.Add(48 * time.Hour), b2},
+		{"a", day.Add(48 * time.Hour), a},
+		{"c", day.Add(time.Hour), c},
+		{"c", day.Add(48 * time.Hour), nil},
+	}
+	for _, test := range asOf {
+		m, err := db.GetAsOf(test.name, test.t)
+		if test.m == nil {
+			if err != NoResultError {
+				t.Errorf("%s as of %v: expected NoResultError, got %v %v", test.name, test.t, m, err)
+			}
+		} else if err != nil || m.ID != test.m.ID {
+			t.Errorf("%s as of %v: unexpected version %v: %v", test.name, test.t, m, err)
+		}
+	}
+
+	// the newest version need not be in a snapshot
+	m, err := db.GetByName("b")
+	if err != nil || m.ID != orphan.ID {
+		t.Errorf("unexpected newest version %v: %v", m, err)
+	}
+	orphans, err := db.OrphanedFiles()
+	if err != nil || len(orphans) != 1 || orphans[0].ID != orphan.ID {
+		t.Errorf("unexpected orphans %v: %v", orphans, err)
+	}
+
+	// a deleted version leaves its snapshots
+	err = db.Delete(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err = db.SnapshotFiles(first)
+	if err != nil || len(files) != 2 {
+		t.Errorf("unexpected files %v: %v", files, err)
+	}
+}
@@ -0,0 +1,78 @@
+package info
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+// xattrsVersion is the first byte of encoded extended attributes.
+const xattrsVersion = 1
+
+// ErrInvalidXattrs is returned when decoding extended attributes fails.
+var ErrInvalidXattrs = errors.New("invalid extended attributes")
+
+// Xattr is an extended attribute of a file. POSIX ACLs are the
+// system.posix_acl_access and system.posix_acl_default attributes.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// EncodeXattrs encodes xattrs as a version byte followed by the length
+// prefixed name and value of each, in the order of their names.
+func EncodeXattrs(xattrs []Xattr) []byte {
+	sorted := append([]Xattr{}, xattrs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	data := []byte{xattrsVersion}
+	var n [binary.MaxVarintLen64]byte
+	for _, x := range sorted {
+		data = append(data, n[:binary.PutUvarint(n[:], uint64(len(x.Name)))]...)
+		data = append(data, x.Name...)
+		data = append(data, n[:binary.PutUvarint(n[:], uint64(len(x.Value)))]...)
+		data = append(data, x.Value...)
+	}
+	return data
+}
+
+// DecodeXattrs decodes what EncodeXattrs encoded.
+func DecodeXattrs(data []byte) ([]Xattr, error) {
+	if len(data) == 0 || data[0] != xattrsVersion {
+		return nil, ErrInvalidXattrs
+	}
+	data = data[1:]
+	next := func() ([]byte, error) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || n > uint64(len(data)-size) {
+			return nil, ErrInvalidXattrs
+		}
+		field := data[size : size+int(n)]
+		data = data[size+int(n):]
+		return field, nil
+	}
+	xattrs := make([]Xattr, 0)
+	for len(data) > 0 {
+		name, err := next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, Xattr{Name: string(name), Value: append([]byte{}, value...)})
+	}
+	return xattrs, nil
+}
+
+// XattrHash returns the hash of the encoding of xattrs keyed with key, the
+// dedup key of the db, or "" if there are none. It is stored in the clear
+// to tell whether the attributes changed, so it must not reveal them.
+func XattrHash(key *crypto.DedupKey, xattrs []Xattr) string {
+	if len(xattrs) == 0 {
+		return ""
+	}
+	return key.MetadataHash(EncodeXattrs(xattrs))
+}
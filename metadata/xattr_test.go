@@ -0,0 +1,73 @@
+package info
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/timothyham/bbackup/crypto"
+)
+
+func TestXattrs(t *testing.T) {
+	xattrs := []Xattr{
+		{Name: "user.comment", Value: []byte("hello")},
+		{Name: "security.capability", Value: []byte{1, 0, 0, 2, 0, 32, 0, 0}},
+		{Name: "user.empty", Value: []byte{}},
+	}
+	data := EncodeXattrs(xattrs)
+	decoded, err := DecodeXattrs(data)
+	if err != nil {
+		t.Fatalf("could not decode: %v", err)
+	}
+	expected := []Xattr{xattrs[1], xattrs[0], xattrs[2]}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("decoded %v, expected %v", decoded, expected)
+	}
+	key, err := crypto.NewDedupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewDedupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if XattrHash(key, xattrs) != XattrHash(key, expected) || XattrHash(key, xattrs) == XattrHash(key, xattrs[1:]) ||
+		XattrHash(key, xattrs) == XattrHash(other, xattrs) || XattrHash(key, nil) != "" {
+		t.Errorf("unexpected hashes")
+	}
+
+	for _, bad := range [][]byte{nil, {2}, data[:len(data)-1], append(data, 5)} {
+		if _, err = DecodeXattrs(bad); err != ErrInvalidXattrs {
+			t.Errorf("%v: expected ErrInvalidXattrs, got %v", bad, err)
+		}
+	}
+
+	// the object of the attributes is stored with the version, its key
+	// wrapped like the others
+	db, cleanup := tempDb(t)
+	defer cleanup()
+	err = db.InitMasterKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Info{Name: "a", XattrEncname: "X", XattrKey: "xattrkey", XattrIV: "iv", XattrHash: XattrHash(key, xattrs)}
+	err = db.Insert(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	err = db.db.QueryRow("select xattrkey from "+InfoTableName+" where id = ?", m.ID).Scan(&stored)
+	if err != nil || stored == "xattrkey" {
+		t.Errorf("xattr key stored as %q: %v", stored, err)
+	}
+	got := mustGetInfo(t, db, "a")
+	if got.XattrEncname != "X" || got.XattrKey != "xattrkey" || got.XattrIV != "iv" || got.XattrHash != m.XattrHash {
+		t.Errorf("unexpected info %+v", got)
+	}
+	err = db.ChangePassphrase("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got = mustGetInfo(t, db, "a"); got.XattrKey != "xattrkey" {
+		t.Errorf("xattr key %q after changing the passphrase", got.XattrKey)
+	}
+}